@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -36,6 +37,9 @@ const (
 	TRACKER_ERR_BUNDLE_DOWNLOAD_TIMEOUT = iota + 1
 	TRACKER_ERR_BUNDLE_BAD_CHECKSUM
 	TRACKER_ERR_DEPLOYMENT_BAD_JSON
+	TRACKER_ERR_DEPLOYMENT_ROLLED_BACK
+	TRACKER_ERR_DEPLOYMENT_BAD_CONFIG
+	TRACKER_ERR_BUNDLE_DOWNLOAD_FAILED
 )
 
 const (
@@ -43,8 +47,23 @@ const (
 	API_ERR_BAD_JSON
 	API_ERR_BAD_CONTENT
 	API_ERR_INTERNAL
+	API_ERR_UNAUTHORIZED
+	API_ERR_FORBIDDEN
+	API_ERR_MISSING_FIELD
+	API_ERR_BAD_FIELD
+	API_ERR_UNKNOWN_DEPLOYMENT
 )
 
+// outcome of each result of a partially accepted PUT /deployments
+const (
+	RESULT_OUTCOME_ACCEPTED = "ACCEPTED"
+	RESULT_OUTCOME_REJECTED = "REJECTED"
+	RESULT_OUTCOME_UNKNOWN  = "UNKNOWN"
+)
+
+// PUT /deployments?partial=true applies the valid results and responds with the outcome of each
+const partialQueryParam = "partial"
+
 const (
 	sqlTimeFormat    = "2006-01-02 15:04:05.999 -0700 MST"
 	iso8601          = "2006-01-02T15:04:05.999Z07:00"
@@ -58,13 +77,6 @@ type deploymentsResult struct {
 	eTag        string
 }
 
-var (
-	deploymentsChanged = make(chan interface{}, 5)
-	addSubscriber      = make(chan chan deploymentsResult)
-	removeSubscriber   = make(chan chan deploymentsResult)
-	eTag               int64
-)
-
 type errorResponse struct {
 	ErrorCode int    `json:"errorCode"`
 	Reason    string `json:"reason"`
@@ -81,26 +93,68 @@ type ApiDeployment struct {
 	BundleConfigJson json.RawMessage `json:"bundleConfiguration"`
 	DisplayName      string          `json:"displayName"`
 	URI              string          `json:"uri"`
+	Org              string          `json:"org,omitempty"`
+	Env              string          `json:"env,omitempty"`
 }
 
 // sent to client
 type ApiDeploymentResponse []ApiDeployment
 
 type apiDeploymentResult struct {
-	ID        string `json:"id"`
-	Status    string `json:"status"`
-	ErrorCode int    `json:"errorCode"`
-	Message   string `json:"message"`
+	ID         string             `json:"id"`
+	Status     string             `json:"status"`
+	ErrorCode  int                `json:"errorCode"`
+	Message    string             `json:"message"`
+	GatewayID  string             `json:"gatewayId,omitempty"`  // received from client
+	Gateways   []apiGatewayResult `json:"gateways,omitempty"`   // sent to tracker
+	Violations []schemaViolation  `json:"violations,omitempty"` // sent to tracker
 }
 
 // received from client
 type apiDeploymentResults []apiDeploymentResult
 
+// a problem with the result at Index of a PUT /deployments request
+type apiResultError struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id"`
+	Field     string `json:"field"`
+	ErrorCode int    `json:"errorCode"`
+	Reason    string `json:"reason"`
+}
+
+type apiResultErrorResponse struct {
+	ErrorCode int              `json:"errorCode"`
+	Reason    string           `json:"reason"`
+	Errors    []apiResultError `json:"errors"`
+}
+
+type apiResultOutcome struct {
+	Index   int              `json:"index"`
+	ID      string           `json:"id"`
+	Outcome string           `json:"outcome"`
+	Errors  []apiResultError `json:"errors,omitempty"`
+}
+
+// sent to client for a partially accepted PUT /deployments
+type apiResultOutcomes struct {
+	Results []apiResultOutcome `json:"results"`
+}
+
 const deploymentsEndpoint = "/deployments"
 
+// InitAPI registers the deployments API
+func (gd *GatewayDeploy) InitAPI() {
+	gd.services.API().HandleFunc(deploymentsEndpoint,
+		gd.instrumentAPI(gd.authorize(PERMISSION_READ, gd.apiGetCurrentDeployments))).Methods("GET")
+	gd.services.API().HandleFunc(deploymentsEndpoint,
+		gd.instrumentAPI(gd.authorize(PERMISSION_REPORT, gd.apiSetDeploymentResults))).Methods("PUT")
+	gd.initWebhooksAPI()
+	gd.initPeersAPI()
+}
+
+// InitAPI registers the deployments API of the instance registered with apid
 func InitAPI() {
-	services.API().HandleFunc(deploymentsEndpoint, apiGetCurrentDeployments).Methods("GET")
-	services.API().HandleFunc(deploymentsEndpoint, apiSetDeploymentResults).Methods("PUT")
+	plugin.InitAPI()
 }
 
 func writeError(w http.ResponseWriter, status int, code int, reason string) {
@@ -122,11 +176,16 @@ func writeDatabaseError(w http.ResponseWriter) {
 	writeError(w, http.StatusInternalServerError, API_ERR_INTERNAL, "database error")
 }
 
-func debounce(in chan interface{}, out chan []interface{}, window time.Duration) {
+// debounce() runs until in is closed or stop is closed
+func debounce(in chan interface{}, out chan []interface{}, window time.Duration, clock Clock,
+	stop <-chan struct{}) {
 	send := func(toSend []interface{}) {
 		if toSend != nil {
 			log.Debugf("debouncer sending: %v", toSend)
-			out <- toSend
+			select {
+			case out <- toSend:
+			case <-stop:
+			}
 		}
 	}
 	var toSend []interface{}
@@ -142,18 +201,49 @@ func debounce(in chan interface{}, out chan []interface{}, window time.Duration)
 				close(out)
 				return
 			}
-		case <-time.After(window):
+		case <-clock.After(window):
 			send(toSend)
 			toSend = nil
+		case <-stop:
+			log.Debugf("stopping debouncer")
+			return
 		}
 	}
 }
 
-func distributeEvents() {
+// notifyDeploymentsChanged() tells distributeEvents() that the deployments changed. Nothing listens once shutting
+// down, so the change is dropped then.
+func (gd *GatewayDeploy) notifyDeploymentsChanged(change interface{}) {
+	select {
+	case gd.deploymentsChanged <- change:
+	case <-gd.lifecycle.stop:
+	}
+}
+
+// distributeEvents() runs until stop is closed. Long-polling subscribers are answered by their handlers.
+func (gd *GatewayDeploy) distributeEvents(stop <-chan struct{}) {
 	subscribers := make(map[chan deploymentsResult]struct{})
 	deliverDeployments := make(chan []interface{}, 1)
 
-	go debounce(deploymentsChanged, deliverDeployments, debounceDuration)
+	go debounce(gd.deploymentsChanged, deliverDeployments, gd.debounceDuration, gd.clock, stop)
+
+	deliver := func() {
+		subs := subscribers
+		subscribers = make(map[chan deploymentsResult]struct{})
+		atomic.StoreInt64(&gd.longPollSubscribers, 0)
+		go func() {
+			eTag := gd.incrementETag()
+			deployments, err := gd.getReadyDeployments()
+			log.Debugf("delivering deployments to %d subscribers", len(subs))
+			for subscriber := range subs {
+				log.Debugf("delivering to: %v", subscriber)
+				subscriber <- deploymentsResult{deployments, err, eTag}
+			}
+			if err == nil {
+				gd.notifyWebhooks(deployments, eTag)
+			}
+		}()
+	}
 
 	for {
 		select {
@@ -161,28 +251,28 @@ func distributeEvents() {
 			if !ok {
 				return // todo: using this?
 			}
-			subs := subscribers
-			subscribers = make(map[chan deploymentsResult]struct{})
-			go func() {
-				eTag := incrementETag()
-				deployments, err := getReadyDeployments()
-				log.Debugf("delivering deployments to %d subscribers", len(subs))
-				for subscriber := range subs {
-					log.Debugf("delivering to: %v", subscriber)
-					subscriber <- deploymentsResult{deployments, err, eTag}
-				}
-			}()
-		case subscriber := <-addSubscriber:
+			deliver()
+			gd.triggerWindowReschedule()
+		case t := <-gd.windowBoundaryReached:
+			log.Debugf("deployment activation window boundary reached at %s", t)
+			deliver()
+			gd.triggerWindowReschedule()
+		case subscriber := <-gd.addSubscriber:
 			log.Debugf("Add subscriber: %v", subscriber)
 			subscribers[subscriber] = struct{}{}
-		case subscriber := <-removeSubscriber:
+			atomic.StoreInt64(&gd.longPollSubscribers, int64(len(subscribers)))
+		case subscriber := <-gd.removeSubscriber:
 			log.Debugf("Remove subscriber: %v", subscriber)
 			delete(subscribers, subscriber)
+			atomic.StoreInt64(&gd.longPollSubscribers, int64(len(subscribers)))
+		case <-stop:
+			atomic.StoreInt64(&gd.longPollSubscribers, 0)
+			return
 		}
 	}
 }
 
-func apiGetCurrentDeployments(w http.ResponseWriter, r *http.Request) {
+func (gd *GatewayDeploy) apiGetCurrentDeployments(w http.ResponseWriter, r *http.Request) {
 
 	// If returning without a bundle (immediately or after timeout), status = 404
 	// If returning If-None-Match value is equal to current deployment, status = 304
@@ -209,7 +299,7 @@ func apiGetCurrentDeployments(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("if-none-match: %s", ifNoneMatch)
 
 	// send unmodified if matches prior eTag and no timeout
-	eTag := getETag()
+	eTag := gd.getETag()
 	if eTag == ifNoneMatch && timeout == 0 {
 		w.WriteHeader(http.StatusNotModified)
 		return
@@ -217,7 +307,14 @@ func apiGetCurrentDeployments(w http.ResponseWriter, r *http.Request) {
 
 	// send results if different eTag
 	if eTag != ifNoneMatch {
-		sendReadyDeployments(w)
+		gd.sendReadyDeployments(w, r)
+		return
+	}
+
+	// don't block while shutting down
+	l := gd.lifecycle
+	if l.stopping() {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
@@ -225,7 +322,12 @@ func apiGetCurrentDeployments(w http.ResponseWriter, r *http.Request) {
 	var newDeploymentsChannel chan deploymentsResult
 	if timeout > 0 && ifNoneMatch != "" {
 		newDeploymentsChannel = make(chan deploymentsResult, 1)
-		addSubscriber <- newDeploymentsChannel
+		select {
+		case gd.addSubscriber <- newDeploymentsChannel:
+		case <-l.stop:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 	}
 
 	log.Debug("Blocking request... Waiting for new Deployments.")
@@ -235,47 +337,69 @@ func apiGetCurrentDeployments(w http.ResponseWriter, r *http.Request) {
 		if result.err != nil {
 			writeDatabaseError(w)
 		} else {
-			sendDeployments(w, result.deployments, result.eTag)
+			gd.sendDeployments(w, r, result.deployments, result.eTag)
 		}
 
-	case <-time.After(time.Duration(timeout) * time.Second):
-		removeSubscriber <- newDeploymentsChannel
+	case <-l.stop:
+		log.Debug("Blocking deployment request ended by shutdown.")
+		w.WriteHeader(http.StatusNotModified)
+
+	case <-gd.clock.After(time.Duration(timeout) * time.Second):
+		select {
+		case gd.removeSubscriber <- newDeploymentsChannel:
+		case <-l.stop:
+		}
 		log.Debug("Blocking deployment request timed out.")
 		if ifNoneMatch != "" {
 			w.WriteHeader(http.StatusNotModified)
 		} else {
-			sendReadyDeployments(w)
+			gd.sendReadyDeployments(w, r)
 		}
 	}
 }
 
-func sendReadyDeployments(w http.ResponseWriter) {
-	eTag := getETag()
-	deployments, err := getReadyDeployments()
+func (gd *GatewayDeploy) sendReadyDeployments(w http.ResponseWriter, r *http.Request) {
+	eTag := gd.getETag()
+	deployments, err := gd.getReadyDeployments()
 	if err != nil {
 		writeDatabaseError(w)
 		return
 	}
-	sendDeployments(w, deployments, eTag)
+	gd.sendDeployments(w, r, deployments, eTag)
 }
 
-func sendDeployments(w http.ResponseWriter, dataDeps []DataDeployment, eTag string) {
+func (gd *GatewayDeploy) sendDeployments(w http.ResponseWriter, r *http.Request, dataDeps []DataDeployment,
+	eTag string) {
+
+	dataDeps = gd.resolveConfigs(dataDeps, eTag)
+	rollouts, err := gd.getRolloutViews(dataDeps)
+	if err != nil {
+		writeDatabaseError(w)
+		return
+	}
+	gd.changeLog.record(eTag, dataDeps, rollouts, gd.deltaHistory)
+
+	client := clientFromRequest(r)
+	gw := gatewayFromRequest(r)
+	dataDeps = filterDeploymentsForClient(client, dataDeps)
+	dataDeps = filterDeploymentsForGateway(gw, dataDeps, rollouts)
+
+	if wantsDelta(r) {
+		since := r.Header.Get("If-None-Match")
+		sent := func(id string, e deltaEntry) bool {
+			return client.inScope(e.scopeID) && e.rollout.includes(id, gw)
+		}
+		if delta, ok := gd.changeLog.delta(since, sent, dataDeps); ok {
+			sendDelta(w, delta, since, eTag)
+			return
+		}
+		log.Debugf("no deployments delta from %s, sending all", since)
+	}
 
 	apiDeps := ApiDeploymentResponse{}
 
 	for _, d := range dataDeps {
-		apiDeps = append(apiDeps, ApiDeployment{
-			ID:               d.ID,
-			ScopeId:          d.DataScopeID,
-			Created:          convertTime(d.Created),
-			CreatedBy:        d.CreatedBy,
-			Updated:          convertTime(d.Updated),
-			UpdatedBy:        d.UpdatedBy,
-			BundleConfigJson: []byte(d.BundleConfigJSON),
-			ConfigJson:       []byte(d.ConfigJSON),
-			DisplayName:      d.BundleName,
-			URI:              d.LocalBundleURI,
-		})
+		apiDeps = append(apiDeps, apiDeploymentFromData(d))
 	}
 
 	b, err := json.Marshal(apiDeps)
@@ -290,7 +414,24 @@ func sendDeployments(w http.ResponseWriter, dataDeps []DataDeployment, eTag stri
 	w.Write(b)
 }
 
-func apiSetDeploymentResults(w http.ResponseWriter, r *http.Request) {
+func apiDeploymentFromData(d DataDeployment) ApiDeployment {
+	return ApiDeployment{
+		ID:               d.ID,
+		ScopeId:          d.DataScopeID,
+		Created:          convertTime(d.Created),
+		CreatedBy:        d.CreatedBy,
+		Updated:          convertTime(d.Updated),
+		UpdatedBy:        d.UpdatedBy,
+		BundleConfigJson: []byte(d.BundleConfigJSON),
+		ConfigJson:       []byte(d.ConfigJSON),
+		DisplayName:      d.BundleName,
+		URI:              d.LocalBundleURI,
+		Org:              d.Org,
+		Env:              d.Env,
+	}
+}
+
+func (gd *GatewayDeploy) apiSetDeploymentResults(w http.ResponseWriter, r *http.Request) {
 
 	var results apiDeploymentResults
 	buf, _ := ioutil.ReadAll(r.Body)
@@ -301,64 +442,182 @@ func apiSetDeploymentResults(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	partial := r.URL.Query().Get(partialQueryParam) == "true"
+
+	outcomes := make([]apiResultOutcome, len(results))
+	var resultErrs []apiResultError
+	reject := func(errs ...apiResultError) {
+		for _, e := range errs {
+			outcomes[e.Index].Outcome = RESULT_OUTCOME_REJECTED
+			outcomes[e.Index].Errors = append(outcomes[e.Index].Errors, e)
+		}
+		resultErrs = append(resultErrs, errs...)
+	}
+
 	// validate the results
-	// todo: these errors to the client should be standardized
-	var errs bytes.Buffer
 	var validResults apiDeploymentResults
+	var validIndexes []int
+	gatewayID := r.Header.Get(gatewayIDHeader)
 	for i, result := range results {
-		valid := true
-		if result.ID == "" {
-			errs.WriteString(fmt.Sprintf("Missing id at %d\n", i))
+		outcomes[i] = apiResultOutcome{Index: i, ID: result.ID, Outcome: RESULT_OUTCOME_ACCEPTED}
+		if result.GatewayID == "" {
+			result.GatewayID = gatewayID
 		}
+		result.Gateways = nil
+		result.Violations = nil
 
-		if result.Status != RESPONSE_STATUS_SUCCESS && result.Status != RESPONSE_STATUS_FAIL {
-			errs.WriteString(fmt.Sprintf("status must be '%s' or '%s' at %d\n",
-				RESPONSE_STATUS_SUCCESS, RESPONSE_STATUS_FAIL, i))
+		if errs := validateDeploymentResult(i, result); len(errs) > 0 {
+			reject(errs...)
+			continue
 		}
+		validResults = append(validResults, result)
+		validIndexes = append(validIndexes, i)
+	}
 
-		if result.Status == RESPONSE_STATUS_FAIL {
-			if result.ErrorCode == 0 {
-				errs.WriteString(fmt.Sprintf("errorCode is required for status == fail at %d\n", i))
-			}
-			if result.Message == "" {
-				errs.WriteString(fmt.Sprintf("message are required for status == fail at %d\n", i))
+	if len(resultErrs) > 0 && !partial {
+		writeResultErrors(w, http.StatusBadRequest, API_ERR_BAD_CONTENT, "invalid deployment results", resultErrs)
+		return
+	}
+
+	outOfScope, err := gd.resultsOutOfScope(clientFromRequest(r), validResults)
+	if err != nil {
+		writeDatabaseError(w)
+		return
+	}
+	if len(outOfScope) > 0 {
+		if !partial {
+			writeError(w, http.StatusForbidden, API_ERR_FORBIDDEN,
+				fmt.Sprintf("deployments not in client scope: %s", strings.Join(outOfScope, ", ")))
+			return
+		}
+		forbidden := make(map[string]bool, len(outOfScope))
+		for _, id := range outOfScope {
+			forbidden[id] = true
+		}
+		var inScope apiDeploymentResults
+		var inScopeIndexes []int
+		for j, result := range validResults {
+			if forbidden[result.ID] {
+				reject(apiResultError{validIndexes[j], result.ID, "id", API_ERR_FORBIDDEN, "deployment not in client scope"})
+				continue
 			}
+			inScope = append(inScope, result)
+			inScopeIndexes = append(inScopeIndexes, validIndexes[j])
 		}
+		validResults, validIndexes = inScope, inScopeIndexes
+	}
 
-		if valid {
-			validResults = append(validResults, result)
+	var unknown map[string]bool
+	if len(validResults) > 0 {
+		unknown, err = gd.setGatewayResults(validResults)
+		if err == nil {
+			err = gd.updateRollouts(validResults)
+		}
+		if err != nil {
+			writeDatabaseError(w)
+			return
 		}
 	}
 
-	if errs.Len() > 0 {
-		writeError(w, http.StatusBadRequest, API_ERR_BAD_CONTENT, errs.String())
+	if !partial {
+		w.Write([]byte("OK"))
 		return
 	}
 
-	if len(validResults) > 0 {
-		setDeploymentResults(validResults)
+	for j, result := range validResults {
+		if unknown[result.ID] {
+			i := validIndexes[j]
+			outcomes[i].Outcome = RESULT_OUTCOME_UNKNOWN
+			outcomes[i].Errors = append(outcomes[i].Errors,
+				apiResultError{i, result.ID, "id", API_ERR_UNKNOWN_DEPLOYMENT, "no deployment with this id"})
+		}
 	}
 
-	w.Write([]byte("OK"))
+	b, err := json.Marshal(apiResultOutcomes{outcomes})
+	if err != nil {
+		log.Errorf("unable to marshal result outcomes: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(b)
 }
 
-func addHeaders(req *http.Request) {
-	var token = services.Config().GetString("apigeesync_bearer_token")
-	req.Header.Add("Authorization", "Bearer "+token)
+// validateDeploymentResult() returns the problems with the result at index i
+func validateDeploymentResult(i int, result apiDeploymentResult) (errs []apiResultError) {
+
+	if result.ID == "" {
+		errs = append(errs, apiResultError{i, result.ID, "id", API_ERR_MISSING_FIELD, "id is required"})
+	}
+
+	if result.Status != RESPONSE_STATUS_SUCCESS && result.Status != RESPONSE_STATUS_FAIL {
+		errs = append(errs, apiResultError{i, result.ID, "status", API_ERR_BAD_FIELD,
+			fmt.Sprintf("status must be '%s' or '%s'", RESPONSE_STATUS_SUCCESS, RESPONSE_STATUS_FAIL)})
+	}
+
+	if result.Status == RESPONSE_STATUS_FAIL {
+		if result.ErrorCode == 0 {
+			errs = append(errs, apiResultError{i, result.ID, "errorCode", API_ERR_MISSING_FIELD,
+				"errorCode is required for status FAIL"})
+		}
+		if result.Message == "" {
+			errs = append(errs, apiResultError{i, result.ID, "message", API_ERR_MISSING_FIELD,
+				"message is required for status FAIL"})
+		}
+	}
+
+	return
 }
 
-func transmitDeploymentResultsToServer(validResults apiDeploymentResults) error {
+func writeResultErrors(w http.ResponseWriter, status int, code int, reason string, errs []apiResultError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	b, err := json.Marshal(apiResultErrorResponse{
+		ErrorCode: code,
+		Reason:    reason,
+		Errors:    errs,
+	})
+	if err != nil {
+		log.Errorf("unable to marshal apiResultErrorResponse: %v", err)
+	} else {
+		w.Write(b)
+	}
+	log.Debugf("sending %d error to client: %s %v", status, reason, errs)
+}
+
+func (gd *GatewayDeploy) transmitDeploymentResultsToServer(validResults apiDeploymentResults) error {
+
+	if gd.election.leavesResultsToLeader() {
+		log.Debugf("not the cluster leader, leaving %d deployment results to the leader", len(validResults))
+		return nil
+	}
+
+	l := gd.lifecycle
+	if l.ctx.Err() != nil {
+		log.Warnf("shut down, not transmitting %d deployment results", len(validResults))
+		return l.ctx.Err()
+	}
+	l.trackerSending()
+	defer l.trackerSent()
+
+	sent := false
+	gd.health.trackerQueued(len(validResults))
+	defer func() {
+		gd.health.trackerDone(len(validResults), sent)
+	}()
 
-	retryIn := bundleRetryDelay
+	retryIn := gd.bundleRetryDelay
 	maxBackOff := 5 * time.Minute
-	backOffFunc := createBackoff(retryIn, maxBackOff)
+	backOffFunc := gd.createBackoff(retryIn, maxBackOff)
 
-	_, err := url.Parse(apiServerBaseURI.String())
+	_, err := url.Parse(gd.apiServerBaseURI.String())
 	if err != nil {
-		log.Errorf("unable to parse apiServerBaseURI %s: %v", apiServerBaseURI.String(), err)
+		log.Errorf("unable to parse apiServerBaseURI %s: %v", gd.apiServerBaseURI.String(), err)
 		return err
 	}
-	apiPath := fmt.Sprintf("%s/clusters/%s/apids/%s/deployments", apiServerBaseURI.String(), apidClusterID, apidInstanceID)
+	apiPath := fmt.Sprintf("%s/clusters/%s/apids/%s/deployments", gd.apiServerBaseURI.String(), gd.apidClusterID,
+		gd.apidInstanceID)
 
 	resultJSON, err := json.Marshal(validResults)
 	if err != nil {
@@ -366,41 +625,109 @@ func transmitDeploymentResultsToServer(validResults apiDeploymentResults) error
 		return err
 	}
 
+	breaker := gd.breakers.get(BREAKER_TRACKER, apiPath)
+	attempts := 0
+
+	// counts a failed attempt and backs off, reporting whether to give up instead
+	attemptFailed := func() bool {
+		gd.health.trackerFailed()
+		attempts++
+		if gd.trackerMaxAttempts > 0 && attempts >= gd.trackerMaxAttempts {
+			log.Errorf("giving up on transmitting %d deployment results after %d attempts",
+				len(validResults), attempts)
+			return true
+		}
+		backOffFunc()
+		return false
+	}
+
+	// a rejected token is refreshed and retried at once, but only once per backoff
+	refreshed := false
 	for {
+		if l.ctx.Err() != nil {
+			log.Warnf("shutdown deadline passed, abandoning %d deployment results", len(validResults))
+			return l.ctx.Err()
+		}
+
 		log.Debugf("transmitting deployment results to tracker by URL=%s data=%s", apiPath, string(resultJSON))
 		req, err := http.NewRequest("PUT", apiPath, bytes.NewReader(resultJSON))
 		if err != nil {
 			log.Errorf("unable to create PUT request", err)
 			return err
 		}
+		req = req.WithContext(l.ctx)
 		req.Header.Add("Content-Type", "application/json")
-		addHeaders(req)
+		if err := gd.addHeaders(req); err != nil {
+			log.Errorf("%v", err)
+			if attemptFailed() {
+				return fmt.Errorf("tracking service call failed %d times", attempts)
+			}
+			continue
+		}
 
-		resp, err := http.DefaultClient.Do(req)
+		if !breaker.allow() {
+			log.Debugf("circuit breaker %s is open, not transmitting deployment results", breaker.name)
+			if attemptFailed() {
+				return fmt.Errorf("tracking service call failed %d times", attempts)
+			}
+			continue
+		}
+
+		start := gd.clock.Now()
+		resp, err := gd.client.Do(req)
+		gd.metrics.trackerDuration.observeSince(gd.clock, start)
+		if err != nil || resp.StatusCode >= http.StatusInternalServerError ||
+			resp.StatusCode == http.StatusTooManyRequests {
+			if err != nil {
+				breaker.failure(err.Error())
+			} else {
+				breaker.failure("status " + strconv.Itoa(resp.StatusCode))
+			}
+		} else {
+			breaker.success()
+		}
+
+		if err == nil && resp.StatusCode == http.StatusUnauthorized && !refreshed {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			refreshed = true
+			log.Infof("tracking service rejected credentials, refreshing")
+			if err := gd.trackerCredentials.Refresh(); err != nil {
+				log.Errorf("unable to refresh tracker credentials: %v", err)
+			}
+			continue
+		}
 		if err != nil || resp.StatusCode != http.StatusOK {
 			if err != nil {
 				log.Errorf("failed to communicate with tracking service: %v", err)
+				gd.metrics.trackerFailures.inc(TRACKER_FAILURE_CONNECTION, "")
 			} else {
 				b, _ := ioutil.ReadAll(resp.Body)
 				log.Errorf("tracking service call failed to %s, code: %d, body: %s", apiPath, resp.StatusCode, string(b))
+				resp.Body.Close()
+				gd.metrics.trackerFailures.inc(TRACKER_FAILURE_HTTP_STATUS, strconv.Itoa(resp.StatusCode))
 			}
-			resp.Body.Close()
-			backOffFunc()
+			if attemptFailed() {
+				return fmt.Errorf("tracking service call failed %d times", attempts)
+			}
+			refreshed = false
 			continue
 		}
 		resp.Body.Close()
+		sent = true
+		gd.election.recordSent(validResults)
 		return nil
 	}
 }
 
 // call whenever the list of deployments changes
-func incrementETag() string {
-	e := atomic.AddInt64(&eTag, 1)
+func (gd *GatewayDeploy) incrementETag() string {
+	e := atomic.AddInt64(&gd.eTag, 1)
 	return strconv.FormatInt(e, 10)
 }
 
-func getETag() string {
-	e := atomic.LoadInt64(&eTag)
+func (gd *GatewayDeploy) getETag() string {
+	e := atomic.LoadInt64(&gd.eTag)
 	return strconv.FormatInt(e, 10)
 }
 
@@ -23,6 +23,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/30x/apid-core"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"strconv"
@@ -56,7 +57,7 @@ var _ = Describe("api", func() {
 			var in = make(chan interface{})
 			var out = make(chan []interface{})
 
-			go debounce(in, out, 3*time.Millisecond)
+			go debounce(in, out, 3*time.Millisecond, systemClock{}, nil)
 
 			go func() {
 				defer GinkgoRecover()
@@ -207,7 +208,7 @@ var _ = Describe("api", func() {
 
 			time.Sleep(250 * time.Millisecond) // give api call above time to block
 			insertTestDeployment(testServer, deploymentID)
-			deploymentsChanged <- deploymentID
+			gd.deploymentsChanged <- deploymentID
 		})
 
 		It("should get 304 after blocking if no new deployment", func() {
@@ -257,6 +258,77 @@ var _ = Describe("api", func() {
 			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
 		})
 
+		It("should list the problems with each invalid result", func() {
+
+			deploymentResults := apiDeploymentResults{
+				apiDeploymentResult{ID: "api_valid_result", Status: RESPONSE_STATUS_SUCCESS},
+				apiDeploymentResult{Status: "DONE"},
+				apiDeploymentResult{ID: "api_bad_fail", Status: RESPONSE_STATUS_FAIL},
+			}
+			payload, err := json.Marshal(deploymentResults)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			req, err := http.NewRequest("PUT", testServer.URL+deploymentsEndpoint, bytes.NewReader(payload))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+
+			var errRes apiResultErrorResponse
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(json.Unmarshal(body, &errRes)).To(Succeed())
+			Expect(errRes.ErrorCode).To(Equal(API_ERR_BAD_CONTENT))
+			Expect(errRes.Errors).To(Equal([]apiResultError{
+				{1, "", "id", API_ERR_MISSING_FIELD, "id is required"},
+				{1, "", "status", API_ERR_BAD_FIELD, "status must be 'SUCCESS' or 'FAIL'"},
+				{2, "api_bad_fail", "errorCode", API_ERR_MISSING_FIELD, "errorCode is required for status FAIL"},
+				{2, "api_bad_fail", "message", API_ERR_MISSING_FIELD, "message is required for status FAIL"},
+			}))
+		})
+
+		It("should partially accept results if requested", func() {
+
+			deploymentID := "api_partial_accept"
+			insertTestDeployment(testServer, deploymentID)
+
+			deploymentResults := apiDeploymentResults{
+				apiDeploymentResult{ID: deploymentID, Status: RESPONSE_STATUS_SUCCESS},
+				apiDeploymentResult{ID: "api_partial_invalid"},
+				apiDeploymentResult{ID: "api_partial_unknown", Status: RESPONSE_STATUS_SUCCESS},
+			}
+			payload, err := json.Marshal(deploymentResults)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			req, err := http.NewRequest("PUT", testServer.URL+deploymentsEndpoint+"?partial=true",
+				bytes.NewReader(payload))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(http.StatusMultiStatus))
+
+			var outcomes apiResultOutcomes
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(json.Unmarshal(body, &outcomes)).To(Succeed())
+			Expect(outcomes.Results).To(HaveLen(3))
+			Expect(outcomes.Results[0].Outcome).To(Equal(RESULT_OUTCOME_ACCEPTED))
+			Expect(outcomes.Results[1].Outcome).To(Equal(RESULT_OUTCOME_REJECTED))
+			Expect(outcomes.Results[1].Errors[0].Field).To(Equal("status"))
+			Expect(outcomes.Results[2].Outcome).To(Equal(RESULT_OUTCOME_UNKNOWN))
+			Expect(outcomes.Results[2].Errors[0].ErrorCode).To(Equal(API_ERR_UNKNOWN_DEPLOYMENT))
+
+			var deployStatus string
+			err = gd.getDB().QueryRow("SELECT deploy_status FROM edgex_deployment WHERE id=?", deploymentID).
+				Scan(&deployStatus)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deployStatus).Should(Equal(RESPONSE_STATUS_SUCCESS))
+		})
+
 		It("should ignore deployments that can't be found", func() {
 
 			deploymentID := "api_missing_deployment"
@@ -284,7 +356,7 @@ var _ = Describe("api", func() {
 
 		It("should mark a deployment as successful", func() {
 
-			db := getDB()
+			db := gd.getDB()
 			deploymentID := "api_mark_deployed"
 			insertTestDeployment(testServer, deploymentID)
 
@@ -316,7 +388,7 @@ var _ = Describe("api", func() {
 
 		It("should mark a deployment as failed", func() {
 
-			db := getDB()
+			db := gd.getDB()
 			deploymentID := "api_mark_failed"
 			insertTestDeployment(testServer, deploymentID)
 
@@ -364,7 +436,7 @@ var _ = Describe("api", func() {
 				},
 			}
 
-			err := transmitDeploymentResultsToServer(deploymentResults)
+			err := gd.transmitDeploymentResultsToServer(deploymentResults)
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(testLastTrackerVars["clusterID"]).To(Equal("CLUSTER_ID"))
@@ -426,7 +498,7 @@ func insertTestDeployment(testServer *httptest.Server, deploymentID string) {
 	bundleJson, err := json.Marshal(bundle)
 	Expect(err).ShouldNot(HaveOccurred())
 
-	tx, err := getDB().Begin()
+	tx, err := gd.getDB().Begin()
 	Expect(err).ShouldNot(HaveOccurred())
 
 	dep := DataDeployment{
@@ -457,6 +529,22 @@ func insertTestDeployment(testServer *httptest.Server, deploymentID string) {
 	Expect(err).ShouldNot(HaveOccurred())
 }
 
+// insertBundleDeployment() inserts a deployment of the bundle at bundleURI with its crc32 checksum into db
+func insertBundleDeployment(db apid.DB, deploymentID, bundleURI, checksum string) DataDeployment {
+	dep := DataDeployment{
+		ID:                 deploymentID,
+		DataScopeID:        deploymentID,
+		BundleURI:          bundleURI,
+		BundleChecksum:     checksum,
+		BundleChecksumType: "crc32",
+	}
+	tx, err := db.Begin()
+	Expect(err).ShouldNot(HaveOccurred())
+	Expect(InsertDeployment(tx, dep)).To(Succeed())
+	Expect(tx.Commit()).To(Succeed())
+	return dep
+}
+
 func insertTimeDeployment(testServer *httptest.Server, deploymentID string, timestamp string) {
 
 	uri, err := url.Parse(testServer.URL)
@@ -473,7 +561,7 @@ func insertTimeDeployment(testServer *httptest.Server, deploymentID string, time
 	bundleJson, err := json.Marshal(bundle)
 	Expect(err).ShouldNot(HaveOccurred())
 
-	tx, err := getDB().Begin()
+	tx, err := gd.getDB().Begin()
 	Expect(err).ShouldNot(HaveOccurred())
 
 	dep := DataDeployment{
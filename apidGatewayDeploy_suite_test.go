@@ -18,6 +18,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"context"
 	"encoding/hex"
 
 	"github.com/30x/apid-core"
@@ -28,19 +29,37 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
 var (
+	gd                  *GatewayDeploy // the instance of the running spec
 	tmpDir              string
+	testServices        apid.Services
+	testDB              apid.DB
 	testServer          *httptest.Server
 	testLastTrackerVars map[string]string
 	testLastTrackerBody []byte
+
+	testAPIMux sync.RWMutex
+	testAPI    apid.APIService // serves testServer for the running spec
 )
 
+// specServices gives each spec's instance routes of its own
+type specServices struct {
+	apid.Services
+	api apid.APIService
+}
+
+func (s specServices) API() apid.APIService {
+	return s.api
+}
+
 var _ = BeforeSuite(func() {
-	apid.Initialize(factory.DefaultServicesFactory())
+	testServices = factory.DefaultServicesFactory()
+	apid.Initialize(testServices)
 
 	config := apid.Config()
 
@@ -48,92 +67,119 @@ var _ = BeforeSuite(func() {
 	tmpDir, err = ioutil.TempDir("", "api_test")
 	Expect(err).NotTo(HaveOccurred())
 
+	testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testAPIMux.RLock()
+		api := testAPI
+		testAPIMux.RUnlock()
+		api.Router().ServeHTTP(w, r)
+	}))
+
 	config.Set("local_storage_path", tmpDir)
 	config.Set(configApidInstanceID, "INSTANCE_ID")
 	config.Set(configApidClusterID, "CLUSTER_ID")
-	config.Set(configApiServerBaseURI, "http://localhost")
+	config.Set(configApiServerBaseURI, testServer.URL)
 	config.Set(configDebounceDuration, "1ms")
+	config.Set(configBundleCleanupDelay, "1ms")
+	config.Set(configMarkDeployFailedAfter, "50ms")
 
+	// the instance registered with apid isn't used by the specs
 	apid.InitializePlugins("")
+	Expect(plugin.Shutdown(context.Background())).To(Succeed())
 
 	// init full DB
-	db, err := data.DB()
+	testDB, err = apid.Data().DB()
 	Expect(err).NotTo(HaveOccurred())
-	err = InitDBFullColumns(db)
+	err = InitDBFullColumns(testDB)
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	apid.Events().Close()
+	if testServer != nil {
+		testServer.Close()
+	}
+	os.RemoveAll(tmpDir)
+})
+
+var _ = BeforeEach(func() {
+	for _, table := range []string{"edgex_deployment", "edgex_deployment_gateway_result", "edgex_deployment_rollout",
+		"edgex_deployment_history", "edgex_deployment_rollback", "edgex_deployment_sequence", "edgex_data_scope",
+		"edgex_apid_cluster", "edgex_data_scope_delivery"} {
+		_, err := testDB.Exec("DELETE FROM " + table)
+		Expect(err).ShouldNot(HaveOccurred())
+	}
+	testDB.Exec("UPDATE etag SET value=1")
+
+	api := factory.DefaultServicesFactory().API()
+	instance, err := NewGatewayDeploy(specServices{testServices, api}, Options{})
 	Expect(err).NotTo(HaveOccurred())
-	SetDB(db)
-
-	bundleCleanupDelay = time.Millisecond
-	bundleRetryDelay = 10 * time.Millisecond
-	markDeploymentFailedAfter = 50 * time.Millisecond
-	concurrentDownloads = 1
-	downloadQueueSize = 1
-
-	router := apid.API().Router()
-	// fake an unreliable bundle repo
-	count := 1
-	failedOnce := false
+	instance.bundleRetryDelay = 10 * time.Millisecond
+	instance.snapshotRetryDelay = 10 * time.Millisecond
+	instance.store.SetDB(testDB)
+	instance.InitAPI()
+	registerTestOrigins(instance, api.Router())
+	instance.launch()
+
+	gd, plugin = instance, instance
+	testAPIMux.Lock()
+	testAPI = api
+	testAPIMux.Unlock()
+})
+
+var _ = AfterEach(func() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	gd.Shutdown(ctx)
+})
+
+var (
+	testBundleCount int
+	testFailedOnce  bool
+)
+
+// registerTestOrigins fakes an unreliable bundle repo and APID tracker for the instance of a spec
+func registerTestOrigins(gd *GatewayDeploy, router apid.Router) {
 	router.HandleFunc("/bundles/failonce", func(w http.ResponseWriter, req *http.Request) {
-		if failedOnce {
-			vars := apid.API().Vars(req)
+		if testFailedOnce {
+			vars := gd.services.API().Vars(req)
 			w.Write([]byte("/bundles/" + vars["id"]))
 		} else {
-			failedOnce = true
+			testFailedOnce = true
 			w.WriteHeader(500)
 		}
 	}).Methods("GET")
 
 	router.HandleFunc("/bundles/{id}", func(w http.ResponseWriter, req *http.Request) {
-		count++
-		vars := apid.API().Vars(req)
-		if count%2 == 0 && vars["id"] != "checksum" {
+		testBundleCount++
+		vars := gd.services.API().Vars(req)
+		if testBundleCount%2 == 0 && vars["id"] != "checksum" {
 			w.WriteHeader(500)
 			return
 		}
 		if vars["id"] == "longfail" {
-			time.Sleep(markDeploymentFailedAfter + (250 * time.Millisecond))
+			time.Sleep(gd.markDeploymentFailedAfter + (250 * time.Millisecond))
 		}
 		w.Write([]byte("/bundles/" + vars["id"]))
 
 	}).Methods("GET")
 
-	// fake an unreliable APID tracker
 	router.HandleFunc("/clusters/{clusterID}/apids/{instanceID}/deployments",
 		func(w http.ResponseWriter, req *http.Request) {
-			count++
-			if count%2 == 0 {
+			testBundleCount++
+			if testBundleCount%2 == 0 {
 				w.WriteHeader(500)
 				return
 			}
 
-			testLastTrackerVars = apid.API().Vars(req)
-			testLastTrackerBody, err = ioutil.ReadAll(req.Body)
+			testLastTrackerVars = gd.services.API().Vars(req)
+			body, err := ioutil.ReadAll(req.Body)
 			Expect(err).ToNot(HaveOccurred())
+			testLastTrackerBody = body
 
 			w.Write([]byte("OK"))
 
 		}).Methods("PUT")
-	testServer = httptest.NewServer(router)
-})
-
-var _ = AfterSuite(func() {
-	apid.Events().Close()
-	if testServer != nil {
-		testServer.Close()
-	}
-	os.RemoveAll(tmpDir)
-})
-
-var _ = BeforeEach(func() {
-	var err error
-	apiServerBaseURI, err = url.Parse(testServer.URL)
-	Expect(err).NotTo(HaveOccurred())
-
-	_, err = getDB().Exec("DELETE FROM edgex_deployment")
-	Expect(err).ShouldNot(HaveOccurred())
-
-	_, err = getDB().Exec("UPDATE etag SET value=1")
-})
+}
 
 func TestApidGatewayDeploy(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	PERMISSION_READ    = "read"    // GET /deployments
+	PERMISSION_REPORT  = "report"  // PUT /deployments
+	PERMISSION_ADMIN   = "admin"   // GET /deployments/breakers
+	PERMISSION_WEBHOOK = "webhook" // /deployments/webhooks
+)
+
+type contextKey string
+
+const apiClientContextKey contextKey = "apiClient"
+
+// an apiClient is allowed to use the deployments API with its permissions. If Scopes is not empty, the client
+// only sees and reports on deployments with a matching data_scope_id.
+type apiClient struct {
+	Name           string   `json:"name"`
+	Token          string   `json:"token"`
+	CertCommonName string   `json:"certCommonName"`
+	Permissions    []string `json:"permissions"`
+	Scopes         []string `json:"scopes"`
+}
+
+type apiAuthConfig struct {
+	token     string // shared token, grants all permissions
+	clients   []apiClient
+	clientCAs *x509.CertPool
+}
+
+// the client used when authentication is disabled or by holders of the shared token
+var unrestrictedClient = &apiClient{
+	Name:        "unrestricted",
+	Permissions: []string{PERMISSION_READ, PERMISSION_REPORT, PERMISSION_ADMIN, PERMISSION_WEBHOOK},
+}
+
+func initAPIAuth(token, clientsFile, clientCAFile string) (apiAuthConfig, error) {
+
+	auth := apiAuthConfig{
+		token: token,
+	}
+
+	if clientsFile != "" {
+		b, err := ioutil.ReadFile(clientsFile)
+		if err != nil {
+			return auth, fmt.Errorf("unable to read API clients file %s: %v", clientsFile, err)
+		}
+		err = json.Unmarshal(b, &auth.clients)
+		if err != nil {
+			return auth, fmt.Errorf("unable to parse API clients file %s: %v", clientsFile, err)
+		}
+		for _, c := range auth.clients {
+			if c.Token == "" && c.CertCommonName == "" {
+				return auth, fmt.Errorf("API client %s requires a token or certCommonName", c.Name)
+			}
+		}
+	}
+
+	if clientCAFile != "" {
+		b, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return auth, fmt.Errorf("unable to read API client CA file %s: %v", clientCAFile, err)
+		}
+		auth.clientCAs = x509.NewCertPool()
+		if !auth.clientCAs.AppendCertsFromPEM(b) {
+			return auth, fmt.Errorf("no certificates found in API client CA file %s", clientCAFile)
+		}
+	}
+
+	return auth, nil
+}
+
+func (a apiAuthConfig) enabled() bool {
+	return a.token != "" || len(a.clients) > 0 || a.clientCAs != nil
+}
+
+// authenticate returns the client making the request or an error describing why it isn't allowed
+func (a apiAuthConfig) authenticate(r *http.Request) (*apiClient, error) {
+
+	if !a.enabled() {
+		return unrestrictedClient, nil
+	}
+
+	var commonName string
+	if a.clientCAs != nil {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return nil, fmt.Errorf("client certificate required")
+		}
+		certs := r.TLS.PeerCertificates
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         a.clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		commonName = certs[0].Subject.CommonName
+	}
+
+	var token string
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	if token != "" && a.token != "" && tokenEquals(token, a.token) {
+		return unrestrictedClient, nil
+	}
+
+	for i, c := range a.clients {
+		if c.Token != "" && !tokenEquals(token, c.Token) {
+			continue
+		}
+		if c.CertCommonName != "" && c.CertCommonName != commonName {
+			continue
+		}
+		return &a.clients[i], nil
+	}
+
+	// a verified certificate is sufficient if no clients are configured
+	if commonName != "" && len(a.clients) == 0 && a.token == "" {
+		return unrestrictedClient, nil
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("bearer token required")
+	}
+	return nil, fmt.Errorf("unknown client")
+}
+
+func tokenEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (c *apiClient) hasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *apiClient) inScope(dataScopeID string) bool {
+	if len(c.Scopes) == 0 {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == dataScopeID {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize only passes requests from clients with the permission to h
+func (gd *GatewayDeploy) authorize(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := gd.apiAuth.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, API_ERR_UNAUTHORIZED, err.Error())
+			return
+		}
+		if !client.hasPermission(permission) {
+			writeError(w, http.StatusForbidden, API_ERR_FORBIDDEN,
+				fmt.Sprintf("client %s does not have %s permission", client.Name, permission))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), apiClientContextKey, client)))
+	}
+}
+
+func clientFromRequest(r *http.Request) *apiClient {
+	if client, ok := r.Context().Value(apiClientContextKey).(*apiClient); ok {
+		return client
+	}
+	return unrestrictedClient
+}
+
+// returns only the deployments in the client's scopes
+func filterDeploymentsForClient(client *apiClient, deployments []DataDeployment) []DataDeployment {
+	if len(client.Scopes) == 0 {
+		return deployments
+	}
+	var filtered []DataDeployment
+	for _, d := range deployments {
+		if client.inScope(d.DataScopeID) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// returns the ids of results for known deployments outside of the client's scopes
+func (gd *GatewayDeploy) resultsOutOfScope(client *apiClient, results apiDeploymentResults) ([]string, error) {
+	if len(client.Scopes) == 0 {
+		return nil, nil
+	}
+	var outOfScope []string
+	for _, result := range results {
+		deployments, err := gd.getDeployments("WHERE id=$1", result.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(deployments) > 0 && !client.inScope(deployments[0].DataScopeID) {
+			outOfScope = append(outOfScope, result.ID)
+		}
+	}
+	return outOfScope, nil
+}
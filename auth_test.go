@@ -0,0 +1,190 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("auth", func() {
+
+	var saveAuth apiAuthConfig
+
+	BeforeEach(func() {
+		saveAuth = gd.apiAuth
+	})
+
+	AfterEach(func() {
+		gd.apiAuth = saveAuth
+	})
+
+	It("should require the shared token", func() {
+
+		gd.apiAuth = apiAuthConfig{token: "shared-secret"}
+
+		res := testAuthRequest("GET", "", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(res.Header.Get("WWW-Authenticate")).To(Equal("Bearer"))
+
+		res = testAuthRequest("GET", "wrong", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		res = testAuthRequest("GET", "shared-secret", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should enforce client permissions", func() {
+
+		gd.apiAuth = apiAuthConfig{
+			clients: []apiClient{
+				{Name: "reader", Token: "reader-token", Permissions: []string{PERMISSION_READ}},
+			},
+		}
+
+		deploymentID := "auth_read_only"
+		insertTestDeployment(testServer, deploymentID)
+		results := apiDeploymentResults{{ID: deploymentID, Status: RESPONSE_STATUS_SUCCESS}}
+
+		res := testAuthRequest("GET", "reader-token", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		res = testAuthRequest("PUT", "reader-token", results)
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("should restrict clients to their scopes", func() {
+
+		gd.apiAuth = apiAuthConfig{
+			clients: []apiClient{
+				{
+					Name:        "scoped",
+					Token:       "scoped-token",
+					Permissions: []string{PERMISSION_READ, PERMISSION_REPORT},
+					Scopes:      []string{"auth_in_scope"},
+				},
+			},
+		}
+
+		insertTestDeployment(testServer, "auth_in_scope")
+		insertTestDeployment(testServer, "auth_out_of_scope")
+
+		res := testAuthRequest("GET", "scoped-token", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		var depRes ApiDeploymentResponse
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		json.Unmarshal(body, &depRes)
+		Expect(depRes).To(HaveLen(1))
+		Expect(depRes[0].ID).To(Equal("auth_in_scope"))
+
+		res = testAuthRequest("PUT", "scoped-token",
+			apiDeploymentResults{{ID: "auth_out_of_scope", Status: RESPONSE_STATUS_SUCCESS}})
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+
+		res = testAuthRequest("PUT", "scoped-token",
+			apiDeploymentResults{{ID: "auth_in_scope", Status: RESPONSE_STATUS_SUCCESS}})
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should verify client certificates", func() {
+
+		caCert, caKey := testCertificate("auth ca", nil, nil)
+		clientCert, _ := testCertificate("gateway-1", caCert, caKey)
+		otherCA, otherKey := testCertificate("other ca", nil, nil)
+		strangerCert, _ := testCertificate("gateway-1", otherCA, otherKey)
+
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		gd.apiAuth = apiAuthConfig{
+			clientCAs: roots,
+			clients: []apiClient{
+				{Name: "gateway-1", CertCommonName: "gateway-1", Permissions: []string{PERMISSION_READ}},
+			},
+		}
+
+		r, err := http.NewRequest("GET", deploymentsEndpoint, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = gd.apiAuth.authenticate(r)
+		Expect(err).To(HaveOccurred())
+
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{strangerCert}}
+		_, err = gd.apiAuth.authenticate(r)
+		Expect(err).To(HaveOccurred())
+
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}}
+		client, err := gd.apiAuth.authenticate(r)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(client.Name).To(Equal("gateway-1"))
+	})
+})
+
+func testAuthRequest(method, token string, results apiDeploymentResults) *http.Response {
+	var body []byte
+	if results != nil {
+		var err error
+		body, err = json.Marshal(results)
+		Expect(err).ShouldNot(HaveOccurred())
+	}
+	req, err := http.NewRequest(method, testServer.URL+deploymentsEndpoint, bytes.NewReader(body))
+	Expect(err).ShouldNot(HaveOccurred())
+	req.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	Expect(err).ShouldNot(HaveOccurred())
+	return res
+}
+
+// creates a certificate signed by parent, or a self-signed CA if parent is nil
+func testCertificate(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ShouldNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ShouldNot(HaveOccurred())
+	return cert, key
+}
@@ -26,41 +26,23 @@ import (
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var (
-	markDeploymentFailedAfter time.Duration
-	bundleDownloadConnTimeout time.Duration
-	bundleRetryDelay          = time.Second
-	downloadQueue             = make(chan *DownloadRequest, downloadQueueSize)
-	workerQueue               = make(chan chan *DownloadRequest, concurrentDownloads)
-)
-
-// simple doubling back-off
-func createBackoff(retryIn, maxBackOff time.Duration) func() {
-	return func() {
-		log.Debugf("backoff called. will retry in %s.", retryIn)
-		time.Sleep(retryIn)
-		retryIn = retryIn * time.Duration(2)
-		if retryIn > maxBackOff {
-			retryIn = maxBackOff
-		}
-	}
-}
-
-func queueDownloadRequest(dep DataDeployment) {
+func (gd *GatewayDeploy) queueDownloadRequest(dep DataDeployment) {
 
 	hashWriter, err := getHashWriter(dep.BundleChecksumType)
 	if err != nil {
 		msg := fmt.Sprintf("invalid bundle checksum type: %s for deployment: %s", dep.BundleChecksumType, dep.ID)
 		log.Error(msg)
-		setDeploymentResults(apiDeploymentResults{
+		gd.setDeploymentResults(apiDeploymentResults{
 			{
 				ID:        dep.ID,
 				Status:    RESPONSE_STATUS_FAIL,
@@ -71,33 +53,117 @@ func queueDownloadRequest(dep DataDeployment) {
 		return
 	}
 
-	retryIn := bundleRetryDelay
+	retryIn := gd.bundleRetryDelay
 	maxBackOff := 5 * time.Minute
-	markFailedAt := time.Now().Add(markDeploymentFailedAfter)
+	markFailedAt := gd.clock.Now().Add(gd.markDeploymentFailedAfter)
 	req := &DownloadRequest{
+		gd:           gd,
 		dep:          dep,
 		hashWriter:   hashWriter,
-		bundleFile:   getBundleFile(dep),
-		backoffFunc:  createBackoff(retryIn, maxBackOff),
+		bundleFile:   gd.getBundleFile(dep),
+		backoffFunc:  gd.createBackoff(retryIn, maxBackOff),
 		markFailedAt: markFailedAt,
 	}
-	downloadQueue <- req
+	if !gd.downloads.add(req) {
+		log.Debugf("download of bundle for %s already in flight", dep.ID)
+		return
+	}
+	select {
+	case gd.downloadQueue <- req:
+	case <-gd.lifecycle.stop:
+		log.Debugf("shutting down, leaving download of %s for the next start", dep.ID)
+		gd.downloads.remove(req)
+	}
+}
+
+// downloadsInFlight holds the DownloadRequest of each deployment from when it is queued until it succeeds or
+// fails for good, so that a deployment delivered twice is only downloaded once
+type downloadsInFlight struct {
+	sync.Mutex
+	requests map[string]*DownloadRequest
+}
+
+func newDownloadsInFlight() *downloadsInFlight {
+	return &downloadsInFlight{requests: make(map[string]*DownloadRequest)}
+}
+
+// add() returns false if a request for the same bundle of the deployment is in flight. A request for a
+// changed bundle replaces the one in flight, which stops at its next attempt.
+func (d *downloadsInFlight) add(r *DownloadRequest) bool {
+	d.Lock()
+	defer d.Unlock()
+	if prev, ok := d.requests[r.dep.ID]; ok && prev.sameBundle(r) {
+		return false
+	}
+	d.requests[r.dep.ID] = r
+	return true
+}
+
+func (d *downloadsInFlight) remove(r *DownloadRequest) {
+	d.Lock()
+	defer d.Unlock()
+	if d.requests[r.dep.ID] == r {
+		delete(d.requests, r.dep.ID)
+	}
+}
+
+func (d *downloadsInFlight) current(r *DownloadRequest) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.requests[r.dep.ID] == r
+}
+
+func (d *downloadsInFlight) count() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.requests)
+}
+
+// clear() forgets the requests of a previous start
+func (d *downloadsInFlight) clear() {
+	d.Lock()
+	defer d.Unlock()
+	d.requests = make(map[string]*DownloadRequest)
 }
 
 type DownloadRequest struct {
+	gd           *GatewayDeploy
 	dep          DataDeployment
 	hashWriter   hash.Hash
 	bundleFile   string
 	backoffFunc  func()
 	markFailedAt time.Time
+	attempts     int // from the origin
+}
+
+func (r *DownloadRequest) sameBundle(other *DownloadRequest) bool {
+	return r.bundleFile == other.bundleFile && r.dep.BundleURI == other.dep.BundleURI &&
+		r.dep.BundleChecksumType == other.dep.BundleChecksumType && r.dep.BundleChecksum == other.dep.BundleChecksum
 }
 
 func (r *DownloadRequest) downloadBundle() {
 
 	dep := r.dep
+	if !r.gd.downloads.current(r) {
+		log.Debugf("never mind, download of %s was superseded", dep.ID)
+		return
+	}
+
+	// the request stays in flight while it is retried
+	retrying := false
+	defer func() {
+		if !retrying {
+			r.gd.downloads.remove(r)
+		}
+	}()
+
+	if r.gd.lifecycle.stopping() {
+		log.Debugf("shutting down, leaving download of %s for the next start", dep.ID)
+		return
+	}
 	log.Debugf("starting bundle download attempt for %s: %s", dep.ID, dep.BundleURI)
 
-	deployments, err := getDeployments("WHERE id=$1", dep.ID)
+	deployments, err := r.gd.getDeployments("WHERE id=$1", dep.ID)
 	if err == nil && len(deployments) == 0 {
 		log.Debugf("never mind, deployment %s was deleted", dep.ID)
 		return
@@ -106,7 +172,24 @@ func (r *DownloadRequest) downloadBundle() {
 	r.checkTimeout()
 
 	r.hashWriter.Reset()
-	tempFile, err := downloadFromURI(dep.BundleURI, r.hashWriter, dep.BundleChecksum)
+	tempFile, err := r.gd.downloadFromPeers(dep, r.hashWriter)
+	if err != nil {
+		breaker := r.gd.breakers.get(BREAKER_DOWNLOAD, dep.BundleURI)
+		if !breaker.allow() {
+			log.Debugf("circuit breaker %s is open, not downloading %s", breaker.name, dep.BundleURI)
+			retrying = true
+			r.retry()
+			return
+		}
+		r.attempts++
+		r.hashWriter.Reset()
+		tempFile, err = r.gd.downloadFromURI(dep.BundleURI, r.hashWriter, dep.BundleChecksum)
+		if err != nil && downloadEndpointFailed(err) {
+			breaker.failure(err.Error())
+		} else {
+			breaker.success()
+		}
+	}
 
 	if err == nil {
 		err = os.Rename(tempFile, r.bundleFile)
@@ -120,32 +203,92 @@ func (r *DownloadRequest) downloadBundle() {
 	}
 
 	if err == nil {
-		err = updateLocalBundleURI(dep.ID, r.bundleFile)
+		if violations := r.gd.validateDeploymentConfig(dep, r.bundleFile, r.gd.templatingEnabled); len(violations) > 0 {
+			r.rejectConfig(violations)
+			return
+		}
+		err = r.gd.updateLocalBundleURI(dep.ID, r.bundleFile)
 	}
 
 	if err != nil {
-		// add myself back into the queue after back off
-		go func() {
-			r.backoffFunc()
-			downloadQueue <- r
-		}()
+		if r.gd.lifecycle.stopping() {
+			log.Debugf("shutting down, leaving download of %s for the next start: %v", dep.ID, err)
+			return
+		}
+		if r.gd.downloadMaxAttempts > 0 && r.attempts >= r.gd.downloadMaxAttempts {
+			r.giveUp(err)
+			return
+		}
+		retrying = true
+		r.retry()
 		return
 	}
 
 	log.Debugf("bundle for %s downloaded: %s", dep.ID, dep.BundleURI)
 
+	dep.LocalBundleURI = r.bundleFile
+	r.gd.recordBundleHistory(dep)
+	r.gd.emitDeploymentEvent(&BundleDownloaded{Deployment: dep})
+	r.gd.emitDeploymentEvent(&DeploymentReady{Deployment: dep})
+
 	// send deployments to client
-	deploymentsChanged <- dep.ID
+	r.gd.notifyDeploymentsChanged(dep.ID)
+}
+
+// retry() adds the request back into the queue after back off, unless shutting down
+func (r *DownloadRequest) retry() {
+	l := r.gd.lifecycle
+	go func() {
+		r.backoffFunc()
+		select {
+		case r.gd.downloadQueue <- r:
+		case <-l.stop:
+			log.Debugf("shutting down, leaving download of %s for the next start", r.dep.ID)
+			r.gd.downloads.remove(r)
+		}
+	}()
+}
+
+// giveUp() fails a deployment whose bundle couldn't be downloaded in downloadMaxAttempts
+func (r *DownloadRequest) giveUp(err error) {
+
+	msg := fmt.Sprintf("bundle download failed after %d attempts: %v", r.attempts, err)
+	log.Errorf("deployment %s failed: %s", r.dep.ID, msg)
+	r.gd.setDeploymentResults(apiDeploymentResults{
+		{
+			ID:        r.dep.ID,
+			Status:    RESPONSE_STATUS_FAIL,
+			ErrorCode: TRACKER_ERR_BUNDLE_DOWNLOAD_FAILED,
+			Message:   msg,
+		},
+	})
+}
+
+// rejectConfig() fails a deployment whose configuration doesn't match its schema. It never becomes ready.
+func (r *DownloadRequest) rejectConfig(violations []schemaViolation) {
+
+	msg := schemaViolationsMessage(violations)
+	log.Errorf("deployment %s rejected: %s", r.dep.ID, msg)
+	safeDelete(r.bundleFile)
+	r.gd.setDeploymentResults(apiDeploymentResults{
+		{
+			ID:         r.dep.ID,
+			Status:     RESPONSE_STATUS_FAIL,
+			ErrorCode:  TRACKER_ERR_DEPLOYMENT_BAD_CONFIG,
+			Message:    msg,
+			Violations: violations,
+		},
+	})
 }
 
 func (r *DownloadRequest) checkTimeout() {
 
 	if !r.markFailedAt.IsZero() {
-		if time.Now().After(r.markFailedAt) {
+		if r.gd.clock.Now().After(r.markFailedAt) {
 			r.markFailedAt = time.Time{}
 			log.Debugf("bundle download timeout. marking deployment %s failed. will keep retrying: %s",
 				r.dep.ID, r.dep.BundleURI)
-			setDeploymentResults(apiDeploymentResults{
+			r.gd.setDeploymentResults(apiDeploymentResults{
 				{
 					ID:        r.dep.ID,
 					Status:    RESPONSE_STATUS_FAIL,
@@ -157,40 +300,88 @@ func (r *DownloadRequest) checkTimeout() {
 	}
 }
 
-func getBundleFile(dep DataDeployment) string {
+func (gd *GatewayDeploy) getBundleFile(dep DataDeployment) string {
 
 	// the content of the URI is unfortunately not guaranteed not to change, so I can't just use dep.BundleURI
 	// unfortunately, this also means that a bundle cache isn't especially relevant
 	fileName := dep.DataScopeID + "_" + dep.ID
 
-	return path.Join(bundlePath, base64.StdEncoding.EncodeToString([]byte(fileName)))
+	return path.Join(gd.bundlePath, base64.StdEncoding.EncodeToString([]byte(fileName)))
 }
 
-func downloadFromURI(uri string, hashWriter hash.Hash, expectedHash string) (tempFileName string, err error) {
+// badChecksumError indicates that downloaded bundle content doesn't match the expected checksum
+type badChecksumError struct {
+	file       string
+	calculated string
+	given      string
+}
+
+func (e badChecksumError) Error() string {
+	return fmt.Sprintf("Bad checksum on %s. calculated: %s, given: %s", e.file, e.calculated, e.given)
+}
+
+// httpStatusError indicates that a bundle server responded with an unexpected status
+type httpStatusError struct {
+	uri    string
+	status int
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("Bundle uri %s failed with status %d", e.uri, e.status)
+}
+
+func (gd *GatewayDeploy) downloadFromURI(uri string, hashWriter hash.Hash, expectedHash string) (
+	tempFileName string, err error) {
 
 	log.Debugf("Downloading bundle: %s", uri)
 
-	var tempFile *os.File
-	tempFile, err = ioutil.TempFile(bundlePath, "download")
-	if err != nil {
-		log.Errorf("Unable to create temp file: %v", err)
-		return
-	}
-	defer tempFile.Close()
-	tempFileName = tempFile.Name()
+	gd.metrics.downloadAttempts.inc()
+	start := gd.clock.Now()
+	defer func() {
+		gd.metrics.downloadDuration.observeSince(gd.clock, start)
+		if err != nil {
+			gd.metrics.downloadFailures.inc(downloadFailureCause(err))
+		} else {
+			gd.metrics.downloadSuccesses.inc()
+		}
+	}()
 
 	var bundleReader io.ReadCloser
-	bundleReader, err = getURIFileReader(uri)
+	bundleReader, err = gd.fetcher.Fetch(gd.lifecycle.ctx, uri)
 	if err != nil {
 		log.Errorf("Unable to retrieve bundle %s: %v", uri, err)
 		return
 	}
 	defer bundleReader.Close()
 
+	var written int64
+	tempFileName, written, err = gd.writeBundleTempFile(bundleReader, hashWriter, expectedHash)
+	gd.metrics.downloadBytes.add(float64(written))
+	if err != nil {
+		return
+	}
+
+	log.Debugf("Bundle %s downloaded to: %s", uri, tempFileName)
+	return
+}
+
+// writeBundleTempFile() copies bundle content to a temp file and verifies its checksum
+func (gd *GatewayDeploy) writeBundleTempFile(bundleReader io.Reader, hashWriter hash.Hash, expectedHash string) (
+	tempFileName string, written int64, err error) {
+
+	var tempFile *os.File
+	tempFile, err = ioutil.TempFile(gd.bundlePath, "download")
+	if err != nil {
+		log.Errorf("Unable to create temp file: %v", err)
+		return
+	}
+	defer tempFile.Close()
+	tempFileName = tempFile.Name()
+
 	// track checksum
 	teedReader := io.TeeReader(bundleReader, hashWriter)
 
-	_, err = io.Copy(tempFile, teedReader)
+	written, err = io.Copy(tempFile, teedReader)
 	if err != nil {
 		log.Errorf("Unable to write bundle %s: %v", tempFileName, err)
 		return
@@ -199,46 +390,38 @@ func downloadFromURI(uri string, hashWriter hash.Hash, expectedHash string) (tem
 	// check checksum
 	checksum := hex.EncodeToString(hashWriter.Sum(nil))
 	if checksum != expectedHash {
-		err = errors.New(fmt.Sprintf("Bad checksum on %s. calculated: %s, given: %s", tempFileName, checksum, expectedHash))
+		err = badChecksumError{tempFileName, checksum, expectedHash}
 		log.Error(err.Error())
 		return
 	}
-
-	log.Debugf("Bundle %s downloaded to: %s", uri, tempFileName)
 	return
 }
 
-// retrieveBundle retrieves bundle data from a URI
-func getURIFileReader(uriString string) (io.ReadCloser, error) {
-
-	uri, err := url.Parse(uriString)
-	if err != nil {
-		return nil, fmt.Errorf("DownloadFileUrl: Failed to parse urlStr: %s", uriString)
-	}
-
-	// todo: add authentication - TBD?
-
-	// assume it's a file if no scheme - todo: remove file support?
-	if uri.Scheme == "" || uri.Scheme == "file" {
-		f, err := os.Open(uri.Path)
-		if err != nil {
-			return nil, err
+// returns the cause and code labels of the download failures metric
+func downloadFailureCause(err error) (string, string) {
+	switch e := err.(type) {
+	case badChecksumError:
+		return DOWNLOAD_FAILURE_CHECKSUM, ""
+	case httpStatusError:
+		return DOWNLOAD_FAILURE_HTTP_STATUS, strconv.Itoa(e.status)
+	case net.Error:
+		if e.Timeout() {
+			return DOWNLOAD_FAILURE_TIMEOUT, ""
 		}
-		return f, nil
 	}
+	return DOWNLOAD_FAILURE_OTHER, ""
+}
 
-	// GET the contents at uriString
-	client := http.Client{
-		Timeout: bundleDownloadConnTimeout,
-	}
-	res, err := client.Get(uriString)
-	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("Bundle uri %s failed with status %d", uriString, res.StatusCode)
+// downloadEndpointFailed() reports whether err means the bundle server is unavailable, as opposed to serving
+// bad content or failing locally. Only network errors, truncated bodies and 5xx or 429 responses count.
+func downloadEndpointFailed(err error) bool {
+	switch e := err.(type) {
+	case httpStatusError:
+		return e.status >= http.StatusInternalServerError || e.status == http.StatusTooManyRequests
+	case net.Error:
+		return true
 	}
-	return res.Body, nil
+	return err == io.ErrUnexpectedEOF
 }
 
 func getHashWriter(hashType string) (hash.Hash, error) {
@@ -272,58 +455,80 @@ func (f fakeHash) Sum(b []byte) []byte {
 	return []byte("")
 }
 
-func initializeBundleDownloading() {
+// initializeBundleDownloading() runs the workers and dispatcher until l stops. Requests still queued then are
+// dropped; their deployments remain unready and are queued again on the next start.
+func (gd *GatewayDeploy) initializeBundleDownloading(l *pluginLifecycle) {
+
+	// workers of a previous start may have left their channels behind
+	gd.workerQueue = make(chan chan *DownloadRequest, gd.concurrentDownloads)
 
 	// create workers
-	for i := 0; i < concurrentDownloads; i++ {
-		worker := BundleDownloader{
-			id:       i + 1,
-			workChan: make(chan *DownloadRequest),
-			quitChan: make(chan bool),
+	for i := 0; i < gd.concurrentDownloads; i++ {
+		worker := &BundleDownloader{
+			gd:        gd,
+			id:        i + 1,
+			workChan:  make(chan *DownloadRequest),
+			quitChan:  make(chan bool),
+			lifecycle: l,
 		}
+		l.downloaders = append(l.downloaders, worker)
 		worker.Start()
 	}
 
 	// run dispatcher
-	go func() {
+	l.spawn(func() {
 		for {
 			select {
-			case req := <-downloadQueue:
+			case req := <-gd.downloadQueue:
 				log.Debugf("dispatching downloader for: %s", req.bundleFile)
 				go func() {
-					worker := <-workerQueue
-					log.Debugf("got a worker for: %s", req.bundleFile)
-					worker <- req
+					select {
+					case worker := <-gd.workerQueue:
+						log.Debugf("got a worker for: %s", req.bundleFile)
+						select {
+						case worker <- req:
+						case <-l.stop:
+						}
+					case <-l.stop:
+					}
 				}()
+			case <-l.stop:
+				log.Debugf("bundle download dispatcher stopped")
+				return
 			}
 		}
-	}()
+	})
 }
 
 type BundleDownloader struct {
-	id       int
-	workChan chan *DownloadRequest
-	quitChan chan bool
+	gd        *GatewayDeploy
+	id        int
+	workChan  chan *DownloadRequest
+	quitChan  chan bool
+	lifecycle *pluginLifecycle
 }
 
 func (w *BundleDownloader) Start() {
-	go func() {
+	queue := w.gd.workerQueue
+	w.lifecycle.spawn(func() {
 		log.Debugf("started bundle downloader %d", w.id)
 		for {
 			// wait for work
-			workerQueue <- w.workChan
+			queue <- w.workChan
 
 			select {
 			case req := <-w.workChan:
 				log.Debugf("starting download %s", req.bundleFile)
+				w.gd.health.downloadStarted()
 				req.downloadBundle()
+				w.gd.health.downloadFinished()
 
 			case <-w.quitChan:
 				log.Debugf("bundle downloader %d stopped", w.id)
 				return
 			}
 		}
-	}()
+	})
 }
 
 func (w *BundleDownloader) Stop() {
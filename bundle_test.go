@@ -24,6 +24,7 @@ import (
 
 	"io/ioutil"
 
+	"github.com/30x/apidGatewayDeploy/testutil"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -34,9 +35,9 @@ var _ = Describe("bundle", func() {
 
 		It("should timeout connection and retry", func() {
 			defer func() {
-				bundleDownloadConnTimeout = time.Second
+				gd.bundleDownloadConnTimeout = time.Second
 			}()
-			bundleDownloadConnTimeout = 100 * time.Millisecond
+			gd.bundleDownloadConnTimeout = 100 * time.Millisecond
 			firstTime := true
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if firstTime {
@@ -53,7 +54,7 @@ var _ = Describe("bundle", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			uri.Path = "/bundles/longfail"
 
-			tx, err := getDB().Begin()
+			tx, err := gd.getDB().Begin()
 			Expect(err).ShouldNot(HaveOccurred())
 
 			deploymentID := "bundle_download_fail"
@@ -71,10 +72,10 @@ var _ = Describe("bundle", func() {
 			err = tx.Commit()
 			Expect(err).ShouldNot(HaveOccurred())
 
-			queueDownloadRequest(dep)
+			gd.queueDownloadRequest(dep)
 
 			var listener = make(chan deploymentsResult)
-			addSubscriber <- listener
+			gd.addSubscriber <- listener
 			result := <-listener
 
 			Expect(result.err).NotTo(HaveOccurred())
@@ -90,11 +91,11 @@ var _ = Describe("bundle", func() {
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if failedOnce {
 					proceed <- true
-					time.Sleep(markDeploymentFailedAfter)
+					time.Sleep(gd.markDeploymentFailedAfter)
 					w.Write([]byte("/bundles/longfail"))
 				} else {
 					failedOnce = true
-					time.Sleep(markDeploymentFailedAfter)
+					time.Sleep(gd.markDeploymentFailedAfter)
 					w.WriteHeader(500)
 				}
 			}))
@@ -116,7 +117,7 @@ var _ = Describe("bundle", func() {
 			bundleJson, err := json.Marshal(bundle)
 			Expect(err).ShouldNot(HaveOccurred())
 
-			tx, err := getDB().Begin()
+			tx, err := gd.getDB().Begin()
 			Expect(err).ShouldNot(HaveOccurred())
 
 			dep := DataDeployment{
@@ -168,15 +169,15 @@ var _ = Describe("bundle", func() {
 				w.Write([]byte("OK"))
 			}))
 			defer tracker.Close()
-			apiServerBaseURI, err = url.Parse(tracker.URL)
+			gd.apiServerBaseURI, err = url.Parse(tracker.URL)
 			Expect(err).ShouldNot(HaveOccurred())
 
-			queueDownloadRequest(dep)
+			gd.queueDownloadRequest(dep)
 
 			<-proceed
 
 			// get error state deployment
-			deployments, err := getDeployments("WHERE id=$1", deploymentID)
+			deployments, err := gd.getDeployments("WHERE id=$1", deploymentID)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			Expect(len(deployments)).To(Equal(1))
@@ -191,12 +192,12 @@ var _ = Describe("bundle", func() {
 			Expect(trackerHit).To(BeTrue())
 
 			var listener = make(chan deploymentsResult)
-			addSubscriber <- listener
+			gd.addSubscriber <- listener
 			<-listener
 
 			// get finished deployment
 			// still in error state (let client update), but with valid local bundle
-			deployments, err = getDeployments("WHERE id=$1", deploymentID)
+			deployments, err = gd.getDeployments("WHERE id=$1", deploymentID)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			Expect(len(deployments)).To(Equal(1))
@@ -209,6 +210,60 @@ var _ = Describe("bundle", func() {
 			Expect(d.LocalBundleURI).To(BeAnExistingFile())
 		})
 
+		It("should mark deployment failed after the clock passes the timeout, then finish", func() {
+
+			content := []byte("/bundles/clock")
+			origin := testutil.NewBundleOrigin()
+			defer origin.Close()
+			bundleURI := origin.AddBundle("/bundles/clock", content)
+			origin.Script("/bundles/clock", testutil.Status(500))
+
+			tracker := testutil.NewTracker()
+			defer tracker.Close()
+
+			clock := NewFakeClock(time.Now())
+			other, err := NewGatewayDeploy(gd.services, Options{Clock: clock, Store: &dbStore{}})
+			Expect(err).ShouldNot(HaveOccurred())
+			other.store.SetDB(gd.getDB())
+			other.markDeploymentFailedAfter = 5 * time.Minute
+			other.bundleRetryDelay = time.Minute
+			other.apiServerBaseURI, err = url.Parse(tracker.URL)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			deploymentID := "bundle_download_clock"
+			dep := insertBundleDeployment(other.getDB(), deploymentID, bundleURI, testutil.Checksum(content))
+
+			other.queueDownloadRequest(dep)
+			req := <-other.downloadQueue
+			req.downloadBundle()
+
+			// the retry waits out its backoff on the clock
+			Eventually(clock.Waiters).Should(Equal(1))
+			Consistently(other.downloadQueue).ShouldNot(Receive())
+			clock.Advance(6 * time.Minute)
+			Eventually(other.downloadQueue).Should(Receive(&req))
+			req.downloadBundle()
+
+			Eventually(tracker.Accepted).Should(HaveLen(1))
+			var received apiDeploymentResults
+			Expect(json.Unmarshal(tracker.Accepted()[0].Body, &received)).To(Succeed())
+			Expect(received).To(Equal(apiDeploymentResults{{
+				ID:        deploymentID,
+				Status:    RESPONSE_STATUS_FAIL,
+				ErrorCode: TRACKER_ERR_BUNDLE_DOWNLOAD_TIMEOUT,
+				Message:   "bundle download failed",
+			}}))
+
+			deployments, err := other.getDeployments("WHERE id=$1", deploymentID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deployments).To(HaveLen(1))
+			d := deployments[0]
+			Expect(d.DeployStatus).To(Equal(RESPONSE_STATUS_FAIL))
+			Expect(d.DeployErrorCode).To(Equal(TRACKER_ERR_BUNDLE_DOWNLOAD_TIMEOUT))
+			Expect(d.LocalBundleURI).To(BeAnExistingFile())
+			Expect(origin.Requests("/bundles/clock")).To(Equal(2))
+		})
+
 		It("should not continue attempts if deployment has been deleted", func() {
 
 			deploymentID := "bundle_download_deployment_deleted"
@@ -227,7 +282,7 @@ var _ = Describe("bundle", func() {
 			bundleJson, err := json.Marshal(bundle)
 			Expect(err).ShouldNot(HaveOccurred())
 
-			tx, err := getDB().Begin()
+			tx, err := gd.getDB().Begin()
 			Expect(err).ShouldNot(HaveOccurred())
 
 			dep := DataDeployment{
@@ -257,20 +312,20 @@ var _ = Describe("bundle", func() {
 			err = tx.Commit()
 			Expect(err).ShouldNot(HaveOccurred())
 
-			queueDownloadRequest(dep)
+			gd.queueDownloadRequest(dep)
 
 			// skip first try
-			time.Sleep(bundleRetryDelay)
+			time.Sleep(gd.bundleRetryDelay)
 
 			// delete deployment
-			tx, err = getDB().Begin()
+			tx, err = gd.getDB().Begin()
 			Expect(err).ShouldNot(HaveOccurred())
 			deleteDeployment(tx, dep.ID)
 			err = tx.Commit()
 			Expect(err).ShouldNot(HaveOccurred())
 
 			// wait for final
-			time.Sleep(bundleRetryDelay)
+			time.Sleep(gd.bundleRetryDelay)
 
 			// No way to test this programmatically currently
 			// search logs for "never mind, deployment bundle_download_deployment_deleted was deleted"
@@ -334,7 +389,7 @@ func checksumDownloadValid(checksumType string) {
 	checksum := testGetChecksum(checksumType, uri.String())
 	hash, err := getHashWriter(checksumType)
 	Expect(err).NotTo(HaveOccurred())
-	_, err = downloadFromURI(uri.String(), hash, checksum)
+	_, err = gd.downloadFromURI(uri.String(), hash, checksum)
 	Expect(err).NotTo(HaveOccurred())
 }
 
@@ -347,6 +402,6 @@ func checksumDownloadInvalid(checksumType string) {
 	checksum := "invalidchecksum"
 	hash, err := getHashWriter(checksumType)
 	Expect(err).NotTo(HaveOccurred())
-	_, err = downloadFromURI(uri.String(), hash, checksum)
+	_, err = gd.downloadFromURI(uri.String(), hash, checksum)
 	Expect(err).To(HaveOccurred())
 }
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("fake clock", func() {
+
+	epoch := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	It("should fire timers only when advanced past them", func() {
+		clock := NewFakeClock(epoch)
+		Expect(clock.Now()).To(Equal(epoch))
+
+		early := clock.After(time.Minute)
+		late := clock.After(time.Hour)
+		Expect(clock.After(0)).To(Receive(Equal(epoch)))
+		Expect(clock.Waiters()).To(Equal(2))
+
+		clock.Advance(59 * time.Second)
+		Expect(early).ShouldNot(Receive())
+
+		clock.Advance(2 * time.Second)
+		Expect(early).To(Receive(Equal(epoch.Add(time.Minute))))
+		Expect(late).ShouldNot(Receive())
+		Expect(clock.Now()).To(Equal(epoch.Add(61 * time.Second)))
+		Expect(clock.Waiters()).To(Equal(1))
+
+		clock.Advance(time.Hour)
+		Expect(late).To(Receive(Equal(epoch.Add(time.Hour))))
+		Expect(clock.Waiters()).To(Equal(0))
+	})
+
+	It("should tick every period until stopped", func() {
+		clock := NewFakeClock(epoch)
+		ticker := clock.NewTicker(time.Second)
+
+		clock.Advance(time.Second)
+		Expect(ticker.C()).To(Receive(Equal(epoch.Add(time.Second))))
+
+		// ticks the receiver isn't ready for are dropped
+		clock.Advance(3 * time.Second)
+		Expect(ticker.C()).To(Receive(Equal(epoch.Add(2 * time.Second))))
+		Expect(ticker.C()).ShouldNot(Receive())
+
+		ticker.Stop()
+		Expect(clock.Waiters()).To(Equal(0))
+		clock.Advance(time.Minute)
+		Expect(ticker.C()).ShouldNot(Receive())
+	})
+
+	It("should drive debounce", func() {
+		clock := NewFakeClock(epoch)
+		in := make(chan interface{})
+		out := make(chan []interface{})
+		stop := make(chan struct{})
+		defer close(stop)
+		go debounce(in, out, time.Second, clock, stop)
+
+		in <- "x"
+		in <- "y"
+		// a window is started for each of x, y and the wait after them
+		Eventually(clock.Waiters).Should(Equal(3))
+		Consistently(out).ShouldNot(Receive())
+
+		clock.Advance(time.Second)
+		Eventually(out).Should(Receive(Equal([]interface{}{"x", "y"})))
+	})
+})
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"github.com/30x/apid-core"
@@ -23,10 +24,15 @@ import (
 	_ "github.com/30x/apidGatewayDeploy"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	deploymentsFlag := flag.String("deployments", "", "file path to a deployments file (for testing)")
+	shutdownTimeoutFlag := flag.Duration("shutdown-timeout", 30*time.Second,
+		"time to finish downloads and send results to the tracker when stopped")
 	flag.Parse()
 	deploymentsFile := *deploymentsFlag
 
@@ -68,6 +74,8 @@ func main() {
 
 	insertTestDeployments(deployments)
 
+	go shutdownOnSignal(*shutdownTimeoutFlag)
+
 	// print the base url to the console
 	basePath := "/deployments"
 	port := configService.GetString("api_port")
@@ -83,6 +91,25 @@ func main() {
 	}
 }
 
+// shutdownOnSignal() stops the plugin gracefully on SIGTERM or interrupt and exits
+func shutdownOnSignal(timeout time.Duration) {
+	log := apid.Log()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.Printf("received %v, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := apiGatewayDeploy.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		log.Errorf("shutdown incomplete: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func insertTestDeployments(deployments apiGatewayDeploy.ApiDeploymentResponse) error {
 
 	if len(deployments) == 0 {
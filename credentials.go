@@ -0,0 +1,283 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/30x/apid-core"
+)
+
+const (
+	CREDENTIALS_STATIC = "static" // gatewaydeploy_tracker_token, or the apigeesync bearer token
+	CREDENTIALS_FILE   = "file"   // a token file, re-read when it changes
+	CREDENTIALS_OAUTH2 = "oauth2" // OAuth2 client credentials grant
+)
+
+const configApigeeSyncToken = "apigeesync_bearer_token"
+
+// refresh OAuth2 tokens this long before they expire
+const oauth2ExpiryMargin = 30 * time.Second
+
+// give up on the OAuth2 token endpoint after this long
+const oauth2FetchTimeout = 30 * time.Second
+
+// CredentialProvider supplies the bearer token for calls to the tracker
+type CredentialProvider interface {
+	// Token returns the current token
+	Token() (string, error)
+	// Refresh is called when the tracker rejects the current token
+	Refresh() error
+}
+
+// SetCredentialProvider replaces the provider of tracker credentials
+func (gd *GatewayDeploy) SetCredentialProvider(p CredentialProvider) {
+	gd.trackerCredentials = p
+}
+
+// SetCredentialProvider replaces the provider of tracker credentials of the instance registered with apid
+func SetCredentialProvider(p CredentialProvider) {
+	plugin.SetCredentialProvider(p)
+}
+
+func initCredentials(config apid.ConfigService, clock Clock, client *http.Client, kind, token, tokenFile, tokenURL, clientID,
+	clientSecret string, scopes []string) (CredentialProvider, error) {
+
+	switch kind {
+	case CREDENTIALS_STATIC:
+		if token != "" {
+			return NewStaticCredentials(token), nil
+		}
+		return configCredentials{config: config, key: configApigeeSyncToken}, nil
+	case CREDENTIALS_FILE:
+		if tokenFile == "" {
+			return nil, fmt.Errorf("%s is required for %s credentials", configTrackerTokenFile, kind)
+		}
+		return NewFileCredentials(tokenFile), nil
+	case CREDENTIALS_OAUTH2:
+		if tokenURL == "" || clientID == "" {
+			return nil, fmt.Errorf("%s and %s are required for %s credentials", configTrackerTokenURL,
+				configTrackerClientID, kind)
+		}
+		return NewOAuth2ClientCredentials(clock, client, tokenURL, clientID, clientSecret, scopes), nil
+	}
+	return nil, fmt.Errorf("%s must be %s, %s or %s", configTrackerCredentials,
+		CREDENTIALS_STATIC, CREDENTIALS_FILE, CREDENTIALS_OAUTH2)
+}
+
+// addHeaders() authorizes a request to the tracker
+func (gd *GatewayDeploy) addHeaders(req *http.Request) error {
+	token, err := gd.trackerCredentials.Token()
+	if err != nil {
+		return fmt.Errorf("unable to get tracker credentials: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// configCredentials reads the token from config on every request, so that updates by other plugins are used
+type configCredentials struct {
+	config apid.ConfigService
+	key    string
+}
+
+func (c configCredentials) Token() (string, error) {
+	return c.config.GetString(c.key), nil
+}
+
+func (c configCredentials) Refresh() error {
+	return nil
+}
+
+type staticCredentials struct {
+	token string
+}
+
+// NewStaticCredentials always supplies token
+func NewStaticCredentials(token string) CredentialProvider {
+	return staticCredentials{token: token}
+}
+
+func (c staticCredentials) Token() (string, error) {
+	return c.token, nil
+}
+
+func (c staticCredentials) Refresh() error {
+	return nil
+}
+
+type fileCredentials struct {
+	sync.Mutex
+	file    string
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// NewFileCredentials supplies the content of file, re-read whenever it is modified
+func NewFileCredentials(file string) CredentialProvider {
+	return &fileCredentials{file: file}
+}
+
+func (c *fileCredentials) Token() (string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	info, err := os.Stat(c.file)
+	if err != nil {
+		return "", err
+	}
+	if c.token == "" || !info.ModTime().Equal(c.modTime) || info.Size() != c.size {
+		if err := c.read(info); err != nil {
+			return "", err
+		}
+	}
+	return c.token, nil
+}
+
+func (c *fileCredentials) Refresh() error {
+	c.Lock()
+	defer c.Unlock()
+
+	info, err := os.Stat(c.file)
+	if err != nil {
+		return err
+	}
+	return c.read(info)
+}
+
+func (c *fileCredentials) read(info os.FileInfo) error {
+	b, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return fmt.Errorf("token file %s is empty", c.file)
+	}
+	c.token, c.modTime, c.size = token, info.ModTime(), info.Size()
+	return nil
+}
+
+type oauth2Credentials struct {
+	sync.Mutex
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+	clock        Clock
+	token        string
+	expires      time.Time
+}
+
+// NewOAuth2ClientCredentials supplies tokens from an OAuth2 token endpoint using the client credentials grant.
+// Tokens are fetched with client and their expiry is told by clock; nil selects http.DefaultClient and the system
+// clock.
+func NewOAuth2ClientCredentials(clock Clock, client *http.Client, tokenURL, clientID, clientSecret string,
+	scopes []string) CredentialProvider {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &oauth2Credentials{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		client:       client,
+		clock:        clock,
+	}
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (c *oauth2Credentials) Token() (string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.token != "" && (c.expires.IsZero() || c.clock.Now().Before(c.expires)) {
+		return c.token, nil
+	}
+	if err := c.fetch(); err != nil {
+		return "", err
+	}
+	return c.token, nil
+}
+
+func (c *oauth2Credentials) Refresh() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.fetch()
+}
+
+func (c *oauth2Credentials) fetch() error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.scopes) > 0 {
+		form.Set("scope", strings.Join(c.scopes, " "))
+	}
+	req, err := http.NewRequest("POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+
+	ctx, cancel := context.WithTimeout(context.Background(), oauth2FetchTimeout)
+	defer cancel()
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint %s responded with status %d: %s", c.tokenURL, resp.StatusCode, b)
+	}
+
+	var tr oauth2TokenResponse
+	if err := json.Unmarshal(b, &tr); err != nil {
+		return fmt.Errorf("unable to parse token response: %v", err)
+	}
+	if tr.AccessToken == "" {
+		return fmt.Errorf("token response from %s has no access_token", c.tokenURL)
+	}
+
+	c.token = tr.AccessToken
+	c.expires = time.Time{}
+	if tr.ExpiresIn > 0 {
+		c.expires = c.clock.Now().Add(time.Duration(tr.ExpiresIn)*time.Second - oauth2ExpiryMargin)
+	}
+	log.Debugf("fetched tracker token from %s, expires in %ds", c.tokenURL, tr.ExpiresIn)
+	return nil
+}
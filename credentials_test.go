@@ -0,0 +1,173 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("credentials", func() {
+
+	// a stand-in OAuth2 token server issuing token-1, token-2, ...
+	newTokenServer := func(issued *int32, expiresIn int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, secret, ok := r.BasicAuth()
+			r.ParseForm()
+			if !ok || id != "client" || secret != "secret" || r.Form.Get("grant_type") != "client_credentials" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			n := atomic.AddInt32(issued, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, n, expiresIn)
+		}))
+	}
+
+	AfterEach(func() {
+		gd.trackerCredentials = configCredentials{config: gd.services.Config(), key: configApigeeSyncToken}
+	})
+
+	It("should read the static token from config by default", func() {
+		p, err := initCredentials(gd.services.Config(), gd.clock, gd.client, CREDENTIALS_STATIC, "", "", "", "", "", nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		gd.services.Config().Set(configApigeeSyncToken, "synced")
+		Expect(p.Token()).To(Equal("synced"))
+
+		p, err = initCredentials(gd.services.Config(), gd.clock, gd.client, CREDENTIALS_STATIC, "fixed", "", "", "", "", nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(p.Token()).To(Equal("fixed"))
+		Expect(p.Refresh()).To(Succeed())
+
+		_, err = initCredentials(gd.services.Config(), gd.clock, gd.client, "bogus", "", "", "", "", "", nil)
+		Expect(err).Should(HaveOccurred())
+		_, err = initCredentials(gd.services.Config(), gd.clock, gd.client, CREDENTIALS_FILE, "", "", "", "", "", nil)
+		Expect(err).Should(HaveOccurred())
+		_, err = initCredentials(gd.services.Config(), gd.clock, gd.client, CREDENTIALS_OAUTH2, "", "", "", "", "", nil)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should pick up changes to the token file", func() {
+		dir, err := ioutil.TempDir("", "credentials_test")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		file := path.Join(dir, "token")
+		Expect(ioutil.WriteFile(file, []byte("first\n"), 0600)).To(Succeed())
+		p := NewFileCredentials(file)
+		Expect(p.Token()).To(Equal("first"))
+
+		Expect(ioutil.WriteFile(file, []byte("second"), 0600)).To(Succeed())
+		Expect(p.Token()).To(Equal("second"))
+
+		// same size and modification time, only a refresh sees it
+		past := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(file, past, past)).To(Succeed())
+		Expect(p.Token()).To(Equal("second"))
+		Expect(ioutil.WriteFile(file, []byte("third!"), 0600)).To(Succeed())
+		Expect(os.Chtimes(file, past, past)).To(Succeed())
+		Expect(p.Token()).To(Equal("second"))
+		Expect(p.Refresh()).To(Succeed())
+		Expect(p.Token()).To(Equal("third!"))
+
+		Expect(ioutil.WriteFile(file, nil, 0600)).To(Succeed())
+		Expect(p.Refresh()).Should(HaveOccurred())
+		Expect(os.Remove(file)).To(Succeed())
+		_, err = p.Token()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should fetch, cache and refresh OAuth2 client credentials", func() {
+		var issued int32
+		server := newTokenServer(&issued, 3600)
+		defer server.Close()
+
+		p := NewOAuth2ClientCredentials(nil, nil, server.URL, "client", "secret", []string{"tracker"})
+		Expect(p.Token()).To(Equal("token-1"))
+		Expect(p.Token()).To(Equal("token-1"))
+		Expect(p.Refresh()).To(Succeed())
+		Expect(p.Token()).To(Equal("token-2"))
+
+		// tokens close to expiry are replaced
+		short := newTokenServer(&issued, 1)
+		defer short.Close()
+		p = NewOAuth2ClientCredentials(nil, nil, short.URL, "client", "secret", nil)
+		Expect(p.Token()).To(Equal("token-3"))
+		Expect(p.Token()).To(Equal("token-4"))
+
+		p = NewOAuth2ClientCredentials(nil, nil, server.URL, "client", "wrong", nil)
+		_, err := p.Token()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should fetch a new OAuth2 token once the clock passes its expiry", func() {
+		var issued int32
+		server := newTokenServer(&issued, 3600)
+		defer server.Close()
+
+		clock := NewFakeClock(time.Now())
+		p := NewOAuth2ClientCredentials(clock, nil, server.URL, "client", "secret", nil)
+		Expect(p.Token()).To(Equal("token-1"))
+
+		clock.Advance(time.Hour - oauth2ExpiryMargin - time.Second)
+		Expect(p.Token()).To(Equal("token-1"))
+		clock.Advance(time.Second)
+		Expect(p.Token()).To(Equal("token-2"))
+	})
+
+	It("should refresh and retry immediately when the tracker rejects the token", func() {
+		var issued int32
+		tokenServer := newTokenServer(&issued, 3600)
+		defer tokenServer.Close()
+
+		var accepted, rejected int32
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token-2" {
+				atomic.AddInt32(&rejected, 1)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		SetCredentialProvider(NewOAuth2ClientCredentials(nil, nil, tokenServer.URL, "client", "secret", nil))
+
+		Expect(gd.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "x", Status: RESPONSE_STATUS_SUCCESS}})).
+			To(Succeed())
+		Expect(atomic.LoadInt32(&rejected)).To(Equal(int32(1)))
+		Expect(atomic.LoadInt32(&accepted)).To(Equal(int32(1)))
+
+		// heartbeats too
+		Expect(gd.sendHeartbeat(apiHeartbeat{})).To(Succeed())
+		Expect(atomic.LoadInt32(&accepted)).To(Equal(int32(2)))
+		atomic.StoreInt32(&issued, 2)
+		Expect(gd.trackerCredentials.Refresh()).To(Succeed())
+		Expect(gd.sendHeartbeat(apiHeartbeat{})).Should(HaveOccurred())
+	})
+})
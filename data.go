@@ -17,18 +17,12 @@ package apiGatewayDeploy
 import (
 	"database/sql"
 	"fmt"
-	"sync"
 
 	"encoding/json"
 	"github.com/30x/apid-core"
 	"strings"
 )
 
-var (
-	unsafeDB apid.DB
-	dbMux    sync.RWMutex
-)
-
 type DataDeployment struct {
 	ID                 string
 	BundleConfigID     string
@@ -48,6 +42,8 @@ type DataDeployment struct {
 	DeployStatus       string
 	DeployErrorCode    int
 	DeployErrorMessage string
+	Org                string // of the data scope, not stored
+	Env                string // of the data scope, not stored
 }
 
 type SQLExec interface {
@@ -82,6 +78,36 @@ func InitDBFullColumns(db apid.DB) error {
 		return err
 	}
 
+	err = initGatewayResultsTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initRolloutTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initRollbackTables(db)
+	if err != nil {
+		return err
+	}
+
+	err = initLeaderTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initSequenceTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initScopeTables(db)
+	if err != nil {
+		return err
+	}
+
 	log.Debug("Database tables created.")
 	return nil
 }
@@ -132,23 +158,59 @@ func alterTable(db apid.DB) error {
 			}
 		}
 	}
+	err := initGatewayResultsTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initRolloutTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initRollbackTables(db)
+	if err != nil {
+		return err
+	}
+
+	err = initLeaderTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initSequenceTable(db)
+	if err != nil {
+		return err
+	}
+
+	err = initScopeTables(db)
+	if err != nil {
+		return err
+	}
+
 	log.Debug("Database table altered.")
 	return nil
 }
 
-func getDB() apid.DB {
-	dbMux.RLock()
-	db := unsafeDB
-	dbMux.RUnlock()
-	return db
+func (gd *GatewayDeploy) getDB() apid.DB {
+	return gd.store.DB()
 }
 
-// caller is responsible for calling dbMux.Lock() and dbMux.Unlock()
-func SetDB(db apid.DB) {
-	if unsafeDB == nil { // init API when DB is initialized
-		go InitAPI()
+// SetDB replaces the DB of deployments. The deployments API is initialized once the first DB is set.
+func (gd *GatewayDeploy) SetDB(db apid.DB) {
+	first := gd.store.DB() == nil
+	gd.store.SetDB(db)
+	if first {
+		go gd.InitAPI()
 	}
-	unsafeDB = db
+
+	// the deployments of the DB may have activation windows, even if none of them is downloaded again
+	gd.triggerWindowReschedule()
+}
+
+// SetDB replaces the DB of the instance registered with apid
+func SetDB(db apid.DB) {
+	plugin.SetDB(db)
 }
 
 func InsertDeployment(tx *sql.Tx, dep DataDeployment) error {
@@ -228,7 +290,7 @@ func updateDeploymentsColumns(tx *sql.Tx, deps []DataDeployment) error {
 }
 
 func getDeploymentsToUpdate(db apid.DB) (deployments []DataDeployment, err error) {
-	deployments, err = getDeployments("WHERE bundle_uri IS NULL AND local_bundle_uri IS NULL AND deploy_status IS NULL")
+	deployments, err = queryDeployments(db, "WHERE bundle_uri IS NULL AND local_bundle_uri IS NULL AND deploy_status IS NULL")
 	if err != nil {
 		log.Errorf("getDeployments in getDeploymentsToUpdate failed: %v", err)
 		return
@@ -272,29 +334,46 @@ func deleteDeployment(tx *sql.Tx, depID string) error {
 	return err
 }
 
-// getReadyDeployments() returns array of deployments that are ready to deploy
-func getReadyDeployments() (deployments []DataDeployment, err error) {
-	return getDeployments("WHERE local_bundle_uri != $1", "")
+// getReadyDeployments() returns array of deployments that are ready to deploy and within their activation window
+func (gd *GatewayDeploy) getReadyDeployments() (deployments []DataDeployment, err error) {
+	deployments, err = gd.getDeployments("WHERE local_bundle_uri != $1", "")
+	if err != nil {
+		return
+	}
+	deployments, err = gd.applyRollbacks(deployments)
+	if err != nil {
+		return
+	}
+	deployments, err = gd.scopeDeployments(deployments)
+	if err != nil {
+		return
+	}
+	return activeDeployments(deployments, gd.clock.Now()), nil
 }
 
-// getUnreadyDeployments() returns array of deployments that are not yet ready to deploy
-func getUnreadyDeployments() (deployments []DataDeployment, err error) {
-	return getDeployments("WHERE local_bundle_uri = $1", "")
+// getUnreadyDeployments() returns array of deployments that are not yet ready to deploy. Deployments whose
+// configuration was rejected stay unready until ApigeeSync replaces them and aren't downloaded again.
+func (gd *GatewayDeploy) getUnreadyDeployments() (deployments []DataDeployment, err error) {
+	return gd.getDeployments("WHERE local_bundle_uri = $1 AND NOT (deploy_status = $2 AND deploy_error_code = $3)",
+		"", RESPONSE_STATUS_FAIL, TRACKER_ERR_DEPLOYMENT_BAD_CONFIG)
 }
 
 // getDeployments() accepts a "WHERE ..." clause and optional parameters and returns the list of deployments
-func getDeployments(where string, a ...interface{}) (deployments []DataDeployment, err error) {
-	db := getDB()
+func (gd *GatewayDeploy) getDeployments(where string, a ...interface{}) (deployments []DataDeployment, err error) {
+	return queryDeployments(gd.getDB(), where, a...)
+}
 
+// columns scanned by dataDeploymentsFromRows()
+const deploymentColumns = `id, bundle_config_id, apid_cluster_id, data_scope_id,
+	bundle_config_json, config_json, created, created_by,
+	updated, updated_by, bundle_config_name, bundle_uri,
+	local_bundle_uri, bundle_checksum, bundle_checksum_type, deploy_status,
+	deploy_error_code, deploy_error_message`
+
+// queryDeployments() is getDeployments() against a specific DB version
+func queryDeployments(db apid.DB, where string, a ...interface{}) (deployments []DataDeployment, err error) {
 	var stmt *sql.Stmt
-	stmt, err = db.Prepare(`
-	SELECT id, bundle_config_id, apid_cluster_id, data_scope_id,
-		bundle_config_json, config_json, created, created_by,
-		updated, updated_by, bundle_config_name, bundle_uri,
-		local_bundle_uri, bundle_checksum, bundle_checksum_type, deploy_status,
-		deploy_error_code, deploy_error_message
-	FROM edgex_deployment
-	` + where)
+	stmt, err = db.Prepare("SELECT " + deploymentColumns + " FROM edgex_deployment " + where)
 	if err != nil {
 		return
 	}
@@ -329,14 +408,14 @@ func dataDeploymentsFromRows(rows *sql.Rows) (deployments []DataDeployment) {
 	return
 }
 
-func setDeploymentResults(results apiDeploymentResults) error {
+func (gd *GatewayDeploy) setDeploymentResults(results apiDeploymentResults) error {
 
 	// also send results to server
-	go transmitDeploymentResultsToServer(results)
+	go gd.transmitDeploymentResultsToServer(results)
 
 	log.Debugf("setDeploymentResults: %v", results)
 
-	tx, err := getDB().Begin()
+	tx, err := gd.getDB().Begin()
 	if err != nil {
 		log.Errorf("Unable to begin transaction: %v", err)
 		return err
@@ -369,13 +448,18 @@ func setDeploymentResults(results apiDeploymentResults) error {
 	err = tx.Commit()
 	if err != nil {
 		log.Errorf("Unable to commit setDeploymentResults transaction: %v", err)
+		return err
 	}
-	return err
+
+	gd.emitFailedDeploymentEvents(results)
+	gd.markKnownGood(results)
+	gd.rollbackFailedDeployments(results)
+	return nil
 }
 
-func updateLocalBundleURI(depID, localBundleUri string) error {
+func (gd *GatewayDeploy) updateLocalBundleURI(depID, localBundleUri string) error {
 
-	stmt, err := getDB().Prepare("UPDATE edgex_deployment SET local_bundle_uri=$1 WHERE id=$2;")
+	stmt, err := gd.getDB().Prepare("UPDATE edgex_deployment SET local_bundle_uri=$1 WHERE id=$2;")
 	if err != nil {
 		log.Errorf("prepare updateLocalBundleURI failed: %v", err)
 		return err
@@ -0,0 +1,190 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Clients request a delta with ?delta=true and If-None-Match set to the ETag of the deployments they have. If
+// that ETag is still in the change log, the response is an ApiDeploymentDelta and deltaBaseHeader is set to the
+// ETag it applies to. Otherwise the full list is sent.
+const (
+	deltaQueryParam = "delta"
+	deltaBaseHeader = "X-Delta-Base"
+)
+
+// sent to client instead of ApiDeploymentResponse
+type ApiDeploymentDelta struct {
+	Added   []ApiDeployment `json:"added"`
+	Changed []ApiDeployment `json:"changed"`
+	Removed []string        `json:"removed"`
+}
+
+type deltaEntry struct {
+	scopeID     string
+	fingerprint [sha256.Size]byte
+	rollout     *rolloutView
+}
+
+func (e deltaEntry) equal(o deltaEntry) bool {
+	if e.scopeID != o.scopeID || e.fingerprint != o.fingerprint || (e.rollout == nil) != (o.rollout == nil) {
+		return false
+	}
+	return e.rollout == nil || (e.rollout.percentage == o.rollout.percentage && e.rollout.halted == o.rollout.halted)
+}
+
+// the deployments that were sent with an ETag. Deployments may change before the ETag is incremented, so a
+// generation sent with different deployments is ambiguous and can't be the base of a delta.
+type deploymentsGeneration struct {
+	eTag        string
+	deployments map[string]deltaEntry
+	ambiguous   bool
+}
+
+// deploymentsChangeLog keeps the most recent generations of ready deployments, oldest first
+type deploymentsChangeLog struct {
+	sync.Mutex
+	generations []deploymentsGeneration
+}
+
+func wantsDelta(r *http.Request) bool {
+	return r.URL.Query().Get(deltaQueryParam) == "true" && r.Header.Get("If-None-Match") != ""
+}
+
+func deploymentFingerprint(dep ApiDeployment) [sha256.Size]byte {
+	b, err := json.Marshal(dep)
+	if err != nil {
+		log.Errorf("unable to marshal deployment %s: %v", dep.ID, err)
+	}
+	return sha256.Sum256(b)
+}
+
+// record() saves the deployments sent with eTag and their rollouts, keeping the latest history generations
+func (c *deploymentsChangeLog) record(eTag string, deployments []DataDeployment, rollouts map[string]*rolloutView,
+	history int) {
+	if history == 0 {
+		return
+	}
+
+	entries := make(map[string]deltaEntry, len(deployments))
+	for _, d := range deployments {
+		entries[d.ID] = deltaEntry{
+			scopeID:     d.DataScopeID,
+			fingerprint: deploymentFingerprint(apiDeploymentFromData(d)),
+			rollout:     rollouts[d.ID],
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for i, g := range c.generations {
+		if g.eTag == eTag {
+			if !sameDeltaEntries(g.deployments, entries) {
+				c.generations[i].ambiguous = true
+			}
+			return
+		}
+	}
+
+	generation := deploymentsGeneration{
+		eTag:        eTag,
+		deployments: entries,
+	}
+	c.generations = append(c.generations, generation)
+	if len(c.generations) > history {
+		c.generations = c.generations[len(c.generations)-history:]
+	}
+}
+
+// delta() returns the changes from the deployments sent with since to the current deployments of a client, or
+// false if since is no longer in the change log. sent() returns whether a deployment of since was sent to the
+// client.
+func (c *deploymentsChangeLog) delta(since string, sent func(id string, e deltaEntry) bool,
+	current []DataDeployment) (ApiDeploymentDelta, bool) {
+
+	delta := ApiDeploymentDelta{
+		Added:   []ApiDeployment{},
+		Changed: []ApiDeployment{},
+		Removed: []string{},
+	}
+
+	c.Lock()
+	var base map[string]deltaEntry
+	for _, g := range c.generations {
+		if g.eTag == since && !g.ambiguous {
+			base = g.deployments
+			break
+		}
+	}
+	c.Unlock()
+
+	if base == nil {
+		return delta, false
+	}
+
+	currentIDs := make(map[string]bool, len(current))
+	for _, d := range current {
+		currentIDs[d.ID] = true
+		dep := apiDeploymentFromData(d)
+		entry, ok := base[d.ID]
+		if !ok || !sent(d.ID, entry) {
+			delta.Added = append(delta.Added, dep)
+		} else if entry.fingerprint != deploymentFingerprint(dep) {
+			delta.Changed = append(delta.Changed, dep)
+		}
+	}
+
+	for id, entry := range base {
+		if !currentIDs[id] && sent(id, entry) {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	sort.Strings(delta.Removed)
+
+	return delta, true
+}
+
+func sameDeltaEntries(a, b map[string]deltaEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, entry := range a {
+		if !b[id].equal(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+func sendDelta(w http.ResponseWriter, delta ApiDeploymentDelta, since, eTag string) {
+
+	b, err := json.Marshal(delta)
+	if err != nil {
+		log.Errorf("unable to marshal deployments delta: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Debugf("sending deployments delta %s..%s: %s", since, eTag, b)
+	w.Header().Set("ETag", eTag)
+	w.Header().Set(deltaBaseHeader, since)
+	w.Write(b)
+}
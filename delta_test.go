@@ -0,0 +1,115 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("deployments delta", func() {
+
+	getDeployments := func(eTag string, delta bool) (*http.Response, []byte) {
+		uri := testServer.URL + deploymentsEndpoint
+		if delta {
+			uri += "?delta=true"
+		}
+		req, err := http.NewRequest("GET", uri, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		if eTag != "" {
+			req.Header.Add("If-None-Match", eTag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		return res, body
+	}
+
+	It("should send added, changed and removed deployments since an ETag", func() {
+
+		insertTestDeployment(testServer, "delta_unchanged")
+		insertTestDeployment(testServer, "delta_changed")
+		insertTestDeployment(testServer, "delta_removed")
+
+		// start from a generation no other test has seen
+		gd.incrementETag()
+		res, _ := getDeployments("", false)
+		since := res.Header.Get("ETag")
+		Expect(since).ShouldNot(BeEmpty())
+
+		insertTestDeployment(testServer, "delta_added")
+		Expect(gd.updateLocalBundleURI("delta_changed", "y")).To(Succeed())
+		tx, err := gd.getDB().Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deleteDeployment(tx, "delta_removed")).To(Succeed())
+		Expect(tx.Commit()).To(Succeed())
+		gd.incrementETag()
+
+		res, body := getDeployments(since, true)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(res.Header.Get(deltaBaseHeader)).To(Equal(since))
+		Expect(res.Header.Get("ETag")).To(Equal(gd.getETag()))
+
+		var delta ApiDeploymentDelta
+		Expect(json.Unmarshal(body, &delta)).To(Succeed())
+		Expect(delta.Added).To(HaveLen(1))
+		Expect(delta.Added[0].ID).To(Equal("delta_added"))
+		Expect(delta.Changed).To(HaveLen(1))
+		Expect(delta.Changed[0].ID).To(Equal("delta_changed"))
+		Expect(delta.Changed[0].URI).To(Equal("y"))
+		Expect(delta.Removed).To(Equal([]string{"delta_removed"}))
+	})
+
+	It("should send all deployments if the ETag is no longer known", func() {
+
+		insertTestDeployment(testServer, "delta_full")
+
+		res, body := getDeployments("unknown", true)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(res.Header.Get(deltaBaseHeader)).To(BeEmpty())
+
+		var depRes ApiDeploymentResponse
+		Expect(json.Unmarshal(body, &depRes)).To(Succeed())
+		Expect(depRes).To(HaveLen(1))
+		Expect(depRes[0].ID).To(Equal("delta_full"))
+	})
+
+	It("should keep a bounded number of generations", func() {
+
+		history := 2
+		sentAll := func(string, deltaEntry) bool { return true }
+		changes := &deploymentsChangeLog{}
+		changes.record("1", nil, nil, history)
+		changes.record("2", nil, nil, history)
+		changes.record("2", nil, nil, history)
+		changes.record("3", nil, nil, history)
+		Expect(changes.generations).To(HaveLen(2))
+
+		_, ok := changes.delta("1", sentAll, nil)
+		Expect(ok).To(BeFalse())
+		_, ok = changes.delta("2", sentAll, nil)
+		Expect(ok).To(BeTrue())
+
+		changes.record("3", []DataDeployment{{ID: "delta_ambiguous"}}, nil, history)
+		_, ok = changes.delta("3", sentAll, nil)
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"github.com/30x/apid-core"
+)
+
+// other plugins may listen on this selector to follow the lifecycle of deployments
+const GATEWAY_DEPLOY_EVENT = "GatewayDeploy"
+
+// DeploymentReceived is emitted when a new deployment arrives from ApigeeSync
+type DeploymentReceived struct {
+	Deployment DataDeployment
+}
+
+// BundleDownloaded is emitted when the bundle for a deployment has been stored locally
+type BundleDownloaded struct {
+	Deployment DataDeployment
+}
+
+// DeploymentReady is emitted when a deployment becomes available to gateways
+type DeploymentReady struct {
+	Deployment DataDeployment
+}
+
+// DeploymentFailed is emitted when a deployment is marked as failed, either by this plugin or by a gateway
+type DeploymentFailed struct {
+	Deployment DataDeployment
+	ErrorCode  int
+	Message    string
+}
+
+// DeploymentRemoved is emitted when a deployment is deleted by ApigeeSync
+type DeploymentRemoved struct {
+	Deployment DataDeployment
+}
+
+// DeploymentRolledBack is emitted when a failed deployment is replaced by a previous known-good deployment of
+// the same bundle config
+type DeploymentRolledBack struct {
+	Deployment   DataDeployment
+	RolledBackTo DataDeployment
+}
+
+// SnapshotFailed is emitted when switching to a new snapshot fails. The previous DB version remains in use
+// and the switch will be retried.
+type SnapshotFailed struct {
+	SnapshotInfo string
+	Error        error
+}
+
+func (gd *GatewayDeploy) emitDeploymentEvent(event apid.Event) {
+	log.Debugf("emitting %s event: %#v", GATEWAY_DEPLOY_EVENT, event)
+	gd.services.Events().Emit(GATEWAY_DEPLOY_EVENT, event)
+}
+
+// emits DeploymentFailed for each failed result that matches a known deployment
+func (gd *GatewayDeploy) emitFailedDeploymentEvents(results apiDeploymentResults) {
+	for _, result := range results {
+		if result.Status != RESPONSE_STATUS_FAIL {
+			continue
+		}
+		deployments, err := gd.getDeployments("WHERE id=$1", result.ID)
+		if err != nil || len(deployments) == 0 {
+			continue
+		}
+		gd.emitDeploymentEvent(&DeploymentFailed{
+			Deployment: deployments[0],
+			ErrorCode:  result.ErrorCode,
+			Message:    result.Message,
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/30x/apid-core"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("events", func() {
+
+	It("should emit received, downloaded and ready for a new deployment", func() {
+
+		deploymentID := "events_new_deployment"
+		events := listenForDeploymentEvents(deploymentID)
+
+		event, dep := createChangeDeployment(deploymentID)
+		tx, err := gd.getDB().Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		err = InsertDeployment(tx, dep)
+		Expect(err).ShouldNot(HaveOccurred())
+		err = tx.Commit()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		apid.Events().Emit(APIGEE_SYNC_EVENT, &event)
+
+		seen := map[string]apid.Event{}
+		Eventually(func() map[string]apid.Event {
+			select {
+			case e := <-events:
+				seen[reflect.TypeOf(e).Elem().Name()] = e
+			default:
+			}
+			return seen
+		}, 2*time.Second).Should(And(
+			HaveKey("DeploymentReceived"),
+			HaveKey("BundleDownloaded"),
+			HaveKey("DeploymentReady"),
+		))
+
+		ready := seen["DeploymentReady"].(*DeploymentReady)
+		Expect(ready.Deployment.ID).To(Equal(deploymentID))
+		Expect(ready.Deployment.LocalBundleURI).To(BeAnExistingFile())
+	})
+
+	It("should emit removed for a deleted deployment", func() {
+
+		deploymentID := "events_removed_deployment"
+		events := listenForDeploymentEvents(deploymentID)
+
+		row := common.Row{}
+		row["id"] = &common.ColumnVal{Value: deploymentID}
+		row["data_scope_id"] = &common.ColumnVal{Value: "events_scope"}
+		event := common.ChangeList{
+			Changes: []common.Change{
+				{
+					Operation: common.Delete,
+					Table:     DEPLOYMENT_TABLE,
+					OldRow:    row,
+				},
+			},
+		}
+
+		apid.Events().Emit(APIGEE_SYNC_EVENT, &event)
+
+		var e apid.Event
+		Eventually(events).Should(Receive(&e))
+		removed, ok := e.(*DeploymentRemoved)
+		Expect(ok).To(BeTrue())
+		Expect(removed.Deployment.ID).To(Equal(deploymentID))
+		Expect(removed.Deployment.DataScopeID).To(Equal("events_scope"))
+	})
+
+	It("should emit failed when a deployment is marked failed", func() {
+
+		deploymentID := "events_failed_deployment"
+		insertTestDeployment(testServer, deploymentID)
+		events := listenForDeploymentEvents(deploymentID)
+
+		err := gd.setDeploymentResults(apiDeploymentResults{
+			{
+				ID:        deploymentID,
+				Status:    RESPONSE_STATUS_FAIL,
+				ErrorCode: 100,
+				Message:   "Some error message",
+			},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var e apid.Event
+		Eventually(events).Should(Receive(&e))
+		failed, ok := e.(*DeploymentFailed)
+		Expect(ok).To(BeTrue())
+		Expect(failed.Deployment.ID).To(Equal(deploymentID))
+		Expect(failed.ErrorCode).To(Equal(100))
+		Expect(failed.Message).To(Equal("Some error message"))
+	})
+})
+
+func listenForDeploymentEvents(deploymentID string) chan apid.Event {
+	events := make(chan apid.Event, 10)
+	apid.Events().ListenFunc(GATEWAY_DEPLOY_EVENT, func(e apid.Event) {
+		var dep DataDeployment
+		switch e := e.(type) {
+		case *DeploymentReceived:
+			dep = e.Deployment
+		case *BundleDownloaded:
+			dep = e.Deployment
+		case *DeploymentReady:
+			dep = e.Deployment
+		case *DeploymentFailed:
+			dep = e.Deployment
+		case *DeploymentRemoved:
+			dep = e.Deployment
+		case *DeploymentRolledBack:
+			dep = e.Deployment
+		}
+		if dep.ID == deploymentID {
+			select {
+			case events <- e:
+			default:
+			}
+		}
+	})
+	return events
+}
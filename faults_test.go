@@ -0,0 +1,264 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/30x/apidGatewayDeploy/testutil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// rejected until refreshed
+type refreshingCredentials struct {
+	token string
+}
+
+func (c *refreshingCredentials) Token() (string, error) {
+	return c.token, nil
+}
+
+func (c *refreshingCredentials) Refresh() error {
+	c.token = "fresh"
+	return nil
+}
+
+var _ = Describe("fault injection", func() {
+
+	const bundlePath = "/bundles/faults"
+	content := []byte("bundle behind a faulty origin")
+
+	var (
+		origin  *testutil.BundleOrigin
+		tracker *testutil.Tracker
+		clock   *FakeClock
+		other   *GatewayDeploy
+	)
+
+	BeforeEach(func() {
+		origin = testutil.NewBundleOrigin()
+		tracker = testutil.NewTracker()
+		clock = NewFakeClock(time.Now())
+
+		var err error
+		other, err = NewGatewayDeploy(gd.services, Options{Clock: clock, Store: &dbStore{}})
+		Expect(err).ShouldNot(HaveOccurred())
+		other.store.SetDB(gd.getDB())
+		other.markDeploymentFailedAfter = time.Hour
+		other.bundleRetryDelay = time.Minute
+		other.fetcher = uriFetcher{other.client.Transport, 200 * time.Millisecond}
+		other.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		origin.Close()
+		tracker.Close()
+	})
+
+	// waits for each of n backoffs and moves the clock past it
+	skipBackoffs := func(n int) {
+		for i := 0; i < n; i++ {
+			Eventually(clock.Waiters).Should(Equal(1))
+			clock.Advance(5 * time.Minute)
+		}
+	}
+
+	Context("downloadFromURI", func() {
+
+		download := func() (string, error) {
+			hashWriter, err := getHashWriter("crc32")
+			Expect(err).ShouldNot(HaveOccurred())
+			tempFile, err := other.downloadFromURI(origin.URL+bundlePath, hashWriter, testutil.Checksum(content))
+			if tempFile != "" {
+				defer os.Remove(tempFile)
+			}
+			return tempFile, err
+		}
+
+		BeforeEach(func() {
+			origin.AddBundle(bundlePath, content)
+		})
+
+		It("should report a bad checksum for wrong bytes", func() {
+			origin.Script(bundlePath, testutil.Fault{WrongBytes: true})
+			_, err := download()
+			Expect(err).To(BeAssignableToTypeOf(badChecksumError{}))
+			Expect(downloadEndpointFailed(err)).To(BeFalse())
+
+			_, err = download()
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should fail on a connection reset mid-body", func() {
+			origin.Script(bundlePath, testutil.Fault{ResetAfter: 5})
+			_, err := download()
+			Expect(err).Should(HaveOccurred())
+			Expect(err).NotTo(BeAssignableToTypeOf(badChecksumError{}))
+			Expect(downloadEndpointFailed(err)).To(BeTrue())
+		})
+
+		It("should not blame the origin for local I/O errors", func() {
+			err := &os.PathError{Op: "write", Path: "bundle", Err: os.ErrPermission}
+			Expect(downloadEndpointFailed(err)).To(BeFalse())
+		})
+
+		It("should fail on 5xx responses", func() {
+			origin.Script(bundlePath, testutil.Status(503), testutil.Status(404))
+			_, err := download()
+			Expect(err).To(Equal(httpStatusError{origin.URL + bundlePath, 503}))
+			Expect(downloadEndpointFailed(err)).To(BeTrue())
+			_, err = download()
+			Expect(downloadEndpointFailed(err)).To(BeFalse())
+			Expect(origin.Requests(bundlePath)).To(Equal(2))
+		})
+
+		It("should time out on latency and on a slow drip", func() {
+			origin.Script(bundlePath, testutil.Fault{Latency: time.Second}, testutil.Fault{DripEvery: 50 * time.Millisecond})
+			_, err := download()
+			Expect(downloadFailureCause(err)).To(Equal(DOWNLOAD_FAILURE_TIMEOUT))
+			_, err = download()
+			Expect(downloadFailureCause(err)).To(Equal(DOWNLOAD_FAILURE_TIMEOUT))
+
+			origin.Script(bundlePath, testutil.Fault{DripEvery: time.Millisecond})
+			_, err = download()
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("DownloadRequest", func() {
+
+		var dep DataDeployment
+
+		BeforeEach(func() {
+			dep = insertBundleDeployment(other.getDB(), "faults_download", origin.AddBundle(bundlePath, content),
+				testutil.Checksum(content))
+		})
+
+		// runs the queued request and each of its retries
+		drive := func(retries int) {
+			var req *DownloadRequest
+			Eventually(other.downloadQueue).Should(Receive(&req))
+			req.downloadBundle()
+			for i := 0; i < retries; i++ {
+				skipBackoffs(1)
+				Eventually(other.downloadQueue).Should(Receive(&req))
+				req.downloadBundle()
+			}
+		}
+
+		It("should retry through faults until the bundle is downloaded", func() {
+			origin.Script(bundlePath,
+				testutil.Status(503),
+				testutil.Status(500),
+				testutil.Fault{ResetAfter: 3},
+				testutil.Fault{WrongBytes: true},
+			)
+
+			other.queueDownloadRequest(dep)
+			drive(4)
+
+			deployments, err := other.getDeployments("WHERE id=$1", dep.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deployments).To(HaveLen(1))
+			Expect(ioutil.ReadFile(deployments[0].LocalBundleURI)).To(Equal(content))
+			Expect(origin.Requests(bundlePath)).To(Equal(5))
+			Expect(tracker.Requests()).To(BeEmpty())
+		})
+
+		It("should fail the deployment after the maximum attempts", func() {
+			other.downloadMaxAttempts = 2
+			origin.Script(bundlePath, testutil.Repeat(2, testutil.Status(502))...)
+
+			other.queueDownloadRequest(dep)
+			drive(1)
+
+			Eventually(tracker.Accepted).Should(HaveLen(1))
+			var received apiDeploymentResults
+			Expect(json.Unmarshal(tracker.Accepted()[0].Body, &received)).To(Succeed())
+			Expect(received).To(HaveLen(1))
+			Expect(received[0].ID).To(Equal(dep.ID))
+			Expect(received[0].Status).To(Equal(RESPONSE_STATUS_FAIL))
+			Expect(received[0].ErrorCode).To(Equal(TRACKER_ERR_BUNDLE_DOWNLOAD_FAILED))
+
+			deployments, err := other.getDeployments("WHERE id=$1", dep.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deployments[0].LocalBundleURI).To(BeEmpty())
+			Expect(origin.Requests(bundlePath)).To(Equal(2))
+		})
+	})
+
+	Context("transmitDeploymentResultsToServer", func() {
+
+		results := apiDeploymentResults{{ID: "faults_transmit", Status: RESPONSE_STATUS_SUCCESS}}
+
+		transmit := func() chan error {
+			done := make(chan error, 1)
+			go func() {
+				done <- other.transmitDeploymentResultsToServer(results)
+			}()
+			return done
+		}
+
+		statuses := func() []int {
+			var s []int
+			for _, req := range tracker.Requests() {
+				s = append(s, req.Status)
+			}
+			return s
+		}
+
+		It("should retry through 5xx responses, resets and 401s", func() {
+			tracker.Script(testutil.Status(500), testutil.Fault{Drop: true}, testutil.Status(401))
+
+			done := transmit()
+			skipBackoffs(2)
+			Eventually(done).Should(Receive(BeNil()))
+
+			Expect(statuses()).To(Equal([]int{500, 0, 401, 200}))
+			accepted := tracker.Accepted()[0]
+			Expect(accepted.Method).To(Equal("PUT"))
+			Expect(accepted.Path).To(Equal("/clusters/CLUSTER_ID/apids/INSTANCE_ID/deployments"))
+			var received apiDeploymentResults
+			Expect(json.Unmarshal(accepted.Body, &received)).To(Succeed())
+			Expect(received).To(Equal(results))
+		})
+
+		It("should refresh a rejected token without backing off", func() {
+			tracker.RequireToken("fresh")
+			other.SetCredentialProvider(&refreshingCredentials{token: "stale"})
+
+			Expect(<-transmit()).To(Succeed())
+			Expect(statuses()).To(Equal([]int{http.StatusUnauthorized, http.StatusOK}))
+			Expect(tracker.Accepted()[0].Header.Get("Authorization")).To(Equal("Bearer fresh"))
+		})
+
+		It("should give up after the maximum attempts", func() {
+			other.trackerMaxAttempts = 3
+			tracker.Script(testutil.Repeat(3, testutil.Status(503))...)
+
+			done := transmit()
+			skipBackoffs(2)
+			Eventually(done).Should(Receive(HaveOccurred()))
+			Expect(statuses()).To(Equal([]int{503, 503, 503}))
+		})
+	})
+})
@@ -0,0 +1,240 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/30x/apid-core"
+)
+
+// the instance registered with apid by initPlugin
+var plugin *GatewayDeploy
+
+// GatewayDeploy is an instance of the plugin. All of its state lives here, so that several isolated instances
+// can run in one process.
+type GatewayDeploy struct {
+	services apid.Services
+	data     apid.DataService
+	clock    Clock
+	client   *http.Client
+	store    Store
+	fetcher  BundleFetcher
+
+	// configuration
+	bundlePath                 string
+	debounceDuration           time.Duration
+	bundleCleanupDelay         time.Duration
+	apiServerBaseURI           *url.URL
+	apidInstanceID             string
+	apidClusterID              string
+	downloadQueueSize          int
+	concurrentDownloads        int
+	markDeploymentFailedAfter  time.Duration
+	bundleDownloadConnTimeout  time.Duration
+	bundleRetryDelay           time.Duration
+	snapshotRetryDelay         time.Duration
+	unhealthyAfter             time.Duration
+	resultPolicy               string
+	expectedGateways           int
+	deltaHistory               int // generations kept, 0 disables deltas
+	bundleHistory              int // downloaded deployments kept per bundle_config_id, 0 disables history
+	rollbackPolicy             string
+	heartbeatInterval          time.Duration // 0 disables heartbeats
+	leaderLeaseDuration        time.Duration
+	trackerMaxAttempts         int // 0 retries forever
+	downloadMaxAttempts        int // 0 retries forever
+	webhookMaxAttempts         int // per delivery
+	webhookMaxFailedDeliveries int // consecutive, before a registration is dropped
+	webhookRetryDelay          time.Duration
+	templatingEnabled          bool
+	templateVars               templateVarConfig
+	configSchemas              map[string]*jsonSchema
+	apiAuth                    apiAuthConfig
+	bundlePeers                peerDiscovery
+	trackerCredentials         CredentialProvider
+
+	// state
+	startedAt             time.Time
+	eTag                  int64 // atomic
+	longPollSubscribers   int64 // atomic
+	deploymentsChanged    chan interface{}
+	addSubscriber         chan chan deploymentsResult
+	removeSubscriber      chan chan deploymentsResult
+	windowBoundaryReached chan time.Time // signals distributeEvents() that a deployment was (de)activated
+	rescheduleWindows     chan struct{}  // signals scheduleWindowBoundaries() that deployments changed
+	downloadQueue         chan *DownloadRequest
+	downloads             *downloadsInFlight
+	workerQueue           chan chan *DownloadRequest
+	snapshotMux           sync.Mutex
+	latestSnapshotInfo    string
+	changeLog             *deploymentsChangeLog
+	templates             *templateCache
+	health                *pluginHealth
+	metrics               *pluginMetrics
+	breakers              *breakerRegistry
+	webhooks              *webhookRegistry
+	election              *leaderElection
+	lifecycle             *pluginLifecycle
+}
+
+// Options supplies the dependencies of a GatewayDeploy. Zero values select the defaults.
+type Options struct {
+	Clock   Clock         // defaults to the system clock
+	Client  *http.Client  // for the tracker, peers and webhooks; defaults to http.DefaultClient
+	Store   Store         // defaults to a store of the DB versions set by ApigeeSync
+	Fetcher BundleFetcher // defaults to fetching http, https and file URIs with Client's transport
+}
+
+// Store holds the DB of deployments. ApigeeSync replaces it with each snapshot.
+type Store interface {
+	DB() apid.DB // nil until a DB is set
+	SetDB(db apid.DB)
+}
+
+type dbStore struct {
+	mux sync.RWMutex
+	db  apid.DB
+}
+
+func (s *dbStore) DB() apid.DB {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.db
+}
+
+func (s *dbStore) SetDB(db apid.DB) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.db = db
+}
+
+// BundleFetcher reads bundle content from the origin
+type BundleFetcher interface {
+	Fetch(ctx context.Context, uri string) (io.ReadCloser, error)
+}
+
+// uriFetcher reads http and https URIs, and files for file URIs or URIs without a scheme
+type uriFetcher struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (f uriFetcher) Fetch(ctx context.Context, uriString string) (io.ReadCloser, error) {
+
+	uri, err := url.Parse(uriString)
+	if err != nil {
+		return nil, fmt.Errorf("DownloadFileUrl: Failed to parse urlStr: %s", uriString)
+	}
+
+	// todo: add authentication - TBD?
+
+	// assume it's a file if no scheme - todo: remove file support?
+	if uri.Scheme == "" || uri.Scheme == "file" {
+		f, err := os.Open(uri.Path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	// GET the contents at uriString
+	req, err := http.NewRequest("GET", uriString, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{
+		Transport: f.transport,
+		Timeout:   f.timeout,
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, httpStatusError{uriString, res.StatusCode}
+	}
+	return res.Body, nil
+}
+
+var logOnce sync.Once
+
+func initLog(services apid.Services) {
+	logOnce.Do(func() {
+		log = services.Log().ForModule("apiGatewayDeploy")
+	})
+}
+
+// newGatewayDeploy() creates an instance with the default settings and state, before configuration
+func newGatewayDeploy(services apid.Services, opts Options) *GatewayDeploy {
+	gd := &GatewayDeploy{
+		services:                   services,
+		data:                       services.Data(),
+		clock:                      opts.Clock,
+		client:                     opts.Client,
+		store:                      opts.Store,
+		fetcher:                    opts.Fetcher,
+		bundleRetryDelay:           time.Second,
+		snapshotRetryDelay:         time.Second,
+		resultPolicy:               RESULT_POLICY_ANY_FAIL,
+		expectedGateways:           1,
+		deltaHistory:               20,
+		rollbackPolicy:             ROLLBACK_POLICY_NONE,
+		leaderLeaseDuration:        30 * time.Second,
+		webhookMaxAttempts:         5,
+		webhookMaxFailedDeliveries: 3,
+		webhookRetryDelay:          time.Second,
+		deploymentsChanged:         make(chan interface{}, 5),
+		addSubscriber:              make(chan chan deploymentsResult),
+		removeSubscriber:           make(chan chan deploymentsResult),
+		windowBoundaryReached:      make(chan time.Time, 1),
+		rescheduleWindows:          make(chan struct{}, 1),
+		downloads:                  newDownloadsInFlight(),
+		changeLog:                  &deploymentsChangeLog{},
+		templates:                  &templateCache{},
+	}
+	if gd.clock == nil {
+		gd.clock = systemClock{}
+	}
+	if gd.client == nil {
+		gd.client = http.DefaultClient
+	}
+	if gd.store == nil {
+		gd.store = &dbStore{}
+	}
+	gd.startedAt = gd.clock.Now()
+	gd.trackerCredentials = configCredentials{config: services.Config(), key: configApigeeSyncToken}
+	gd.health = &pluginHealth{gd: gd}
+	gd.metrics = newPluginMetrics(gd)
+	gd.breakers = newBreakerRegistry(gd.clock, 5, 30*time.Second)
+	gd.webhooks = newWebhookRegistry()
+	gd.election, _ = newLeaderElection(gd, LEADER_ELECTION_NONE, "", false)
+	gd.lifecycle = newLifecycle(gd)
+	return gd
+}
+
+// start() runs the background work of the instance
+func (gd *GatewayDeploy) start() {
+	gd.lifecycle.start()
+	go gd.election.run()
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("gateway deploy instances", func() {
+
+	It("should keep their state apart", func() {
+		epoch := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		other, err := NewGatewayDeploy(gd.services, Options{
+			Clock: NewFakeClock(epoch),
+			Store: &dbStore{},
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(other.startedAt).To(Equal(epoch))
+
+		db, err := gd.data.DBVersion("gatewaydeploy_test")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(InitDBFullColumns(db)).To(Succeed())
+		_, err = db.Exec("DELETE FROM edgex_deployment")
+		Expect(err).ShouldNot(HaveOccurred())
+		other.store.SetDB(db)
+		Expect(other.getDB()).ShouldNot(BeIdenticalTo(gd.getDB()))
+
+		tx, err := other.getDB().Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(InsertDeployment(tx, DataDeployment{ID: "isolated", DataScopeID: "isolated"})).To(Succeed())
+		Expect(tx.Commit()).To(Succeed())
+
+		deps, err := other.getUnreadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deps).To(HaveLen(1))
+		deps, err = gd.getUnreadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deps).To(BeEmpty())
+
+		Expect(other.getETag()).To(Equal("0"))
+		other.incrementETag()
+		Expect(other.getETag()).To(Equal("1"))
+
+		Expect(other.breakers).ShouldNot(BeIdenticalTo(gd.breakers))
+		Expect(other.webhooks).ShouldNot(BeIdenticalTo(gd.webhooks))
+		Expect(other.downloadQueue).ShouldNot(Equal(gd.downloadQueue))
+	})
+})
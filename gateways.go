@@ -0,0 +1,225 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/30x/apid-core"
+)
+
+// gateways may identify themselves with this header or the gatewayId field of each result
+const gatewayIDHeader = "X-Gateway-Id"
+
+// policies to compute the status of a deployment from the results of all gateways
+const (
+	RESULT_POLICY_ANY_FAIL    = "any-fail"    // FAIL if any gateway failed, otherwise SUCCESS
+	RESULT_POLICY_ALL_SUCCESS = "all-success" // SUCCESS once all expected gateways succeeded, FAIL if any failed
+	RESULT_POLICY_QUORUM      = "quorum"      // SUCCESS once a majority of expected gateways succeeded
+)
+
+type apiGatewayResult struct {
+	GatewayID string `json:"gatewayId"`
+	Status    string `json:"status"`
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+}
+
+func validResultPolicy(policy string) bool {
+	switch policy {
+	case RESULT_POLICY_ANY_FAIL, RESULT_POLICY_ALL_SUCCESS, RESULT_POLICY_QUORUM:
+		return true
+	}
+	return false
+}
+
+func initGatewayResultsTable(db apid.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_deployment_gateway_result (
+		deployment_id varchar(36) NOT NULL,
+		gateway_id text NOT NULL,
+		deploy_status string,
+		deploy_error_code int,
+		deploy_error_message text,
+		updated timestamp without time zone,
+		PRIMARY KEY (deployment_id, gateway_id)
+	);
+	`)
+	return err
+}
+
+// setGatewayResults() stores the results reported by each gateway, then updates each deployment with the
+// aggregate status of all of its gateways. Returns the ids of results without a deployment.
+func (gd *GatewayDeploy) setGatewayResults(results apiDeploymentResults) (unknown map[string]bool, err error) {
+
+	log.Debugf("setGatewayResults: %v", results)
+
+	tx, err := gd.getDB().Begin()
+	if err != nil {
+		log.Errorf("Unable to begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT OR REPLACE INTO edgex_deployment_gateway_result
+		(deployment_id, gateway_id, deploy_status, deploy_error_code, deploy_error_message, updated)
+		SELECT id, $1, $2, $3, $4, $5 FROM edgex_deployment WHERE id = $6;
+	`)
+	if err != nil {
+		log.Errorf("prepare insert into edgex_deployment_gateway_result failed: %v", err)
+		return
+	}
+	defer stmt.Close()
+
+	unknown = make(map[string]bool)
+	var unknownResults apiDeploymentResults
+	var reported []string
+	now := gd.clock.Now().UTC().Format(sqliteTimeFormat)
+	for _, result := range results {
+		res, err := stmt.Exec(result.GatewayID, result.Status, result.ErrorCode, result.Message, now, result.ID)
+		if err != nil {
+			log.Errorf("insert gateway %s result for %s failed: %v", result.GatewayID, result.ID, err)
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); n == 0 || err != nil {
+			unknown[result.ID] = true
+			unknownResults = append(unknownResults, result)
+		} else {
+			reported = append(reported, result.ID)
+		}
+	}
+
+	var aggregated apiDeploymentResults
+	seen := make(map[string]bool)
+	for _, depID := range reported {
+		if seen[depID] {
+			continue
+		}
+		seen[depID] = true
+
+		gatewayResults, err := getGatewayResults(tx, depID)
+		if err != nil {
+			return nil, err
+		}
+		result, decided := aggregateGatewayResults(gd.resultPolicy, gd.expectedGateways, gatewayResults)
+		if decided {
+			result.ID = depID
+			aggregated = append(aggregated, result)
+		} else {
+			log.Debugf("deployment %s awaiting more gateway results: %v", depID, gatewayResults)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Unable to commit setGatewayResults transaction: %v", err)
+		return nil, err
+	}
+
+	// unknown deployments are passed along to be logged and skipped as before
+	aggregated = append(aggregated, unknownResults...)
+	if len(aggregated) == 0 {
+		return unknown, nil
+	}
+	return unknown, gd.setDeploymentResults(aggregated)
+}
+
+func getGatewayResults(tx *sql.Tx, depID string) (results []apiGatewayResult, err error) {
+
+	rows, err := tx.Query(`
+	SELECT gateway_id, deploy_status, deploy_error_code, deploy_error_message
+	FROM edgex_deployment_gateway_result
+	WHERE deployment_id = $1
+	ORDER BY gateway_id
+	`, depID)
+	if err != nil {
+		log.Errorf("query edgex_deployment_gateway_result for %s failed: %v", depID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r apiGatewayResult
+		err = rows.Scan(&r.GatewayID, &r.Status, &r.ErrorCode, &r.Message)
+		if err != nil {
+			log.Errorf("scan edgex_deployment_gateway_result for %s failed: %v", depID, err)
+			return
+		}
+		results = append(results, r)
+	}
+	err = rows.Err()
+	return
+}
+
+// aggregateGatewayResults() returns the status of a deployment and whether the policy has enough results to decide
+func aggregateGatewayResults(policy string, expected int, gatewayResults []apiGatewayResult) (apiDeploymentResult, bool) {
+
+	var failures []apiGatewayResult
+	successes := 0
+	for _, r := range gatewayResults {
+		if r.Status == RESPONSE_STATUS_FAIL {
+			failures = append(failures, r)
+		} else if r.Status == RESPONSE_STATUS_SUCCESS {
+			successes++
+		}
+	}
+
+	result := apiDeploymentResult{
+		Status:   RESPONSE_STATUS_SUCCESS,
+		Gateways: gatewayResults,
+	}
+	fail := func() (apiDeploymentResult, bool) {
+		result.Status = RESPONSE_STATUS_FAIL
+		result.ErrorCode = failures[0].ErrorCode
+		result.Message = failures[0].Message
+		if len(gatewayResults) > 1 {
+			result.Message = fmt.Sprintf("%d of %d gateways failed, %s: %s",
+				len(failures), len(gatewayResults), failures[0].GatewayID, failures[0].Message)
+		}
+		return result, true
+	}
+
+	switch policy {
+	case RESULT_POLICY_ALL_SUCCESS:
+		if len(failures) > 0 {
+			return fail()
+		}
+		return result, successes >= expected
+	case RESULT_POLICY_QUORUM:
+		quorum := expected/2 + 1
+		if successes >= quorum {
+			return result, true
+		}
+		if len(failures) > expected-quorum {
+			return fail()
+		}
+		return result, false
+	default:
+		if len(failures) > 0 {
+			return fail()
+		}
+		return result, successes > 0
+	}
+}
+
+func (gd *GatewayDeploy) deleteGatewayResults(depID string) error {
+	_, err := gd.getDB().Exec("DELETE FROM edgex_deployment_gateway_result WHERE deployment_id = $1;", depID)
+	if err != nil {
+		log.Errorf("delete gateway results of %s failed: %v", depID, err)
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("gateway results", func() {
+
+	success := func(id string) apiGatewayResult {
+		return apiGatewayResult{GatewayID: id, Status: RESPONSE_STATUS_SUCCESS}
+	}
+	failure := func(id string) apiGatewayResult {
+		return apiGatewayResult{GatewayID: id, Status: RESPONSE_STATUS_FAIL, ErrorCode: 100, Message: "boom"}
+	}
+
+	Context("aggregateGatewayResults", func() {
+
+		It("should fail on any failure with any-fail", func() {
+			result, decided := aggregateGatewayResults(RESULT_POLICY_ANY_FAIL, 3,
+				[]apiGatewayResult{success("a"), failure("b")})
+			Expect(decided).To(BeTrue())
+			Expect(result.Status).To(Equal(RESPONSE_STATUS_FAIL))
+			Expect(result.ErrorCode).To(Equal(100))
+			Expect(result.Message).To(Equal("1 of 2 gateways failed, b: boom"))
+			Expect(result.Gateways).To(HaveLen(2))
+
+			result, decided = aggregateGatewayResults(RESULT_POLICY_ANY_FAIL, 3, []apiGatewayResult{success("a")})
+			Expect(decided).To(BeTrue())
+			Expect(result.Status).To(Equal(RESPONSE_STATUS_SUCCESS))
+		})
+
+		It("should wait for all expected gateways with all-success", func() {
+			_, decided := aggregateGatewayResults(RESULT_POLICY_ALL_SUCCESS, 2, []apiGatewayResult{success("a")})
+			Expect(decided).To(BeFalse())
+
+			result, decided := aggregateGatewayResults(RESULT_POLICY_ALL_SUCCESS, 2,
+				[]apiGatewayResult{success("a"), success("b")})
+			Expect(decided).To(BeTrue())
+			Expect(result.Status).To(Equal(RESPONSE_STATUS_SUCCESS))
+
+			result, decided = aggregateGatewayResults(RESULT_POLICY_ALL_SUCCESS, 2, []apiGatewayResult{failure("a")})
+			Expect(decided).To(BeTrue())
+			Expect(result.Status).To(Equal(RESPONSE_STATUS_FAIL))
+			Expect(result.Message).To(Equal("boom"))
+		})
+
+		It("should decide on a majority with quorum", func() {
+			_, decided := aggregateGatewayResults(RESULT_POLICY_QUORUM, 3,
+				[]apiGatewayResult{success("a"), failure("b")})
+			Expect(decided).To(BeFalse())
+
+			result, decided := aggregateGatewayResults(RESULT_POLICY_QUORUM, 3,
+				[]apiGatewayResult{success("a"), failure("b"), success("c")})
+			Expect(decided).To(BeTrue())
+			Expect(result.Status).To(Equal(RESPONSE_STATUS_SUCCESS))
+
+			result, decided = aggregateGatewayResults(RESULT_POLICY_QUORUM, 3,
+				[]apiGatewayResult{failure("a"), failure("b")})
+			Expect(decided).To(BeTrue())
+			Expect(result.Status).To(Equal(RESPONSE_STATUS_FAIL))
+		})
+	})
+
+	Context("PUT /deployments", func() {
+
+		var savePolicy string
+		var saveExpected int
+
+		BeforeEach(func() {
+			savePolicy, saveExpected = gd.resultPolicy, gd.expectedGateways
+		})
+
+		AfterEach(func() {
+			gd.resultPolicy, gd.expectedGateways = savePolicy, saveExpected
+		})
+
+		putGatewayResult := func(gatewayID string, result apiDeploymentResult) {
+			payload, err := json.Marshal(apiDeploymentResults{result})
+			Expect(err).ShouldNot(HaveOccurred())
+			req, err := http.NewRequest("PUT", testServer.URL+deploymentsEndpoint, bytes.NewReader(payload))
+			Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Add("Content-Type", "application/json")
+			req.Header.Add(gatewayIDHeader, gatewayID)
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		deployStatus := func(id string) string {
+			var status sql.NullString
+			err := gd.getDB().QueryRow("SELECT deploy_status FROM edgex_deployment WHERE id=$1", id).Scan(&status)
+			Expect(err).ShouldNot(HaveOccurred())
+			return status.String
+		}
+
+		It("should store each gateway's result and aggregate them", func() {
+
+			gd.resultPolicy, gd.expectedGateways = RESULT_POLICY_ALL_SUCCESS, 2
+			deploymentID := "gateways_aggregate"
+			insertTestDeployment(testServer, deploymentID)
+
+			putGatewayResult("gw-1", apiDeploymentResult{ID: deploymentID, Status: RESPONSE_STATUS_SUCCESS})
+			Expect(deployStatus(deploymentID)).To(BeEmpty())
+
+			putGatewayResult("gw-2", apiDeploymentResult{
+				ID: deploymentID, Status: RESPONSE_STATUS_FAIL, ErrorCode: 200, Message: "bad bundle"})
+			Expect(deployStatus(deploymentID)).To(Equal(RESPONSE_STATUS_FAIL))
+
+			var count int
+			err := gd.getDB().QueryRow("SELECT COUNT(*) FROM edgex_deployment_gateway_result WHERE deployment_id=$1",
+				deploymentID).Scan(&count)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(2))
+
+			// a gateway's new result replaces its previous one
+			putGatewayResult("gw-2", apiDeploymentResult{ID: deploymentID, Status: RESPONSE_STATUS_SUCCESS})
+			Expect(deployStatus(deploymentID)).To(Equal(RESPONSE_STATUS_SUCCESS))
+		})
+	})
+})
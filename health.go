@@ -0,0 +1,203 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_STATUS_HEALTHY   = "HEALTHY"
+	HEALTH_STATUS_UNHEALTHY = "UNHEALTHY"
+)
+
+const (
+	healthEndpoint = "/deployments/health"
+	readyEndpoint  = "/deployments/ready"
+)
+
+type pluginHealth struct {
+	sync.RWMutex
+	gd                    *GatewayDeploy
+	snapshotVersion       string
+	snapshotError         error
+	failedSnapshot        string
+	snapshotFailedAt      time.Time
+	activeDownloads       int
+	lastDownloadCompleted time.Time
+	pendingTrackerResults int
+	lastTrackerSuccess    time.Time
+	trackerFailingSince   time.Time
+}
+
+type apiHealth struct {
+	Status                string   `json:"status"`
+	Problems              []string `json:"problems,omitempty"`
+	DBAttached            bool     `json:"dbAttached"`
+	SnapshotVersion       string   `json:"snapshotVersion"`
+	FailedSnapshot        string   `json:"failedSnapshot,omitempty"`
+	SnapshotError         string   `json:"snapshotError,omitempty"`
+	SnapshotFailedAt      string   `json:"snapshotFailedAt,omitempty"`
+	DownloadQueueDepth    int      `json:"downloadQueueDepth"`
+	ActiveDownloads       int      `json:"activeDownloads"`
+	ConcurrentDownloads   int      `json:"concurrentDownloads"`
+	LastDownloadCompleted string   `json:"lastDownloadCompleted,omitempty"`
+	PendingTrackerResults int      `json:"pendingTrackerResults"`
+	LastTrackerSuccess    string   `json:"lastTrackerSuccess,omitempty"`
+}
+
+func (h *pluginHealth) snapshotSucceeded(version string) {
+	h.Lock()
+	defer h.Unlock()
+	h.snapshotVersion = version
+	h.snapshotError = nil
+	h.failedSnapshot = ""
+	h.snapshotFailedAt = time.Time{}
+}
+
+func (h *pluginHealth) snapshotFailed(version string, err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.snapshotError = err
+	h.failedSnapshot = version
+	if h.snapshotFailedAt.IsZero() {
+		h.snapshotFailedAt = h.gd.clock.Now()
+	}
+}
+
+func (h *pluginHealth) downloadStarted() {
+	h.Lock()
+	defer h.Unlock()
+	h.activeDownloads++
+}
+
+func (h *pluginHealth) downloadFinished() {
+	h.Lock()
+	defer h.Unlock()
+	h.activeDownloads--
+	h.lastDownloadCompleted = h.gd.clock.Now()
+}
+
+func (h *pluginHealth) busyWorkers() int {
+	h.RLock()
+	defer h.RUnlock()
+	return h.activeDownloads
+}
+
+func (h *pluginHealth) trackerQueued(n int) {
+	h.Lock()
+	defer h.Unlock()
+	h.pendingTrackerResults += n
+}
+
+func (h *pluginHealth) trackerFailed() {
+	h.Lock()
+	defer h.Unlock()
+	if h.trackerFailingSince.IsZero() {
+		h.trackerFailingSince = h.gd.clock.Now()
+	}
+}
+
+// n is the number of results that are no longer pending, whether sent or abandoned
+func (h *pluginHealth) trackerDone(n int, sent bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.pendingTrackerResults -= n
+	if sent {
+		h.lastTrackerSuccess = h.gd.clock.Now()
+		h.trackerFailingSince = time.Time{}
+	}
+}
+
+func (h *pluginHealth) report() apiHealth {
+	h.RLock()
+	defer h.RUnlock()
+	report := apiHealth{
+		Status:                HEALTH_STATUS_HEALTHY,
+		DBAttached:            h.gd.getDB() != nil,
+		SnapshotVersion:       h.snapshotVersion,
+		DownloadQueueDepth:    len(h.gd.downloadQueue),
+		ActiveDownloads:       h.activeDownloads,
+		ConcurrentDownloads:   h.gd.concurrentDownloads,
+		LastDownloadCompleted: formatHealthTime(h.lastDownloadCompleted),
+		PendingTrackerResults: h.pendingTrackerResults,
+		LastTrackerSuccess:    formatHealthTime(h.lastTrackerSuccess),
+	}
+
+	if h.snapshotError != nil {
+		report.FailedSnapshot = h.failedSnapshot
+		report.SnapshotError = h.snapshotError.Error()
+		report.SnapshotFailedAt = formatHealthTime(h.snapshotFailedAt)
+		report.Problems = append(report.Problems, "unable to apply latest snapshot")
+	}
+
+	if !h.trackerFailingSince.IsZero() && h.gd.clock.Now().Sub(h.trackerFailingSince) > h.gd.unhealthyAfter {
+		report.Problems = append(report.Problems, "tracker unreachable since "+formatHealthTime(h.trackerFailingSince))
+	}
+
+	// all workers busy with work waiting and nothing finishing
+	if h.activeDownloads >= h.gd.concurrentDownloads && report.DownloadQueueDepth > 0 &&
+		h.gd.clock.Now().Sub(h.lastDownloadCompleted) > h.gd.unhealthyAfter {
+		report.Problems = append(report.Problems, "bundle downloads are not progressing")
+	}
+
+	if len(report.Problems) > 0 {
+		report.Status = HEALTH_STATUS_UNHEALTHY
+	}
+	return report
+}
+
+func formatHealthTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(iso8601)
+}
+
+// health and readiness are available before a DB has been set, unlike InitAPI()
+func (gd *GatewayDeploy) initHealthAPI() {
+	gd.services.API().HandleFunc(healthEndpoint, gd.apiGetHealth).Methods("GET")
+	gd.services.API().HandleFunc(readyEndpoint, gd.apiGetReady).Methods("GET")
+}
+
+func (gd *GatewayDeploy) apiGetHealth(w http.ResponseWriter, r *http.Request) {
+	report := gd.health.report()
+	sendHealth(w, report, report.Status == HEALTH_STATUS_HEALTHY)
+}
+
+// ready once a DB is attached and able to serve deployments
+func (gd *GatewayDeploy) apiGetReady(w http.ResponseWriter, r *http.Request) {
+	report := gd.health.report()
+	sendHealth(w, report, report.DBAttached)
+}
+
+func sendHealth(w http.ResponseWriter, report apiHealth, ok bool) {
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		log.Errorf("unable to marshal health: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("health", func() {
+
+	It("should be ready when a DB is attached", func() {
+
+		res, err := http.Get(testServer.URL + readyEndpoint)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		var report apiHealth
+		err = json.NewDecoder(res.Body).Decode(&report)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(report.DBAttached).To(BeTrue())
+		Expect(report.ConcurrentDownloads).To(Equal(gd.concurrentDownloads))
+	})
+
+	It("should report pending tracker results until they are sent", func() {
+
+		defer func(d time.Duration) {
+			gd.unhealthyAfter = d
+		}(gd.unhealthyAfter)
+		gd.unhealthyAfter = time.Millisecond
+
+		release := make(chan bool)
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+				w.Write([]byte("OK"))
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		sent := make(chan error)
+		go func() {
+			sent <- gd.transmitDeploymentResultsToServer(apiDeploymentResults{
+				{
+					ID:     "health_pending",
+					Status: RESPONSE_STATUS_SUCCESS,
+				},
+			})
+		}()
+
+		Eventually(func() string {
+			return gd.health.report().Status
+		}).Should(Equal(HEALTH_STATUS_UNHEALTHY))
+		report := gd.health.report()
+		Expect(report.PendingTrackerResults).To(BeNumerically(">=", 1))
+		Expect(report.Problems).ToNot(BeEmpty())
+
+		res, err := http.Get(testServer.URL + healthEndpoint)
+		Expect(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		close(release)
+		Eventually(sent).Should(Receive(BeNil()))
+
+		Eventually(func() string {
+			return gd.health.report().Status
+		}).Should(Equal(HEALTH_STATUS_HEALTHY))
+		Expect(gd.health.report().LastTrackerSuccess).ToNot(BeEmpty())
+	})
+})
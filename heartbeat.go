@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// sent to tracker
+type apiHeartbeat struct {
+	ClusterID       string                   `json:"clusterId"`
+	InstanceID      string                   `json:"instanceId"`
+	Timestamp       string                   `json:"timestamp"`
+	UptimeSeconds   int64                    `json:"uptimeSeconds"`
+	PluginName      string                   `json:"pluginName"`
+	PluginVersion   string                   `json:"pluginVersion"`
+	Status          string                   `json:"status"`
+	SnapshotVersion string                   `json:"snapshotVersion"`
+	Deployments     []apiHeartbeatDeployment `json:"deployments"`
+	BundleDiskUsage int64                    `json:"bundleDiskUsage"` // bytes
+	Downloads       apiHeartbeatDownloads    `json:"downloads"`
+}
+
+type apiHeartbeatDeployment struct {
+	ID           string `json:"id"`
+	ChecksumType string `json:"checksumType,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+}
+
+type apiHeartbeatDownloads struct {
+	QueueDepth    int    `json:"queueDepth"`
+	Active        int    `json:"active"`
+	Concurrent    int    `json:"concurrent"`
+	LastCompleted string `json:"lastCompleted,omitempty"`
+}
+
+// sendHeartbeats() reports this instance to the tracker every heartbeatInterval until stop is closed
+func (gd *GatewayDeploy) sendHeartbeats(stop <-chan struct{}) {
+	if gd.heartbeatInterval == 0 {
+		return
+	}
+	ticker := gd.clock.NewTicker(gd.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if err := gd.sendHeartbeat(gd.buildHeartbeat()); err != nil {
+				log.Warnf("unable to send heartbeat to tracker: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (gd *GatewayDeploy) buildHeartbeat() apiHeartbeat {
+	report := gd.health.report()
+	hb := apiHeartbeat{
+		ClusterID:       gd.apidClusterID,
+		InstanceID:      gd.apidInstanceID,
+		Timestamp:       gd.clock.Now().Format(iso8601),
+		UptimeSeconds:   int64(gd.clock.Now().Sub(gd.startedAt).Seconds()),
+		PluginName:      pluginData.Name,
+		PluginVersion:   pluginData.Version,
+		Status:          report.Status,
+		SnapshotVersion: report.SnapshotVersion,
+		Deployments:     []apiHeartbeatDeployment{},
+		BundleDiskUsage: diskUsage(gd.bundlePath),
+		Downloads: apiHeartbeatDownloads{
+			QueueDepth:    report.DownloadQueueDepth,
+			Active:        report.ActiveDownloads,
+			Concurrent:    report.ConcurrentDownloads,
+			LastCompleted: report.LastDownloadCompleted,
+		},
+	}
+
+	if report.DBAttached {
+		deployments, err := gd.getReadyDeployments()
+		if err != nil {
+			log.Errorf("unable to list ready deployments for heartbeat: %v", err)
+		}
+		for _, d := range deployments {
+			hb.Deployments = append(hb.Deployments, apiHeartbeatDeployment{
+				ID:           d.ID,
+				ChecksumType: d.BundleChecksumType,
+				Checksum:     d.BundleChecksum,
+			})
+		}
+	}
+	return hb
+}
+
+func (gd *GatewayDeploy) sendHeartbeat(hb apiHeartbeat) error {
+
+	apiPath := fmt.Sprintf("%s/clusters/%s/apids/%s", gd.apiServerBaseURI.String(), gd.apidClusterID, gd.apidInstanceID)
+	b, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+
+	breaker := gd.breakers.get(BREAKER_TRACKER, apiPath)
+	if !breaker.allow() {
+		return fmt.Errorf("circuit breaker %s is open", breaker.name)
+	}
+	resp, err := gd.putHeartbeat(apiPath, b)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		if err := gd.trackerCredentials.Refresh(); err != nil {
+			err = fmt.Errorf("unable to refresh tracker credentials: %v", err)
+			breaker.failure(err.Error())
+			return err
+		}
+		resp, err = gd.putHeartbeat(apiPath, b)
+	}
+	if err != nil {
+		breaker.failure(err.Error())
+		return err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		breaker.failure("status " + strconv.Itoa(resp.StatusCode))
+	} else {
+		breaker.success()
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("heartbeat to %s failed with status %d", apiPath, resp.StatusCode)
+	}
+	return nil
+}
+
+func (gd *GatewayDeploy) putHeartbeat(apiPath string, b []byte) (*http.Response, error) {
+	req, err := http.NewRequest("PUT", apiPath, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if err := gd.addHeaders(req); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("sending heartbeat to tracker by URL=%s data=%s", apiPath, b)
+	return gd.client.Do(req.WithContext(gd.lifecycle.ctx))
+}
+
+// diskUsage() returns the total size of the files under dir
+func diskUsage(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
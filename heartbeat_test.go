@@ -0,0 +1,103 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// rejected and unable to refresh
+type expiredCredentials struct{}
+
+func (expiredCredentials) Token() (string, error) {
+	return "expired", nil
+}
+
+func (expiredCredentials) Refresh() error {
+	return errors.New("token endpoint unavailable")
+}
+
+var _ = Describe("heartbeat", func() {
+
+	It("should report ready deployments and bundle disk usage", func() {
+		insertTestDeployment(testServer, "heartbeat_ready")
+		_, err := gd.getDB().Exec("UPDATE edgex_deployment SET bundle_checksum_type=$1, bundle_checksum=$2 WHERE id=$3",
+			"crc32", "abc", "heartbeat_ready")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(ioutil.WriteFile(path.Join(gd.bundlePath, "heartbeat_bundle"), make([]byte, 100), 0600)).To(Succeed())
+
+		hb := gd.buildHeartbeat()
+		Expect(hb.ClusterID).To(Equal(gd.apidClusterID))
+		Expect(hb.InstanceID).To(Equal(gd.apidInstanceID))
+		Expect(hb.PluginVersion).To(Equal(pluginData.Version))
+		Expect(hb.Deployments).To(ContainElement(apiHeartbeatDeployment{
+			ID: "heartbeat_ready", ChecksumType: "crc32", Checksum: "abc",
+		}))
+		Expect(hb.BundleDiskUsage).To(BeNumerically(">=", 100))
+	})
+
+	It("should PUT the heartbeat to the tracker", func() {
+		var received apiHeartbeat
+		var receivedPath string
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedPath = r.URL.Path
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &received)
+			if r.Method != "PUT" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(gd.sendHeartbeat(apiHeartbeat{InstanceID: gd.apidInstanceID, UptimeSeconds: 5})).To(Succeed())
+		Expect(receivedPath).To(Equal("/clusters/" + gd.apidClusterID + "/apids/" + gd.apidInstanceID))
+		Expect(received.UptimeSeconds).To(Equal(int64(5)))
+
+		tracker.Close()
+		Expect(gd.sendHeartbeat(apiHeartbeat{})).Should(HaveOccurred())
+	})
+
+	It("should count a failed credential refresh against the tracker breaker", func() {
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		gd.SetCredentialProvider(expiredCredentials{})
+
+		Expect(gd.sendHeartbeat(apiHeartbeat{})).Should(HaveOccurred())
+		report := gd.breakers.report()
+		Expect(report).To(HaveLen(1))
+		Expect(report[0].Failures).To(Equal(1))
+		Expect(report[0].LastFailure).To(ContainSubstring("token endpoint unavailable"))
+	})
+})
@@ -35,51 +35,103 @@ const (
 	configApidClusterID         = "apigeesync_cluster_id"
 	configConcurrentDownloads   = "apigeesync_concurrent_downloads"
 	configDownloadQueueSize     = "apigeesync_download_queue_size"
+	configUnhealthyAfter        = "gatewaydeploy_unhealthy_after"
+	configAPIToken              = "gatewaydeploy_api_token"
+	configAPIClientsFile        = "gatewaydeploy_api_clients_file"
+	configAPIClientCAFile       = "gatewaydeploy_api_client_ca_file"
+	configResultPolicy          = "gatewaydeploy_result_policy"
+	configExpectedGateways      = "gatewaydeploy_expected_gateways"
+	configDeltaHistory          = "gatewaydeploy_delta_history"
+	configBundleHistory         = "gatewaydeploy_bundle_history"
+	configRollbackPolicy        = "gatewaydeploy_rollback_policy"
+	configWebhookMaxAttempts    = "gatewaydeploy_webhook_max_attempts"
+	configWebhookMaxFailures    = "gatewaydeploy_webhook_max_failed_deliveries"
+	configTemplating            = "gatewaydeploy_config_templating"
+	configTemplateClusterVars   = "gatewaydeploy_template_cluster_vars"
+	configTemplateScopeVars     = "gatewaydeploy_template_scope_vars"
+	configTemplateInstanceVars  = "gatewaydeploy_template_instance_vars"
+	configTemplateSecretsFile   = "gatewaydeploy_template_secrets_file"
+	configSchemaDir             = "gatewaydeploy_config_schema_dir"
+	configPeers                 = "gatewaydeploy_peers"
+	configPeerDir               = "gatewaydeploy_peer_dir"
+	configPeerURL               = "gatewaydeploy_peer_url"
+	configPeerToken             = "gatewaydeploy_peer_token"
+	configLeaderElection        = "gatewaydeploy_leader_election"
+	configLeaderLease           = "gatewaydeploy_leader_lease"
+	configBundleDirShared       = "gatewaydeploy_bundle_dir_shared"
+	configHeartbeatInterval     = "gatewaydeploy_heartbeat_interval"
+	configTrackerCredentials    = "gatewaydeploy_tracker_credentials"
+	configTrackerToken          = "gatewaydeploy_tracker_token"
+	configTrackerTokenFile      = "gatewaydeploy_tracker_token_file"
+	configTrackerTokenURL       = "gatewaydeploy_tracker_oauth2_token_url"
+	configTrackerClientID       = "gatewaydeploy_tracker_oauth2_client_id"
+	configTrackerClientSecret   = "gatewaydeploy_tracker_oauth2_client_secret"
+	configTrackerScopes         = "gatewaydeploy_tracker_oauth2_scopes"
+	configBreakerFailures       = "gatewaydeploy_breaker_failures"
+	configBreakerOpenDuration   = "gatewaydeploy_breaker_open_duration"
+	configTrackerMaxAttempts    = "gatewaydeploy_tracker_max_attempts"
+	configDownloadMaxAttempts   = "gatewaydeploy_download_max_attempts"
 )
 
-var (
-	services            apid.Services
-	log                 apid.LogService
-	data                apid.DataService
-	bundlePath          string
-	debounceDuration    time.Duration
-	bundleCleanupDelay  time.Duration
-	apiServerBaseURI    *url.URL
-	apidInstanceID      string
-	apidClusterID       string
-	downloadQueueSize   int
-	concurrentDownloads int
-)
+var log apid.LogService
 
 func init() {
 	apid.RegisterPlugin(initPlugin)
 }
 
-func initPlugin(s apid.Services) (apid.PluginData, error) {
-	services = s
-	log = services.Log().ForModule("apiGatewayDeploy")
+// initPlugin creates the instance of the plugin registered with apid
+func initPlugin(services apid.Services) (apid.PluginData, error) {
+	gd, err := NewGatewayDeploy(services, Options{})
+	if err != nil {
+		return pluginData, err
+	}
+	plugin = gd
+	gd.launch()
+
+	log.Debug("end init")
+
+	return pluginData, nil
+}
+
+// launch() registers the APIs available before a DB is set, starts the background work and listens for
+// ApigeeSync events
+func (gd *GatewayDeploy) launch() {
+	gd.initHealthAPI()
+	gd.initMetricsAPI()
+	gd.initBreakersAPI()
+
+	gd.start()
+
+	gd.initListener()
+}
+
+// NewGatewayDeploy creates an instance of the plugin configured by services. Its APIs and event listener are
+// registered by initPlugin, which creates the instance apid uses; other instances are isolated from it.
+func NewGatewayDeploy(services apid.Services, opts Options) (*GatewayDeploy, error) {
+	initLog(services)
 	log.Debug("start init")
 
+	gd := newGatewayDeploy(services, opts)
 	config := services.Config()
 
 	if !config.IsSet(configApiServerBaseURI) {
-		return pluginData, fmt.Errorf("Missing required config value: %s", configApiServerBaseURI)
+		return nil, fmt.Errorf("Missing required config value: %s", configApiServerBaseURI)
 	}
 	var err error
-	apiServerBaseURI, err = url.Parse(config.GetString(configApiServerBaseURI))
+	gd.apiServerBaseURI, err = url.Parse(config.GetString(configApiServerBaseURI))
 	if err != nil {
-		return pluginData, fmt.Errorf("%s value %s parse err: %v", configApiServerBaseURI, apiServerBaseURI, err)
+		return nil, fmt.Errorf("%s value %s parse err: %v", configApiServerBaseURI, gd.apiServerBaseURI, err)
 	}
 
 	if !config.IsSet(configApidInstanceID) {
-		return pluginData, fmt.Errorf("Missing required config value: %s", configApidInstanceID)
+		return nil, fmt.Errorf("Missing required config value: %s", configApidInstanceID)
 	}
-	apidInstanceID = config.GetString(configApidInstanceID)
+	gd.apidInstanceID = config.GetString(configApidInstanceID)
 
 	if !config.IsSet(configApidClusterID) {
-		return pluginData, fmt.Errorf("Missing required config value: %s", configApidClusterID)
+		return nil, fmt.Errorf("Missing required config value: %s", configApidClusterID)
 	}
-	apidClusterID = config.GetString(configApidClusterID)
+	gd.apidClusterID = config.GetString(configApidClusterID)
 
 	config.SetDefault(configBundleDirKey, "bundles")
 	config.SetDefault(configDebounceDuration, time.Second)
@@ -88,46 +140,188 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 	config.SetDefault(configDownloadConnTimeout, 5*time.Minute)
 	config.SetDefault(configConcurrentDownloads, 15)
 	config.SetDefault(configDownloadQueueSize, 2000)
+	config.SetDefault(configUnhealthyAfter, time.Hour)
+	config.SetDefault(configResultPolicy, RESULT_POLICY_ANY_FAIL)
+	config.SetDefault(configExpectedGateways, 1)
+	config.SetDefault(configDeltaHistory, 20)
+	config.SetDefault(configBundleHistory, 0)
+	config.SetDefault(configRollbackPolicy, ROLLBACK_POLICY_NONE)
+	config.SetDefault(configWebhookMaxAttempts, 5)
+	config.SetDefault(configWebhookMaxFailures, 3)
+	config.SetDefault(configTemplating, false)
+	config.SetDefault(configLeaderElection, LEADER_ELECTION_NONE)
+	config.SetDefault(configLeaderLease, 30*time.Second)
+	config.SetDefault(configBundleDirShared, false)
+	config.SetDefault(configHeartbeatInterval, time.Minute)
+	config.SetDefault(configTrackerCredentials, CREDENTIALS_STATIC)
+	config.SetDefault(configBreakerFailures, 5)
+	config.SetDefault(configBreakerOpenDuration, 30*time.Second)
+	config.SetDefault(configTrackerMaxAttempts, 0)
+	config.SetDefault(configDownloadMaxAttempts, 0)
 
-	debounceDuration = config.GetDuration(configDebounceDuration)
-	if debounceDuration < time.Millisecond {
-		return pluginData, fmt.Errorf("%s must be a positive duration", configDebounceDuration)
+	gd.debounceDuration = config.GetDuration(configDebounceDuration)
+	if gd.debounceDuration < time.Millisecond {
+		return nil, fmt.Errorf("%s must be a positive duration", configDebounceDuration)
 	}
 
-	bundleCleanupDelay = config.GetDuration(configBundleCleanupDelay)
-	if bundleCleanupDelay < time.Millisecond {
-		return pluginData, fmt.Errorf("%s must be a positive duration", configBundleCleanupDelay)
+	gd.bundleCleanupDelay = config.GetDuration(configBundleCleanupDelay)
+	if gd.bundleCleanupDelay < time.Millisecond {
+		return nil, fmt.Errorf("%s must be a positive duration", configBundleCleanupDelay)
 	}
 
-	markDeploymentFailedAfter = config.GetDuration(configMarkDeployFailedAfter)
-	if markDeploymentFailedAfter < time.Millisecond {
-		return pluginData, fmt.Errorf("%s must be a positive duration", configMarkDeployFailedAfter)
+	gd.markDeploymentFailedAfter = config.GetDuration(configMarkDeployFailedAfter)
+	if gd.markDeploymentFailedAfter < time.Millisecond {
+		return nil, fmt.Errorf("%s must be a positive duration", configMarkDeployFailedAfter)
 	}
 
-	bundleDownloadConnTimeout = config.GetDuration(configDownloadConnTimeout)
-	if bundleDownloadConnTimeout < time.Millisecond {
-		return pluginData, fmt.Errorf("%s must be a positive duration", configDownloadConnTimeout)
+	gd.bundleDownloadConnTimeout = config.GetDuration(configDownloadConnTimeout)
+	if gd.bundleDownloadConnTimeout < time.Millisecond {
+		return nil, fmt.Errorf("%s must be a positive duration", configDownloadConnTimeout)
 	}
 
-	data = services.Data()
+	gd.unhealthyAfter = config.GetDuration(configUnhealthyAfter)
+	if gd.unhealthyAfter < time.Millisecond {
+		return nil, fmt.Errorf("%s must be a positive duration", configUnhealthyAfter)
+	}
 
-	concurrentDownloads = config.GetInt(configConcurrentDownloads)
-	downloadQueueSize = config.GetInt(configDownloadQueueSize)
-	relativeBundlePath := config.GetString(configBundleDirKey)
-	storagePath := config.GetString("local_storage_path")
-	bundlePath = path.Join(storagePath, relativeBundlePath)
-	if err := os.MkdirAll(bundlePath, 0700); err != nil {
-		return pluginData, fmt.Errorf("Failed bundle directory creation: %v", err)
+	gd.resultPolicy = config.GetString(configResultPolicy)
+	if !validResultPolicy(gd.resultPolicy) {
+		return nil, fmt.Errorf("%s must be one of %s, %s or %s", configResultPolicy,
+			RESULT_POLICY_ANY_FAIL, RESULT_POLICY_ALL_SUCCESS, RESULT_POLICY_QUORUM)
 	}
-	log.Infof("Bundle directory path is %s", bundlePath)
 
-	initializeBundleDownloading()
+	gd.expectedGateways = config.GetInt(configExpectedGateways)
+	if gd.expectedGateways < 1 {
+		return nil, fmt.Errorf("%s must be at least 1", configExpectedGateways)
+	}
 
-	go distributeEvents()
+	gd.deltaHistory = config.GetInt(configDeltaHistory)
+	if gd.deltaHistory < 0 {
+		return nil, fmt.Errorf("%s must not be negative", configDeltaHistory)
+	}
 
-	initListener(services)
+	gd.bundleHistory = config.GetInt(configBundleHistory)
+	if gd.bundleHistory < 0 {
+		return nil, fmt.Errorf("%s must not be negative", configBundleHistory)
+	}
 
-	log.Debug("end init")
+	gd.rollbackPolicy = config.GetString(configRollbackPolicy)
+	if !validRollbackPolicy(gd.rollbackPolicy) {
+		return nil, fmt.Errorf("%s must be %s or %s", configRollbackPolicy,
+			ROLLBACK_POLICY_NONE, ROLLBACK_POLICY_AUTO)
+	}
+	if gd.rollbackPolicy == ROLLBACK_POLICY_AUTO && gd.bundleHistory < 2 {
+		return nil, fmt.Errorf("%s %s requires %s of at least 2", configRollbackPolicy,
+			ROLLBACK_POLICY_AUTO, configBundleHistory)
+	}
 
-	return pluginData, nil
+	gd.heartbeatInterval = config.GetDuration(configHeartbeatInterval)
+	if gd.heartbeatInterval < 0 {
+		return nil, fmt.Errorf("%s must not be negative", configHeartbeatInterval)
+	}
+
+	breakerFailureThreshold := config.GetInt(configBreakerFailures)
+	if breakerFailureThreshold < 1 {
+		return nil, fmt.Errorf("%s must be at least 1", configBreakerFailures)
+	}
+
+	breakerOpenDuration := config.GetDuration(configBreakerOpenDuration)
+	if breakerOpenDuration < time.Millisecond {
+		return nil, fmt.Errorf("%s must be a positive duration", configBreakerOpenDuration)
+	}
+	gd.breakers = newBreakerRegistry(gd.clock, breakerFailureThreshold, breakerOpenDuration)
+
+	gd.trackerMaxAttempts = config.GetInt(configTrackerMaxAttempts)
+	if gd.trackerMaxAttempts < 0 {
+		return nil, fmt.Errorf("%s must not be negative", configTrackerMaxAttempts)
+	}
+
+	gd.downloadMaxAttempts = config.GetInt(configDownloadMaxAttempts)
+	if gd.downloadMaxAttempts < 0 {
+		return nil, fmt.Errorf("%s must not be negative", configDownloadMaxAttempts)
+	}
+
+	gd.trackerCredentials, err = initCredentials(config, gd.clock, gd.client, config.GetString(configTrackerCredentials),
+		config.GetString(configTrackerToken), config.GetString(configTrackerTokenFile),
+		config.GetString(configTrackerTokenURL), config.GetString(configTrackerClientID),
+		config.GetString(configTrackerClientSecret), config.GetStringSlice(configTrackerScopes))
+	if err != nil {
+		return nil, err
+	}
+
+	gd.webhookMaxAttempts = config.GetInt(configWebhookMaxAttempts)
+	if gd.webhookMaxAttempts < 1 {
+		return nil, fmt.Errorf("%s must be at least 1", configWebhookMaxAttempts)
+	}
+
+	gd.webhookMaxFailedDeliveries = config.GetInt(configWebhookMaxFailures)
+	if gd.webhookMaxFailedDeliveries < 1 {
+		return nil, fmt.Errorf("%s must be at least 1", configWebhookMaxFailures)
+	}
+
+	gd.templatingEnabled = config.GetBool(configTemplating)
+	if gd.templatingEnabled {
+		gd.templateVars, err = initTemplateVars(config.Get(configTemplateClusterVars), config.Get(configTemplateScopeVars),
+			config.Get(configTemplateInstanceVars), config.GetString(configTemplateSecretsFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dir := config.GetString(configSchemaDir); dir != "" {
+		gd.configSchemas, err = loadConfigSchemas(dir)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Loaded %d deployment configuration schemas from %s", len(gd.configSchemas), dir)
+	}
+
+	gd.bundlePeers = peerDiscovery{
+		static: config.GetStringSlice(configPeers),
+		dir:    config.GetString(configPeerDir),
+		self:   gd.apidInstanceID,
+	}
+	if err := gd.bundlePeers.advertise(config.GetString(configPeerURL)); err != nil {
+		return nil, err
+	}
+
+	gd.apiAuth, err = initAPIAuth(config.GetString(configAPIToken), config.GetString(configAPIClientsFile),
+		config.GetString(configAPIClientCAFile))
+	if err != nil {
+		return nil, err
+	}
+	if gd.apiAuth.enabled() {
+		log.Info("Authentication required for deployments API")
+	}
+	if err := gd.initPeerAuth(config.GetString(configPeerToken)); err != nil {
+		return nil, err
+	}
+
+	gd.concurrentDownloads = config.GetInt(configConcurrentDownloads)
+	gd.downloadQueueSize = config.GetInt(configDownloadQueueSize)
+	relativeBundlePath := config.GetString(configBundleDirKey)
+	storagePath := config.GetString("local_storage_path")
+	gd.bundlePath = path.Join(storagePath, relativeBundlePath)
+	if err := os.MkdirAll(gd.bundlePath, 0700); err != nil {
+		return nil, fmt.Errorf("Failed bundle directory creation: %v", err)
+	}
+	log.Infof("Bundle directory path is %s", gd.bundlePath)
+
+	gd.leaderLeaseDuration = config.GetDuration(configLeaderLease)
+	if gd.leaderLeaseDuration < time.Second {
+		return nil, fmt.Errorf("%s must be at least a second", configLeaderLease)
+	}
+	gd.election, err = newLeaderElection(gd, config.GetString(configLeaderElection), gd.bundlePath,
+		config.GetBool(configBundleDirShared))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be %s, %s or %s", configLeaderElection,
+			LEADER_ELECTION_NONE, LEADER_ELECTION_DB, LEADER_ELECTION_FILE)
+	}
+
+	gd.downloadQueue = make(chan *DownloadRequest, gd.downloadQueueSize)
+	if gd.fetcher == nil {
+		gd.fetcher = uriFetcher{transport: gd.client.Transport, timeout: gd.bundleDownloadConnTimeout}
+	}
+
+	return gd, nil
 }
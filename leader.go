@@ -0,0 +1,403 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/30x/apid-core"
+)
+
+const (
+	LEADER_ELECTION_NONE = "none" // every instance talks to the tracker and sweeps bundles
+	LEADER_ELECTION_DB   = "db"   // a lease in the shared DB
+	LEADER_ELECTION_FILE = "file" // a lock file in the bundle directory
+)
+
+const (
+	leaderFile     = ".leader"
+	leaderLockFile = ".leader.lock"
+)
+
+// a leaderLease is held by one instance of the cluster at a time
+type leaderLease interface {
+	// acquire() takes or renews the lease until expires, unless another holder's lease is still valid at now
+	acquire(holder string, now, expires time.Time) (bool, error)
+	release(holder string) error
+}
+
+// leaderElection decides whether this instance talks to the tracker and sweeps old bundles. Without a lease,
+// every instance leads.
+type leaderElection struct {
+	gd            *GatewayDeploy
+	lease         leaderLease
+	sharedDB      bool  // the leader finds the results of every instance in its DB
+	sharedBundles bool  // the leader sweeps the bundles of every instance
+	deadline      int64 // atomic, unix nanoseconds until which this instance leads
+	syncing       int32 // atomic, whether statuses are being sent to the tracker
+	stop          chan struct{}
+	done          chan struct{}
+	resigned      sync.Once
+	mux           sync.Mutex
+	sent          map[string]trackerStatus // statuses the tracker has, by deployment id
+}
+
+type trackerStatus struct {
+	status    string
+	errorCode int
+	message   string
+}
+
+// newLeaderElection() elects a leader with a lease in the DB or a lock file in dir. With a DB lease, the DB is
+// shared but dir only if sharedDir; with a lock file, dir is shared but the DB isn't.
+func newLeaderElection(gd *GatewayDeploy, mode, dir string, sharedDir bool) (*leaderElection, error) {
+	e := &leaderElection{
+		gd:   gd,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		sent: make(map[string]trackerStatus),
+	}
+	switch mode {
+	case LEADER_ELECTION_NONE:
+	case LEADER_ELECTION_DB:
+		e.lease = dbLease{gd}
+		e.sharedDB = true
+		e.sharedBundles = sharedDir
+	case LEADER_ELECTION_FILE:
+		e.lease = fileLease{dir: dir, leaseDuration: gd.leaderLeaseDuration, clock: gd.clock}
+		e.sharedBundles = true
+	default:
+		return nil, fmt.Errorf("unknown leader election %s", mode)
+	}
+	return e, nil
+}
+
+func (e *leaderElection) isLeader() bool {
+	return e.lease == nil || e.gd.clock.Now().UnixNano() < atomic.LoadInt64(&e.deadline)
+}
+
+// leavesResultsToLeader() returns true if this instance doesn't send its results to the tracker because the leader
+// finds them in the shared DB
+func (e *leaderElection) leavesResultsToLeader() bool {
+	return e.sharedDB && !e.isLeader()
+}
+
+// sweepsBundles() returns true if this instance deletes old bundles: the leader of a shared bundle directory, or
+// any instance with its own
+func (e *leaderElection) sweepsBundles() bool {
+	return !e.sharedBundles || e.isLeader()
+}
+
+// run() keeps trying to acquire or renew the lease until resign()
+func (e *leaderElection) run() {
+	defer close(e.done)
+	if e.lease == nil {
+		return
+	}
+
+	ticker := e.gd.clock.NewTicker(e.gd.leaderLeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		e.renew()
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+func (e *leaderElection) renew() {
+	now := e.gd.clock.Now()
+	expires := now.Add(e.gd.leaderLeaseDuration)
+	held, err := e.lease.acquire(e.gd.apidInstanceID, now, expires)
+	if err != nil {
+		// leadership, if any, ends when the current lease expires
+		log.Warnf("unable to renew leader lease: %v", err)
+		return
+	}
+
+	wasLeader := e.isLeader()
+	if !held {
+		if wasLeader {
+			log.Infof("instance %s is no longer the cluster leader", e.gd.apidInstanceID)
+		}
+		atomic.StoreInt64(&e.deadline, 0)
+		return
+	}
+
+	// stop leading a little before the lease expires so that two instances never lead at once
+	atomic.StoreInt64(&e.deadline, expires.Add(-e.gd.leaderLeaseDuration/10).UnixNano())
+	if !wasLeader {
+		log.Infof("instance %s is now the cluster leader", e.gd.apidInstanceID)
+		e.mux.Lock()
+		e.sent = make(map[string]trackerStatus)
+		e.mux.Unlock()
+	}
+	if e.sharedDB && atomic.CompareAndSwapInt32(&e.syncing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&e.syncing, 0)
+			e.syncTrackerStatuses()
+		}()
+	}
+}
+
+// resign() stops leading and releases the lease so that another instance can take over
+func (e *leaderElection) resign() {
+	e.resigned.Do(func() {
+		if e.lease == nil {
+			return
+		}
+		close(e.stop)
+		<-e.done
+		atomic.StoreInt64(&e.deadline, 0)
+		if err := e.lease.release(e.gd.apidInstanceID); err != nil {
+			log.Warnf("unable to release leader lease: %v", err)
+			return
+		}
+		log.Infof("instance %s resigned as cluster leader", e.gd.apidInstanceID)
+	})
+}
+
+// ResignLeadership hands the cluster leadership over to another instance. Call it when shutting down.
+func (gd *GatewayDeploy) ResignLeadership() {
+	gd.election.resign()
+}
+
+// ResignLeadership hands the cluster leadership of the instance registered with apid over to another instance
+func ResignLeadership() {
+	if plugin == nil {
+		return
+	}
+	plugin.ResignLeadership()
+}
+
+func (e *leaderElection) recordSent(results apiDeploymentResults) {
+	if e.lease == nil {
+		return
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for _, r := range results {
+		e.sent[r.ID] = trackerStatus{r.Status, r.ErrorCode, r.Message}
+	}
+}
+
+// syncTrackerStatuses() sends the deployment statuses in the DB that the tracker doesn't have, including those
+// recorded by other instances sharing the DB
+func (e *leaderElection) syncTrackerStatuses() {
+	if e.gd.getDB() == nil {
+		return
+	}
+	deployments, err := e.gd.getDeployments("WHERE deploy_status != $1", "")
+	if err != nil {
+		return
+	}
+
+	var results apiDeploymentResults
+	e.mux.Lock()
+	for _, dep := range deployments {
+		if e.sent[dep.ID] != (trackerStatus{dep.DeployStatus, dep.DeployErrorCode, dep.DeployErrorMessage}) {
+			results = append(results, apiDeploymentResult{
+				ID:        dep.ID,
+				Status:    dep.DeployStatus,
+				ErrorCode: dep.DeployErrorCode,
+				Message:   dep.DeployErrorMessage,
+			})
+		}
+	}
+	e.mux.Unlock()
+
+	if len(results) > 0 {
+		log.Debugf("leader sending %d deployment statuses to tracker", len(results))
+		e.gd.transmitDeploymentResultsToServer(results)
+	}
+}
+
+func initLeaderTable(db apid.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_deployment_leader (
+		apid_cluster_id varchar(36) NOT NULL,
+		holder text NOT NULL,
+		expires int NOT NULL,
+		PRIMARY KEY (apid_cluster_id)
+	);
+	`)
+	return err
+}
+
+// dbLease is a row per cluster in the shared DB
+type dbLease struct {
+	gd *GatewayDeploy
+}
+
+func (l dbLease) acquire(holder string, now, expires time.Time) (bool, error) {
+	db := l.gd.getDB()
+	if db == nil {
+		return false, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT OR IGNORE INTO edgex_deployment_leader (apid_cluster_id, holder, expires) VALUES ($1, $2, $3)
+	`, l.gd.apidClusterID, holder, expires.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+	UPDATE edgex_deployment_leader SET holder=$1, expires=$2
+	WHERE apid_cluster_id=$3 AND (holder=$1 OR expires<$4)
+	`, holder, expires.UnixNano(), l.gd.apidClusterID, now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+
+	var current string
+	err = tx.QueryRow("SELECT holder FROM edgex_deployment_leader WHERE apid_cluster_id=$1", l.gd.apidClusterID).
+		Scan(&current)
+	if err != nil {
+		return false, err
+	}
+	return current == holder, tx.Commit()
+}
+
+func (l dbLease) release(holder string) error {
+	db := l.gd.getDB()
+	if db == nil {
+		return nil
+	}
+	_, err := db.Exec("DELETE FROM edgex_deployment_leader WHERE apid_cluster_id=$1 AND holder=$2",
+		l.gd.apidClusterID, holder)
+	return err
+}
+
+// fileLease is a file holding the holder and expiry in a directory shared by the instances. Updates are
+// serialized by an exclusively created lock file.
+type fileLease struct {
+	dir           string
+	leaseDuration time.Duration // locks older than this are stale
+	clock         Clock
+}
+
+func (l fileLease) acquire(holder string, now, expires time.Time) (bool, error) {
+	unlock, err := l.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	current, currentExpires, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	if current != "" && current != holder && now.Before(currentExpires) {
+		return false, nil
+	}
+
+	tempFile := path.Join(l.dir, leaderFile+"."+holder)
+	content := fmt.Sprintf("%s\n%d\n", holder, expires.UnixNano())
+	if err := ioutil.WriteFile(tempFile, []byte(content), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tempFile, path.Join(l.dir, leaderFile)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l fileLease) release(holder string) error {
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, _, err := l.read()
+	if err != nil || current != holder {
+		return err
+	}
+	return os.Remove(path.Join(l.dir, leaderFile))
+}
+
+func (l fileLease) read() (string, time.Time, error) {
+	b, err := ioutil.ReadFile(path.Join(l.dir, leaderFile))
+	if os.IsNotExist(err) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		return "", time.Time{}, nil // unreadable leases are free
+	}
+	expires, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, nil
+	}
+	return lines[0], time.Unix(0, expires), nil
+}
+
+// lock() creates the lock file, removing it first if it was left behind longer than a lease
+func (l fileLease) lock() (func(), error) {
+	lockFile := path.Join(l.dir, leaderLockFile)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.WriteString(strconv.FormatInt(l.clock.Now().UnixNano(), 10))
+			f.Close()
+			if err != nil {
+				os.Remove(lockFile)
+				return nil, err
+			}
+			return func() { os.Remove(lockFile) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if l.lockStale(lockFile) {
+			log.Warnf("removing stale leader lock file %s", lockFile)
+			os.Remove(lockFile)
+			continue
+		}
+		break
+	}
+	return nil, fmt.Errorf("leader lock file %s is held by another instance", lockFile)
+}
+
+// lockStale() tells the age of the lock file by the instance clock time written into it, or by its modification
+// time on the system clock while that isn't written yet
+func (l fileLease) lockStale(lockFile string) bool {
+	if b, err := ioutil.ReadFile(lockFile); err == nil {
+		if locked, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+			return l.clock.Now().Sub(time.Unix(0, locked)) > l.leaseDuration
+		}
+	}
+	info, err := os.Stat(lockFile)
+	return err == nil && time.Since(info.ModTime()) > l.leaseDuration
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/30x/apidGatewayDeploy/testutil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("leader", func() {
+
+	leaseBehavior := func(lease leaderLease) {
+		now := time.Now()
+		later := now.Add(time.Minute)
+
+		Expect(lease.acquire("a", now, now.Add(time.Second))).To(BeTrue())
+		Expect(lease.acquire("b", now, now.Add(time.Second))).To(BeFalse())
+		Expect(lease.acquire("a", now, now.Add(time.Second))).To(BeTrue())
+
+		// after expiry
+		Expect(lease.acquire("b", later, later.Add(time.Second))).To(BeTrue())
+		Expect(lease.release("a")).To(Succeed())
+		Expect(lease.acquire("a", later, later.Add(time.Second))).To(BeFalse())
+
+		Expect(lease.release("b")).To(Succeed())
+		Expect(lease.acquire("a", later, later.Add(time.Second))).To(BeTrue())
+		Expect(lease.release("a")).To(Succeed())
+	}
+
+	It("should hand over a DB lease", func() {
+		leaseBehavior(dbLease{gd})
+	})
+
+	It("should hand over a file lease", func() {
+		dir, err := ioutil.TempDir("", "leader_test")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		clock := NewFakeClock(time.Now())
+		lease := fileLease{dir: dir, leaseDuration: gd.leaderLeaseDuration, clock: clock}
+		leaseBehavior(lease)
+
+		// a held lock blocks, a stale one doesn't
+		_, err = lease.lock()
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = lease.acquire("a", clock.Now(), clock.Now().Add(time.Second))
+		Expect(err).Should(HaveOccurred())
+
+		clock.Advance(2 * gd.leaderLeaseDuration)
+		Expect(lease.acquire("a", clock.Now(), clock.Now().Add(time.Second))).To(BeTrue())
+
+		// a lock without a time is as old as the file
+		lockFile := path.Join(dir, leaderLockFile)
+		Expect(ioutil.WriteFile(lockFile, nil, 0644)).To(Succeed())
+		_, err = lease.acquire("a", clock.Now(), clock.Now().Add(time.Second))
+		Expect(err).Should(HaveOccurred())
+
+		old := time.Now().Add(-2 * gd.leaderLeaseDuration)
+		Expect(os.Chtimes(lockFile, old, old)).To(Succeed())
+		Expect(lease.acquire("a", clock.Now(), clock.Now().Add(time.Second))).To(BeTrue())
+	})
+
+	It("should lead only while holding the lease", func() {
+		e, err := newLeaderElection(gd, LEADER_ELECTION_NONE, "", false)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.isLeader()).To(BeTrue())
+
+		_, err = newLeaderElection(gd, "bogus", "", false)
+		Expect(err).Should(HaveOccurred())
+
+		tracker := testutil.NewTracker()
+		defer tracker.Close()
+		other, err := NewGatewayDeploy(gd.services, Options{Store: &dbStore{}})
+		Expect(err).ShouldNot(HaveOccurred())
+		other.store.SetDB(gd.getDB())
+		other.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		e, err = newLeaderElection(other, LEADER_ELECTION_DB, "", false)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.isLeader()).To(BeFalse())
+		other.election = e
+
+		// another instance holds the lease, and finds the results in the shared DB
+		now := time.Now()
+		Expect(dbLease{other}.acquire("other", now, now.Add(time.Minute))).To(BeTrue())
+		e.renew()
+		Expect(e.isLeader()).To(BeFalse())
+		Expect(other.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "x"}})).To(Succeed())
+		Expect(tracker.Requests()).To(BeEmpty())
+		Expect(dbLease{other}.release("other")).To(Succeed())
+
+		go e.run()
+		Eventually(e.isLeader).Should(BeTrue())
+
+		e.resign()
+		Expect(e.isLeader()).To(BeFalse())
+		Expect(dbLease{other}.acquire("other", time.Now(), time.Now().Add(time.Minute))).To(BeTrue())
+		Expect(dbLease{other}.release("other")).To(Succeed())
+	})
+
+	It("should sweep bundles as a follower only without a shared bundle directory", func() {
+		dir, err := ioutil.TempDir("", "leader_test")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		follower := func(mode string, sharedDir bool) *leaderElection {
+			e, err := newLeaderElection(gd, mode, dir, sharedDir)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(e.isLeader()).To(BeFalse())
+			return e
+		}
+		Expect(follower(LEADER_ELECTION_DB, false).sweepsBundles()).To(BeTrue())
+		Expect(follower(LEADER_ELECTION_DB, true).sweepsBundles()).To(BeFalse())
+		Expect(follower(LEADER_ELECTION_FILE, false).sweepsBundles()).To(BeFalse())
+
+		e, err := newLeaderElection(gd, LEADER_ELECTION_NONE, "", false)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(e.sweepsBundles()).To(BeTrue())
+	})
+
+	It("should send its own results as a follower without a shared DB", func() {
+		dir, err := ioutil.TempDir("", "leader_test")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		tracker := testutil.NewTracker()
+		defer tracker.Close()
+		other, err := NewGatewayDeploy(gd.services, Options{Store: &dbStore{}})
+		Expect(err).ShouldNot(HaveOccurred())
+		other.store.SetDB(gd.getDB())
+		other.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		other.election, err = newLeaderElection(other, LEADER_ELECTION_FILE, dir, false)
+		Expect(err).ShouldNot(HaveOccurred())
+		lease := fileLease{dir: dir, leaseDuration: other.leaderLeaseDuration, clock: other.clock}
+		Expect(lease.acquire("other", time.Now(), time.Now().Add(time.Minute))).To(BeTrue())
+		other.election.renew()
+		Expect(other.election.isLeader()).To(BeFalse())
+
+		Expect(other.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "x"}})).To(Succeed())
+		Expect(tracker.Accepted()).To(HaveLen(1))
+	})
+})
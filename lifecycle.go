@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pluginLifecycle runs the background work of the plugin until shutdown. Shutdown happens in two stages: when
+// stop is closed no new work is started, and when ctx is canceled the work still in progress is abandoned.
+type pluginLifecycle struct {
+	gd          *GatewayDeploy
+	stop        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	loops       sync.WaitGroup // download workers, the dispatcher and the other background loops
+	downloaders []*BundleDownloader
+	mux         sync.Mutex
+	sending     int           // tracker transmissions in progress
+	sent        chan struct{} // closed when sending drops to 0
+	shutdown    sync.Once
+	err         error
+}
+
+func newLifecycle(gd *GatewayDeploy) *pluginLifecycle {
+	l := &pluginLifecycle{gd: gd, stop: make(chan struct{})}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l
+}
+
+// start() runs the download workers and background loops
+func (l *pluginLifecycle) start() {
+	l.gd.downloads.clear()
+	l.gd.initializeBundleDownloading(l)
+	l.spawn(func() { l.gd.distributeEvents(l.stop) })
+	l.spawn(func() { l.gd.scheduleWindowBoundaries(l.stop) })
+	l.spawn(func() { l.gd.sendHeartbeats(l.stop) })
+}
+
+func (l *pluginLifecycle) spawn(f func()) {
+	l.loops.Add(1)
+	go func() {
+		defer l.loops.Done()
+		f()
+	}()
+}
+
+func (l *pluginLifecycle) stopping() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep() returns false early if work in progress is abandoned
+func (l *pluginLifecycle) sleep(d time.Duration) bool {
+	select {
+	case <-l.gd.clock.After(d):
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+func (l *pluginLifecycle) trackerSending() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.sending++
+}
+
+func (l *pluginLifecycle) trackerSent() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.sending--
+	if l.sending == 0 && l.sent != nil {
+		close(l.sent)
+		l.sent = nil
+	}
+}
+
+// waitForTracker() waits until no tracker transmissions are in progress or done is closed
+func (l *pluginLifecycle) waitForTracker(done <-chan struct{}) bool {
+	l.mux.Lock()
+	if l.sending == 0 {
+		l.mux.Unlock()
+		return true
+	}
+	if l.sent == nil {
+		l.sent = make(chan struct{})
+	}
+	sent := l.sent
+	l.mux.Unlock()
+
+	select {
+	case <-sent:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Shutdown stops the plugin. Long-polling clients are answered with 304, downloads in progress finish and
+// pending deployment results are sent to the tracker, as long as ctx allows. Downloads that are abandoned or
+// never started remain unready and start over on the next start. Returns ctx.Err() if work was abandoned.
+func (gd *GatewayDeploy) Shutdown(ctx context.Context) error {
+	return gd.lifecycle.stopAll(ctx)
+}
+
+// Shutdown stops the instance registered with apid, if any
+func Shutdown(ctx context.Context) error {
+	if plugin == nil {
+		return nil
+	}
+	return plugin.Shutdown(ctx)
+}
+
+func (l *pluginLifecycle) stopAll(ctx context.Context) error {
+	l.shutdown.Do(func() {
+		log.Info("shutting down")
+		close(l.stop)
+		for _, w := range l.downloaders {
+			w.Stop()
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			l.loops.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+			if !l.waitForTracker(ctx.Done()) {
+				l.err = ctx.Err()
+			}
+		case <-ctx.Done():
+			l.err = ctx.Err()
+		}
+		if l.err != nil {
+			log.Warnf("shutdown deadline passed, abandoning downloads and tracker transmissions: %v", l.err)
+		}
+
+		// nobody receives deployment notifications anymore, senders blocked on them are released
+		l.cancel()
+		for waiting := true; waiting; {
+			select {
+			case <-stopped:
+				waiting = false
+			case <-l.gd.deploymentsChanged:
+			}
+		}
+		l.waitForTracker(nil)
+
+		// hand leadership over once this instance has nothing left to tell the tracker
+		l.gd.election.resign()
+		log.Info("shut down")
+	})
+	return l.err
+}
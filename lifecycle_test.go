@@ -0,0 +1,207 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("lifecycle", func() {
+
+	shutdown := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return Shutdown(ctx)
+	}
+
+	insertDeployment := func(id, bundleURI string) DataDeployment {
+		return insertBundleDeployment(gd.getDB(), id, bundleURI, testGetChecksum("crc32", bundleURI))
+	}
+
+	restart := func() {
+		gd.lifecycle = newLifecycle(gd)
+		gd.lifecycle.start()
+	}
+
+	// start from a fresh plugin, abandoning tracker retries left behind by other tests
+	BeforeEach(func() {
+		shutdown(time.Millisecond)
+		restart()
+	})
+
+	AfterEach(restart)
+
+	It("should answer long-polling clients with 304", func() {
+		uri, err := url.Parse(testServer.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		uri.Path = deploymentsEndpoint
+		res, err := http.Get(uri.String())
+		Expect(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+		eTag := res.Header.Get("etag")
+
+		query := uri.Query()
+		query.Add("block", "10")
+		uri.RawQuery = query.Encode()
+		longPoll := func() int {
+			req, err := http.NewRequest("GET", uri.String(), nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Add("If-None-Match", eTag)
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		status := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			status <- longPoll()
+		}()
+		Eventually(func() int64 { return atomic.LoadInt64(&gd.longPollSubscribers) }).Should(Equal(int64(1)))
+
+		Expect(shutdown(5 * time.Second)).To(Succeed())
+		Eventually(status).Should(Receive(Equal(http.StatusNotModified)))
+
+		start := time.Now()
+		Expect(longPoll()).To(Equal(http.StatusNotModified))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should let a download in progress finish and leave queued ones for the next start", func() {
+		started := make(chan bool, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(r.URL.Path))
+		}))
+		defer ts.Close()
+
+		dep := insertDeployment("lifecycle_in_flight", ts.URL+"/bundles/in_flight")
+		gd.queueDownloadRequest(dep)
+		<-started
+
+		Expect(shutdown(5 * time.Second)).To(Succeed())
+		deployments, err := gd.getDeployments("WHERE id=$1", dep.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deployments[0].LocalBundleURI).ToNot(BeEmpty())
+
+		queued := insertDeployment("lifecycle_queued", ts.URL+"/bundles/queued")
+		gd.queueDownloadRequest(queued)
+		Consistently(started, 100*time.Millisecond).ShouldNot(Receive())
+		unready, err := gd.getUnreadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(unready).To(HaveLen(1))
+		Expect(unready[0].ID).To(Equal(queued.ID))
+	})
+
+	It("should finish more downloads during shutdown than deployment notifications are buffered", func() {
+		gd.concurrentDownloads = 8
+		shutdown(time.Millisecond)
+		restart()
+
+		var started int32
+		release := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&started, 1)
+			<-release
+			w.Write([]byte(r.URL.Path))
+		}))
+		defer ts.Close()
+
+		for i := 0; i < gd.concurrentDownloads; i++ {
+			id := fmt.Sprintf("lifecycle_shutdown_%d", i)
+			gd.queueDownloadRequest(insertDeployment(id, ts.URL+"/bundles/"+id))
+		}
+		Eventually(func() int32 { return atomic.LoadInt32(&started) }).Should(Equal(int32(gd.concurrentDownloads)))
+
+		done := make(chan error, 1)
+		go func() {
+			done <- shutdown(5 * time.Second)
+		}()
+		Eventually(gd.lifecycle.stopping).Should(BeTrue())
+		close(release)
+
+		Eventually(done, 2*time.Second).Should(Receive(BeNil()))
+		unready, err := gd.getUnreadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(unready).To(BeEmpty())
+	})
+
+	It("should flush pending tracker results before shutting down", func() {
+		var calls int32
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		go gd.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "x", Status: RESPONSE_STATUS_SUCCESS}})
+		Eventually(func() int32 { return atomic.LoadInt32(&calls) }).Should(BeNumerically(">=", 1))
+
+		Expect(shutdown(5 * time.Second)).To(Succeed())
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(3)))
+	})
+
+	It("should abandon tracker results when the deadline passes", func() {
+		var calls int32
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- gd.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "x", Status: RESPONSE_STATUS_FAIL}})
+		}()
+		Eventually(func() int32 { return atomic.LoadInt32(&calls) }).Should(BeNumerically(">=", 1))
+
+		Expect(shutdown(100 * time.Millisecond)).To(Equal(context.DeadlineExceeded))
+		Expect(done).To(Receive(Equal(context.Canceled)))
+
+		// nothing is sent after shutdown
+		Expect(gd.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "y"}})).Should(HaveOccurred())
+	})
+
+	It("should do nothing when no instance is registered", func() {
+		savePlugin := plugin
+		plugin = nil
+		Expect(shutdown(time.Millisecond)).To(Succeed())
+		ResignLeadership()
+		plugin = savePlugin
+
+		// stopped as other tests leave it, for the restart after each test
+		shutdown(time.Millisecond)
+	})
+})
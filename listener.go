@@ -26,12 +26,14 @@ import (
 )
 
 const (
-	APIGEE_SYNC_EVENT = "ApigeeSync"
-	DEPLOYMENT_TABLE  = "edgex.deployment"
+	APIGEE_SYNC_EVENT  = "ApigeeSync"
+	DEPLOYMENT_TABLE   = "edgex.deployment"
+	DATA_SCOPE_TABLE   = "edgex.data_scope"
+	APID_CLUSTER_TABLE = "edgex.apid_cluster"
 )
 
-func initListener(services apid.Services) {
-	services.Events().Listen(APIGEE_SYNC_EVENT, &apigeeSyncHandler{})
+func (gd *GatewayDeploy) initListener() {
+	gd.services.Events().Listen(APIGEE_SYNC_EVENT, &apigeeSyncHandler{gd})
 }
 
 type bundleConfigJson struct {
@@ -39,9 +41,11 @@ type bundleConfigJson struct {
 	URI          string `json:"uri"`
 	ChecksumType string `json:"checksumType"`
 	Checksum     string `json:"checksum"`
+	Type         string `json:"type"`
 }
 
 type apigeeSyncHandler struct {
+	gd *GatewayDeploy
 }
 
 func (h *apigeeSyncHandler) String() string {
@@ -50,63 +54,141 @@ func (h *apigeeSyncHandler) String() string {
 
 func (h *apigeeSyncHandler) Handle(e apid.Event) {
 
+	if h.gd.lifecycle.stopping() {
+		log.Debugf("shutting down, ignoring event %v", e)
+		return
+	}
+
 	if changeSet, ok := e.(*common.ChangeList); ok {
-		processChangeList(changeSet)
+		h.gd.processChangeList(changeSet)
 	} else if snapData, ok := e.(*common.Snapshot); ok {
-		processSnapshot(snapData)
+		h.gd.processSnapshot(snapData)
 	} else {
 		log.Debugf("Received invalid event. Ignoring. %v", e)
 	}
 }
 
-func processSnapshot(snapshot *common.Snapshot) {
+func (gd *GatewayDeploy) processSnapshot(snapshot *common.Snapshot) {
 
 	log.Debugf("Snapshot received. Switching to DB version: %s", snapshot.SnapshotInfo)
 
-	db, err := data.DBVersion(snapshot.SnapshotInfo)
+	gd.snapshotMux.Lock()
+	gd.latestSnapshotInfo = snapshot.SnapshotInfo
+	err := gd.switchToSnapshot(snapshot)
+	gd.snapshotMux.Unlock()
+
 	if err != nil {
-		log.Panicf("Unable to access database: %v", err)
+		gd.snapshotFailed(snapshot, err)
+		go gd.retrySnapshot(snapshot)
+		return
+	}
+
+	gd.startupOnExistingDatabase()
+	gd.triggerWindowReschedule()
+
+	// the snapshot may bring different data scopes and clusters
+	if snapshotHasTable(snapshot, DATA_SCOPE_TABLE, APID_CLUSTER_TABLE) {
+		gd.notifyDeploymentsChanged(DATA_SCOPE_TABLE)
+	}
+
+	log.Debug("Snapshot processed")
+}
+
+// switchToSnapshot() prepares the DB version of the snapshot and switches to it.
+// On error, the previous DB version remains in use.
+func (gd *GatewayDeploy) switchToSnapshot(snapshot *common.Snapshot) error {
+
+	db, err := gd.data.DBVersion(snapshot.SnapshotInfo)
+	if err != nil {
+		return fmt.Errorf("Unable to access database: %v", err)
 	}
 
 	// alter table
 	err = alterTable(db)
 	if err != nil {
-		log.Panicf("Alter table failed: %v", err)
+		return fmt.Errorf("Alter table failed: %v", err)
+	}
+
+	if snapshotHasTable(snapshot, DATA_SCOPE_TABLE) {
+		if err = markDataScopesDelivered(db); err != nil {
+			return fmt.Errorf("Unable to record data scopes: %v", err)
+		}
 	}
-	// ensure that no new database updates are made on old database
-	dbMux.Lock()
-	SetDB(db)
-	dbMux.Unlock()
 
 	// update deployments
 	deps, err := getDeploymentsToUpdate(db)
 	if err != nil {
-		log.Panicf("Unable to getDeploymentsToUpdate: %v", err)
+		return fmt.Errorf("Unable to getDeploymentsToUpdate: %v", err)
 	}
 	tx, err := db.Begin()
 	if err != nil {
-		log.Panicf("Error starting transaction: %v", err)
+		return fmt.Errorf("Error starting transaction: %v", err)
 	}
 	defer tx.Rollback()
 	err = updateDeploymentsColumns(tx, deps)
 	if err != nil {
-		log.Panicf("updateDeploymentsColumns failed: %v", err)
+		return fmt.Errorf("updateDeploymentsColumns failed: %v", err)
 	}
 	err = tx.Commit()
 	if err != nil {
-		log.Panicf("Error committing Snapshot update: %v", err)
+		return fmt.Errorf("Error committing Snapshot update: %v", err)
 	}
 
-	startupOnExistingDatabase()
-	log.Debug("Snapshot processed")
+	// ensure that no new database updates are made on old database
+	gd.SetDB(db)
+
+	gd.health.snapshotSucceeded(snapshot.SnapshotInfo)
+	return nil
+}
+
+func (gd *GatewayDeploy) snapshotFailed(snapshot *common.Snapshot, err error) {
+	log.Errorf("Unable to switch to DB version %s, keeping previous version: %v", snapshot.SnapshotInfo, err)
+	gd.health.snapshotFailed(snapshot.SnapshotInfo, err)
+	gd.emitDeploymentEvent(&SnapshotFailed{
+		SnapshotInfo: snapshot.SnapshotInfo,
+		Error:        err,
+	})
+}
+
+// retries the switch to a failed snapshot until it succeeds or a newer snapshot arrives
+func (gd *GatewayDeploy) retrySnapshot(snapshot *common.Snapshot) {
+	backOffFunc := gd.createBackoff(gd.snapshotRetryDelay, 5*time.Minute)
+	for {
+		backOffFunc()
+		if gd.lifecycle.stopping() {
+			return
+		}
+
+		gd.snapshotMux.Lock()
+		if gd.latestSnapshotInfo != snapshot.SnapshotInfo {
+			gd.snapshotMux.Unlock()
+			log.Debugf("never mind, snapshot %s was replaced by %s", snapshot.SnapshotInfo, gd.latestSnapshotInfo)
+			return
+		}
+		err := gd.switchToSnapshot(snapshot)
+		gd.snapshotMux.Unlock()
+
+		if err != nil {
+			gd.snapshotFailed(snapshot, err)
+			continue
+		}
+
+		gd.startupOnExistingDatabase()
+		log.Debugf("Snapshot %s processed after retry", snapshot.SnapshotInfo)
+		return
+	}
 }
 
-func startupOnExistingDatabase() {
-	// ensure all deployment statuses have been sent to tracker
+func (gd *GatewayDeploy) startupOnExistingDatabase() {
+	// ensure all deployment statuses have been sent to tracker. A leader sharing the DB sends them once elected.
 	go func() {
-		deployments, err := getDeployments("WHERE deploy_status != $1", "")
+		if gd.election.sharedDB {
+			return
+		}
+		deployments, err := gd.getDeployments("WHERE deploy_status != $1", "")
 		if err != nil {
-			log.Panicf("unable to query database for ready deployments: %v", err)
+			log.Errorf("unable to query database for ready deployments: %v", err)
+			return
 		}
 		log.Debugf("Queuing %d deployments for bundle download", len(deployments))
 
@@ -121,29 +203,48 @@ func startupOnExistingDatabase() {
 			results = append(results, result)
 		}
 		if len(results) > 0 {
-			transmitDeploymentResultsToServer(results)
+			gd.transmitDeploymentResultsToServer(results)
 		}
 	}()
 
 	// start bundle downloads that didn't finish
 	go func() {
-		deployments, err := getUnreadyDeployments()
+		deployments, err := gd.getUnreadyDeployments()
 		if err != nil {
-			log.Panicf("unable to query database for unready deployments: %v", err)
+			log.Errorf("unable to query database for unready deployments: %v", err)
+			return
 		}
 		log.Debugf("Queuing %d deployments for bundle download", len(deployments))
 		for _, dep := range deployments {
-			queueDownloadRequest(dep)
+			gd.queueDownloadRequest(dep)
 		}
 	}()
 }
 
-func processChangeList(changes *common.ChangeList) {
+func (gd *GatewayDeploy) processChangeList(changes *common.ChangeList) {
+
+	// changes redelivered after a reconnect are skipped
+	last, err := gd.getLastSequence()
+	if err != nil {
+		log.Errorf("unable to get the last processed change sequence, processing all changes: %v", err)
+	}
+	latest := last
 
 	// changes have been applied to DB
 	var insertedDeployments, deletedDeployments []DataDeployment
 	var errResults apiDeploymentResults
+	var scopesChanged bool
 	for _, change := range changes.Changes {
+		if seq := sequenceOfChange(change); !seq.isZero() {
+			if !last.before(seq) {
+				log.Debugf("skipping change %s, already processed", seq)
+				continue
+			}
+			if latest.before(seq) {
+				latest = seq
+			}
+		}
+
 		switch change.Table {
 		case DEPLOYMENT_TABLE:
 			switch change.Operation {
@@ -151,6 +252,14 @@ func processChangeList(changes *common.ChangeList) {
 				dep, err := dataDeploymentFromRow(change.NewRow)
 				if err == nil {
 					insertedDeployments = append(insertedDeployments, dep)
+					if _, err := parseDeploymentWindow(dep.ConfigJSON); err != nil {
+						errResults = append(errResults, apiDeploymentResult{
+							ID:        dep.ID,
+							Status:    RESPONSE_STATUS_FAIL,
+							ErrorCode: TRACKER_ERR_DEPLOYMENT_BAD_CONFIG,
+							Message:   fmt.Sprintf("invalid activation window, never active: %v", err),
+						})
+					}
 				} else {
 					result := apiDeploymentResult{
 						ID:        dep.ID,
@@ -159,46 +268,78 @@ func processChangeList(changes *common.ChangeList) {
 						Message:   fmt.Sprintf("unable to parse deployment: %v", err),
 					}
 					errResults = append(errResults, result)
+					gd.emitDeploymentEvent(&DeploymentFailed{
+						Deployment: dep,
+						ErrorCode:  result.ErrorCode,
+						Message:    result.Message,
+					})
 				}
 			case common.Delete:
-				var id, dataScopeID string
-				change.OldRow.Get("id", &id)
-				change.OldRow.Get("data_scope_id", &dataScopeID)
-				// only need these two fields to delete and determine bundle file
-				dep := DataDeployment{
-					ID:          id,
-					DataScopeID: dataScopeID,
-				}
+				// only id and data_scope_id are required to delete and determine bundle file,
+				// but pass along whatever the old row holds to event listeners
+				dep, _ := dataDeploymentFromRow(change.OldRow)
 				deletedDeployments = append(deletedDeployments, dep)
 			default:
 				log.Errorf("unexpected operation: %s", change.Operation)
 			}
+		case DATA_SCOPE_TABLE, APID_CLUSTER_TABLE:
+			// scopes and clusters are read from the DB when deployments are served
+			if change.Table == DATA_SCOPE_TABLE {
+				if err := markDataScopesDelivered(gd.getDB()); err != nil {
+					log.Errorf("unable to record data scopes: %v", err)
+				}
+			}
+			scopesChanged = true
 		}
 	}
 
 	// transmit parsing errors back immediately
 	if len(errResults) > 0 {
-		go transmitDeploymentResultsToServer(errResults)
+		go gd.transmitDeploymentResultsToServer(errResults)
 	}
 
 	for _, d := range deletedDeployments {
-		deploymentsChanged <- d.ID
+		gd.deleteGatewayResults(d.ID)
+		gd.deleteRollout(d.ID)
+		gd.deleteRollback(d.ID)
+		gd.forgetReportedConfig(d.ID)
+		gd.notifyDeploymentsChanged(d.ID)
+		gd.emitDeploymentEvent(&DeploymentRemoved{Deployment: d})
+	}
+
+	// deployments may have been hidden or rescoped
+	if scopesChanged {
+		gd.notifyDeploymentsChanged(DATA_SCOPE_TABLE)
 	}
 
 	log.Debug("ChangeList processed")
 
 	for _, dep := range insertedDeployments {
-		queueDownloadRequest(dep)
+		gd.emitDeploymentEvent(&DeploymentReceived{Deployment: dep})
+		gd.queueDownloadRequest(dep)
+	}
+
+	if latest != last {
+		if err := gd.setLastSequence(latest); err != nil {
+			log.Errorf("unable to record change sequence %s: %v", latest, err)
+		}
 	}
 
-	// clean up old bundles
-	if len(deletedDeployments) > 0 {
+	// clean up old bundles. With a shared bundle directory, only the leader sweeps.
+	if len(deletedDeployments) > 0 && gd.election.sweepsBundles() {
 		log.Debugf("will delete %d old bundles", len(deletedDeployments))
 		go func() {
-			// give clients a minute to avoid conflicts
-			time.Sleep(bundleCleanupDelay)
+			// give clients a minute to avoid conflicts, unless shutting down
+			select {
+			case <-gd.clock.After(gd.bundleCleanupDelay):
+			case <-gd.lifecycle.stop:
+			}
 			for _, dep := range deletedDeployments {
-				bundleFile := getBundleFile(dep)
+				bundleFile := gd.getBundleFile(dep)
+				if gd.bundleInUse(bundleFile) {
+					log.Debugf("keeping old bundle in history: %v", bundleFile)
+					continue
+				}
 				log.Debugf("removing old bundle: %v", bundleFile)
 				safeDelete(bundleFile)
 			}
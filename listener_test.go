@@ -39,22 +39,22 @@ var _ = Describe("listener", func() {
 		 * so the threads generated by startupOnExistingDatabase() will mess up later tests
 		 */
 		It("should set DB to appropriate version", func(done Done) {
-			saveDB := getDB()
+			saveDB := gd.getDB()
 			deploymentID := "set_version_test"
 			snapshot, dep := createSnapshotDeployment(deploymentID, "test_version")
 
-			db, err := data.DBVersion(snapshot.SnapshotInfo)
+			db, err := gd.data.DBVersion(snapshot.SnapshotInfo)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			err = InitDB(db)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			insertDeploymentToDb(dep, db)
-			expectedDB, err := data.DBVersion(snapshot.SnapshotInfo)
+			expectedDB, err := gd.data.DBVersion(snapshot.SnapshotInfo)
 			Expect(err).NotTo(HaveOccurred())
 
 			var listener = make(chan deploymentsResult)
-			addSubscriber <- listener
+			gd.addSubscriber <- listener
 
 			apid.Events().Emit(APIGEE_SYNC_EVENT, &snapshot)
 
@@ -62,7 +62,7 @@ var _ = Describe("listener", func() {
 			Expect(result.err).ShouldNot(HaveOccurred())
 
 			// DB should have been set
-			Expect(getDB() == expectedDB).Should(BeTrue())
+			Expect(gd.getDB() == expectedDB).Should(BeTrue())
 
 			SetDB(saveDB)
 			close(done)
@@ -70,13 +70,13 @@ var _ = Describe("listener", func() {
 
 		It("should process unready on existing db startup event", func(done Done) {
 
-			saveDB := getDB()
+			saveDB := gd.getDB()
 
 			deploymentID := "startup_test"
 
 			snapshot, dep := createSnapshotDeployment(deploymentID, "test_unready")
 
-			db, err := data.DBVersion(snapshot.SnapshotInfo)
+			db, err := gd.data.DBVersion(snapshot.SnapshotInfo)
 			Expect(err).ShouldNot(HaveOccurred())
 
 			err = InitDB(db)
@@ -85,7 +85,7 @@ var _ = Describe("listener", func() {
 			insertDeploymentToDb(dep, db)
 
 			var listener = make(chan deploymentsResult)
-			addSubscriber <- listener
+			gd.addSubscriber <- listener
 
 			apid.Events().Emit(APIGEE_SYNC_EVENT, &snapshot)
 
@@ -103,7 +103,7 @@ var _ = Describe("listener", func() {
 
 		It("should send deployment statuses on existing db startup event", func(done Done) {
 
-			saveDB := getDB()
+			saveDB := gd.getDB()
 
 			successDep := DataDeployment{
 				ID:                 "success",
@@ -153,7 +153,7 @@ var _ = Describe("listener", func() {
 			}))
 
 			var err error
-			apiServerBaseURI, err = url.Parse(ts.URL)
+			gd.apiServerBaseURI, err = url.Parse(ts.URL)
 			Expect(err).NotTo(HaveOccurred())
 
 			// init without info == startup on existing DB
@@ -162,7 +162,7 @@ var _ = Describe("listener", func() {
 				Tables:       []common.Table{},
 			}
 
-			db, err := data.DBVersion(snapshot.SnapshotInfo)
+			db, err := gd.data.DBVersion(snapshot.SnapshotInfo)
 			Expect(err).NotTo(HaveOccurred())
 
 			err = InitDBFullColumns(db)
@@ -185,6 +185,59 @@ var _ = Describe("listener", func() {
 		})
 	})
 
+	Context("ApigeeSync snapshot failure", func() {
+
+		It("should keep previous DB, report unhealthy and retry", func() {
+
+			saveDB := gd.getDB()
+			defer SetDB(saveDB)
+
+			failures := make(chan *SnapshotFailed, 10)
+			apid.Events().ListenFunc(GATEWAY_DEPLOY_EVENT, func(e apid.Event) {
+				if f, ok := e.(*SnapshotFailed); ok && f.SnapshotInfo == "test_failing" {
+					select {
+					case failures <- f:
+					default:
+					}
+				}
+			})
+
+			// no deployment table, so alter table will fail
+			var snapshot = common.Snapshot{
+				SnapshotInfo: "test_failing",
+				Tables:       []common.Table{},
+			}
+			db, err := gd.data.DBVersion(snapshot.SnapshotInfo)
+			Expect(err).NotTo(HaveOccurred())
+
+			apid.Events().Emit(APIGEE_SYNC_EVENT, &snapshot)
+
+			var failure *SnapshotFailed
+			Eventually(failures).Should(Receive(&failure))
+			Expect(failure.Error).To(HaveOccurred())
+
+			Expect(gd.getDB() == saveDB).Should(BeTrue())
+			report := gd.health.report()
+			Expect(report.Status).To(Equal(HEALTH_STATUS_UNHEALTHY))
+			Expect(report.FailedSnapshot).To(Equal(snapshot.SnapshotInfo))
+
+			res, err := http.Get(testServer.URL + healthEndpoint)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+			// repair the DB, the retry should switch to it
+			err = InitDB(db)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Eventually(gd.getDB).Should(BeIdenticalTo(db))
+			Eventually(func() string {
+				return gd.health.report().Status
+			}).Should(Equal(HEALTH_STATUS_HEALTHY))
+			Expect(gd.health.report().SnapshotVersion).To(Equal(snapshot.SnapshotInfo))
+		})
+	})
+
 	Context("ApigeeSync change event", func() {
 
 		It("inserting event should deliver the deployment to subscribers", func(done Done) {
@@ -194,7 +247,7 @@ var _ = Describe("listener", func() {
 			event, dep := createChangeDeployment(deploymentID)
 
 			// insert full deployment columns
-			tx, err := getDB().Begin()
+			tx, err := gd.getDB().Begin()
 			Expect(err).ShouldNot(HaveOccurred())
 			err = InsertDeployment(tx, dep)
 			Expect(err).ShouldNot(HaveOccurred())
@@ -202,7 +255,7 @@ var _ = Describe("listener", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 
 			var listener = make(chan deploymentsResult)
-			addSubscriber <- listener
+			gd.addSubscriber <- listener
 
 			apid.Events().Emit(APIGEE_SYNC_EVENT, &event)
 
@@ -210,7 +263,7 @@ var _ = Describe("listener", func() {
 			result := <-listener
 			Expect(result.err).ShouldNot(HaveOccurred())
 
-			deployments, err := getReadyDeployments()
+			deployments, err := gd.getReadyDeployments()
 			Expect(err).ShouldNot(HaveOccurred())
 
 			Expect(len(deployments)).To(Equal(1))
@@ -231,7 +284,7 @@ var _ = Describe("listener", func() {
 			event, dep := createChangeDeployment(deploymentID)
 
 			// insert full deployment columns
-			tx, err := getDB().Begin()
+			tx, err := gd.getDB().Begin()
 			Expect(err).ShouldNot(HaveOccurred())
 			err = InsertDeployment(tx, dep)
 			Expect(err).ShouldNot(HaveOccurred())
@@ -239,14 +292,14 @@ var _ = Describe("listener", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 
 			listener := make(chan deploymentsResult)
-			addSubscriber <- listener
+			gd.addSubscriber <- listener
 			apid.Events().Emit(APIGEE_SYNC_EVENT, &event)
 			// wait for event to propagate
 			result := <-listener
 			Expect(result.err).ShouldNot(HaveOccurred())
 
 			// delete deployment
-			deletDeploymentFromDb(dep, getDB())
+			deletDeploymentFromDb(dep, gd.getDB())
 			row := common.Row{}
 			row["id"] = &common.ColumnVal{Value: deploymentID}
 			event = common.ChangeList{
@@ -260,7 +313,7 @@ var _ = Describe("listener", func() {
 			}
 
 			listener = make(chan deploymentsResult)
-			addSubscriber <- listener
+			gd.addSubscriber <- listener
 			apid.Events().Emit(APIGEE_SYNC_EVENT, &event)
 			result = <-listener
 			Expect(result.err).ShouldNot(HaveOccurred())
@@ -0,0 +1,278 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are exposed in the Prometheus text format
+const metricsEndpoint = "/deployments/metrics"
+
+const (
+	DOWNLOAD_FAILURE_TIMEOUT     = "timeout"
+	DOWNLOAD_FAILURE_CHECKSUM    = "checksum"
+	DOWNLOAD_FAILURE_HTTP_STATUS = "http_status"
+	DOWNLOAD_FAILURE_OTHER       = "other"
+
+	TRACKER_FAILURE_CONNECTION  = "connection"
+	TRACKER_FAILURE_HTTP_STATUS = "http_status"
+)
+
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// pluginMetrics are the metrics of an instance
+type pluginMetrics struct {
+	downloadAttempts  *counter
+	downloadSuccesses *counter
+	downloadFailures  *counter
+	downloadBytes     *counter
+	downloadDuration  *histogram
+	peerDownloads     *counter
+	apiRequests       *counter
+	trackerDuration   *histogram
+	trackerFailures   *counter
+	all               []metric
+}
+
+func newPluginMetrics(gd *GatewayDeploy) *pluginMetrics {
+	m := &pluginMetrics{
+		downloadAttempts: newCounter("gatewaydeploy_bundle_download_attempts_total",
+			"Bundle download attempts."),
+		downloadSuccesses: newCounter("gatewaydeploy_bundle_download_successes_total",
+			"Successful bundle downloads."),
+		downloadFailures: newCounter("gatewaydeploy_bundle_download_failures_total",
+			"Failed bundle downloads by cause. code is the HTTP status for http_status failures.", "cause", "code"),
+		downloadBytes: newCounter("gatewaydeploy_bundle_download_bytes_total",
+			"Bytes of bundle content downloaded."),
+		downloadDuration: newHistogram("gatewaydeploy_bundle_download_duration_seconds",
+			"Duration of bundle download attempts.", durationBuckets),
+
+		peerDownloads: newCounter("gatewaydeploy_peer_bundle_downloads_total",
+			"Bundle downloads attempted from peers by outcome.", "outcome"),
+
+		apiRequests: newCounter("gatewaydeploy_api_requests_total",
+			"Requests to the deployments API by method and status code.", "method", "code"),
+
+		trackerDuration: newHistogram("gatewaydeploy_tracker_transmission_duration_seconds",
+			"Duration of tracker transmission attempts.", durationBuckets),
+		trackerFailures: newCounter("gatewaydeploy_tracker_transmission_failures_total",
+			"Failed tracker transmission attempts by cause. code is the HTTP status for http_status failures.",
+			"cause", "code"),
+	}
+	m.all = []metric{
+		m.downloadAttempts,
+		m.downloadSuccesses,
+		m.downloadFailures,
+		m.downloadBytes,
+		m.downloadDuration,
+		m.peerDownloads,
+		newGauge("gatewaydeploy_download_queue_depth",
+			"Bundle downloads waiting to be dispatched.", func() float64 {
+				return float64(len(gd.downloadQueue))
+			}),
+		newGauge("gatewaydeploy_download_workers_busy",
+			"Bundle download workers currently downloading.", func() float64 {
+				return float64(gd.health.busyWorkers())
+			}),
+		newGauge("gatewaydeploy_long_poll_subscribers",
+			"Clients blocked waiting for new deployments.", func() float64 {
+				return float64(atomic.LoadInt64(&gd.longPollSubscribers))
+			}),
+		m.apiRequests,
+		m.trackerDuration,
+		m.trackerFailures,
+	}
+	return m
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type counter struct {
+	sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]float64
+}
+
+func newCounter(name, help string, labelNames ...string) *counter {
+	return &counter{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+}
+
+func (c *counter) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counter) add(v float64, labelValues ...string) {
+	key := formatLabels(c.labelNames, labelValues)
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] += v
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.Lock()
+	defer c.Unlock()
+	if len(c.labelNames) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.values[""]))
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatValue(c.values[k]))
+	}
+}
+
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newGauge(name, help string, value func() float64) *gauge {
+	return &gauge{name, help, value}
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.value()))
+}
+
+type histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) observeSince(clock Clock, start time.Time) {
+	h.observe(clock.Now().Sub(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.Lock()
+	defer h.Unlock()
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics are available before a DB has been set, unlike InitAPI()
+func (gd *GatewayDeploy) initMetricsAPI() {
+	gd.services.API().HandleFunc(metricsEndpoint, gd.apiGetMetrics).Methods("GET")
+}
+
+func (gd *GatewayDeploy) apiGetMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, m := range gd.metrics.all {
+		m.write(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentAPI counts requests handled by h by method and response code
+func (gd *GatewayDeploy) instrumentAPI(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(recorder, r)
+		gd.metrics.apiRequests.inc(r.Method, strconv.Itoa(recorder.status))
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("metrics", func() {
+
+	It("should write histograms in Prometheus format", func() {
+
+		h := newHistogram("test_duration_seconds", "Test durations.", []float64{.1, 1})
+		h.observe(.05)
+		h.observe(.5)
+		h.observe(5)
+
+		var buf bytes.Buffer
+		h.write(&buf)
+		Expect(buf.String()).To(Equal(`# HELP test_duration_seconds Test durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+`))
+	})
+
+	It("should write labeled counters in Prometheus format", func() {
+
+		c := newCounter("test_total", "Test counter.", "cause", "code")
+		c.inc("http_status", "500")
+		c.inc("http_status", "500")
+		c.inc("say \"hi\"", "")
+
+		var buf bytes.Buffer
+		c.write(&buf)
+		Expect(buf.String()).To(Equal(`# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{cause="http_status",code="500"} 2
+test_total{cause="say \"hi\"",code=""} 1
+`))
+	})
+
+	It("should expose download and API metrics", func() {
+
+		checksumDownloadInvalid("crc32")
+
+		res, err := http.Get(testServer.URL + deploymentsEndpoint)
+		Expect(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+
+		res, err = http.Get(testServer.URL + metricsEndpoint)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(`gatewaydeploy_bundle_download_failures_total{cause="checksum",code=""}`))
+		Expect(string(body)).To(ContainSubstring(`gatewaydeploy_api_requests_total{method="GET",code="200"}`))
+		Expect(string(body)).To(ContainSubstring("gatewaydeploy_download_queue_depth 0"))
+		Expect(string(body)).To(ContainSubstring("# TYPE gatewaydeploy_bundle_download_duration_seconds histogram"))
+	})
+})
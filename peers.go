@@ -0,0 +1,238 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	peerBundlesEndpoint = "/deployments/peer/bundles/{checksumType}/{checksum}"
+	peerClusterHeader   = "X-Apid-Cluster-Id"
+)
+
+const (
+	PEER_DOWNLOAD_HIT  = "hit"  // a peer served the bundle
+	PEER_DOWNLOAD_MISS = "miss" // no peer could serve the bundle
+)
+
+var errNoPeers = errors.New("no peer has the bundle")
+
+// peerDiscovery finds the base URLs of the other apid instances of the cluster from a static list and from a
+// directory shared by the instances, in which each instance advertises its URL in a file named by its instance id
+type peerDiscovery struct {
+	static []string
+	dir    string
+	self   string // instance id
+	token  string // shared by the instances of the cluster to fetch bundles from each other
+}
+
+func (p peerDiscovery) enabled() bool {
+	return len(p.static) > 0 || p.dir != ""
+}
+
+// advertise() publishes this instance's URL in the shared directory
+func (p peerDiscovery) advertise(selfURL string) error {
+	if p.dir == "" {
+		return nil
+	}
+	if selfURL == "" {
+		return fmt.Errorf("%s is required with %s", configPeerURL, configPeerDir)
+	}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return fmt.Errorf("unable to create peer dir %s: %v", p.dir, err)
+	}
+	file := path.Join(p.dir, p.self)
+	if err := ioutil.WriteFile(file, []byte(selfURL), 0644); err != nil {
+		return fmt.Errorf("unable to advertise in peer dir %s: %v", p.dir, err)
+	}
+	return nil
+}
+
+// peers() returns the URLs of the other instances
+func (p peerDiscovery) peers() []string {
+	urls := append([]string(nil), p.static...)
+	if p.dir == "" {
+		return urls
+	}
+	files, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		log.Warnf("unable to read peer dir %s: %v", p.dir, err)
+		return urls
+	}
+	for _, f := range files {
+		if f.IsDir() || f.Name() == p.self {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(p.dir, f.Name()))
+		if err != nil {
+			log.Warnf("unable to read peer %s: %v", f.Name(), err)
+			continue
+		}
+		if u := strings.TrimSpace(string(b)); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// initPeerAuth() sets the token peers authenticate with. As API clients can't fetch bundles, peers need a token
+// of their own whenever the deployments API requires authentication.
+func (gd *GatewayDeploy) initPeerAuth(token string) error {
+	gd.bundlePeers.token = token
+	if token != "" || !gd.bundlePeers.enabled() {
+		return nil
+	}
+	if gd.apiAuth.enabled() {
+		return fmt.Errorf("%s is required with %s or %s when the deployments API requires authentication",
+			configPeerToken, configPeers, configPeerDir)
+	}
+	log.Warnf("Bundles are served to peers without authentication, set %s to require it", configPeerToken)
+	return nil
+}
+
+func (gd *GatewayDeploy) initPeersAPI() {
+	gd.services.API().HandleFunc(peerBundlesEndpoint,
+		gd.instrumentAPI(gd.apiGetPeerBundle)).Methods("GET")
+}
+
+// authenticatePeer() returns true if the request carries the peer token or, if the deployments API doesn't
+// require authentication, there is none
+func (gd *GatewayDeploy) authenticatePeer(r *http.Request) bool {
+	if gd.bundlePeers.token == "" {
+		return !gd.apiAuth.enabled()
+	}
+	authorization := r.Header.Get("Authorization")
+	return strings.HasPrefix(authorization, "Bearer ") &&
+		tokenEquals(strings.TrimPrefix(authorization, "Bearer "), gd.bundlePeers.token)
+}
+
+// apiGetPeerBundle() serves a locally stored bundle by checksum to peers of the same cluster
+func (gd *GatewayDeploy) apiGetPeerBundle(w http.ResponseWriter, r *http.Request) {
+
+	if !gd.authenticatePeer(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, API_ERR_UNAUTHORIZED, "peer token required")
+		return
+	}
+	if r.Header.Get(peerClusterHeader) != gd.apidClusterID {
+		writeError(w, http.StatusNotFound, API_ERR_BAD_CONTENT, "no such bundle")
+		return
+	}
+
+	vars := gd.services.API().Vars(r)
+	file, err := gd.findBundleByChecksum(vars["checksumType"], vars["checksum"])
+	if err != nil {
+		writeDatabaseError(w)
+		return
+	}
+	if file == "" {
+		writeError(w, http.StatusNotFound, API_ERR_BAD_CONTENT, "no such bundle")
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Warnf("unable to open bundle %s for peer: %v", file, err)
+		writeError(w, http.StatusNotFound, API_ERR_BAD_CONTENT, "no such bundle")
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, f)
+}
+
+// findBundleByChecksum() returns a downloaded bundle file with the checksum, or "" if there is none
+func (gd *GatewayDeploy) findBundleByChecksum(checksumType, checksum string) (string, error) {
+	var file string
+	err := gd.getDB().QueryRow(`
+	SELECT local_bundle_uri FROM (
+		SELECT local_bundle_uri, bundle_checksum_type, bundle_checksum FROM edgex_deployment
+		UNION ALL
+		SELECT local_bundle_uri, bundle_checksum_type, bundle_checksum FROM edgex_deployment_history
+	)
+	WHERE lower(bundle_checksum_type)=lower($1) AND bundle_checksum=$2 AND local_bundle_uri != ''
+	LIMIT 1
+	`, checksumType, checksum).Scan(&file)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		log.Errorf("unable to find bundle by checksum %s: %v", checksum, err)
+	}
+	return file, err
+}
+
+// downloadFromPeers() asks each peer for a deployment's bundle by checksum and returns a verified temp file
+func (gd *GatewayDeploy) downloadFromPeers(dep DataDeployment, hashWriter hash.Hash) (string, error) {
+	if !gd.bundlePeers.enabled() || dep.BundleChecksumType == "" || dep.BundleChecksum == "" {
+		return "", errNoPeers
+	}
+
+	for _, peer := range gd.bundlePeers.peers() {
+		hashWriter.Reset()
+		tempFile, err := gd.downloadFromPeer(peer, dep, hashWriter)
+		if err == nil {
+			log.Debugf("bundle for %s downloaded from peer %s", dep.ID, peer)
+			gd.metrics.peerDownloads.inc(PEER_DOWNLOAD_HIT)
+			return tempFile, nil
+		}
+		if tempFile != "" {
+			go safeDelete(tempFile)
+		}
+		log.Debugf("peer %s unable to provide bundle for %s: %v", peer, dep.ID, err)
+	}
+	gd.metrics.peerDownloads.inc(PEER_DOWNLOAD_MISS)
+	return "", errNoPeers
+}
+
+func (gd *GatewayDeploy) downloadFromPeer(peer string, dep DataDeployment, hashWriter hash.Hash) (string, error) {
+
+	uri := fmt.Sprintf("%s/deployments/peer/bundles/%s/%s", strings.TrimSuffix(peer, "/"),
+		strings.ToLower(dep.BundleChecksumType), dep.BundleChecksum)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(peerClusterHeader, gd.apidClusterID)
+	if gd.bundlePeers.token != "" {
+		req.Header.Set("Authorization", "Bearer "+gd.bundlePeers.token)
+	}
+
+	ctx, cancel := context.WithTimeout(gd.lifecycle.ctx, gd.bundleDownloadConnTimeout)
+	defer cancel()
+	res, err := gd.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", httpStatusError{uri, res.StatusCode}
+	}
+
+	tempFile, _, err := gd.writeBundleTempFile(res.Body, hashWriter, dep.BundleChecksum)
+	return tempFile, err
+}
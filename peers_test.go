@@ -0,0 +1,173 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("peers", func() {
+
+	const content = "peer bundle content"
+
+	var checksum string
+
+	BeforeEach(func() {
+		hashWriter, err := getHashWriter("crc32")
+		Expect(err).ShouldNot(HaveOccurred())
+		hashWriter.Write([]byte(content))
+		checksum = hex.EncodeToString(hashWriter.Sum(nil))
+	})
+
+	var saveAuth apiAuthConfig
+
+	BeforeEach(func() {
+		saveAuth = gd.apiAuth
+	})
+
+	AfterEach(func() {
+		gd.bundlePeers = peerDiscovery{}
+		gd.apiAuth = saveAuth
+	})
+
+	// inserts a deployment whose bundle has been downloaded
+	insertDownloaded := func(depID string) {
+		bundleFile := path.Join(gd.bundlePath, depID)
+		Expect(ioutil.WriteFile(bundleFile, []byte(content), 0600)).To(Succeed())
+		tx, err := gd.getDB().Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(InsertDeployment(tx, DataDeployment{
+			ID:                 depID,
+			DataScopeID:        depID,
+			LocalBundleURI:     bundleFile,
+			BundleChecksumType: "crc32",
+			BundleChecksum:     checksum,
+		})).To(Succeed())
+		Expect(tx.Commit()).To(Succeed())
+	}
+
+	getPeerBundleWithToken := func(cluster, token string) *http.Response {
+		req, err := http.NewRequest("GET", testServer.URL+"/deployments/peer/bundles/crc32/"+checksum, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Set(peerClusterHeader, cluster)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		return res
+	}
+
+	getPeerBundle := func(cluster string) *http.Response {
+		return getPeerBundleWithToken(cluster, "")
+	}
+
+	It("should discover peers from a static list and a shared directory", func() {
+		dir, err := ioutil.TempDir("", "peers_test")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		Expect(ioutil.WriteFile(path.Join(dir, "other"), []byte("http://other:9000\n"), 0644)).To(Succeed())
+		discovery := peerDiscovery{static: []string{"http://static:9000"}, dir: dir, self: gd.apidInstanceID}
+		Expect(discovery.advertise("")).Should(HaveOccurred())
+		Expect(discovery.advertise("http://self:9000")).To(Succeed())
+
+		Expect(discovery.peers()).To(ConsistOf("http://static:9000", "http://other:9000"))
+	})
+
+	It("should serve bundles by checksum to peers of the cluster", func() {
+		insertDownloaded("peer_serve")
+
+		res := getPeerBundle(gd.apidClusterID)
+		defer res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(body)).To(Equal(content))
+
+		other := getPeerBundle("OTHER_CLUSTER")
+		other.Body.Close()
+		Expect(other.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should only serve bundles to peers with the peer token", func() {
+		insertDownloaded("peer_token")
+		gd.bundlePeers.token = "peer-secret"
+
+		for _, token := range []string{"", "wrong"} {
+			res := getPeerBundleWithToken(gd.apidClusterID, token)
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		}
+
+		res := getPeerBundleWithToken(gd.apidClusterID, "peer-secret")
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should not serve bundles to API clients", func() {
+		insertDownloaded("peer_api_client")
+		gd.apiAuth = apiAuthConfig{token: "shared-secret"}
+
+		res := getPeerBundleWithToken(gd.apidClusterID, "shared-secret")
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should require the peer token with peers if the API requires authentication", func() {
+		gd.apiAuth = apiAuthConfig{token: "shared-secret"}
+		gd.bundlePeers = peerDiscovery{static: []string{"http://other:9000"}}
+		Expect(gd.initPeerAuth("")).Should(HaveOccurred())
+		Expect(gd.initPeerAuth("peer-secret")).To(Succeed())
+
+		gd.apiAuth = apiAuthConfig{}
+		Expect(gd.initPeerAuth("")).To(Succeed())
+	})
+
+	It("should download from a peer before the origin", func() {
+		insertDownloaded("peer_source")
+		gd.bundlePeers = peerDiscovery{static: []string{"http://127.0.0.1:1", testServer.URL}, token: "peer-secret"}
+
+		// the origin is unreachable, so the bundle can only come from the peer
+		dep := insertBundleDeployment(gd.getDB(), "peer_download", "http://127.0.0.1:1/bundles/peer_download", checksum)
+
+		gd.queueDownloadRequest(dep)
+
+		var bundleFile string
+		Eventually(func() string {
+			deployments, err := gd.getDeployments("WHERE id=$1", dep.ID)
+			Expect(err).ShouldNot(HaveOccurred())
+			bundleFile = deployments[0].LocalBundleURI
+			return bundleFile
+		}, 2).ShouldNot(BeEmpty())
+		b, err := ioutil.ReadFile(bundleFile)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(b)).To(Equal(content))
+
+		res, err := http.Get(testServer.URL + metricsEndpoint)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		metricsText, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(metricsText)).To(ContainSubstring(`gatewaydeploy_peer_bundle_downloads_total{outcome="hit"}`))
+	})
+})
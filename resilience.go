@@ -0,0 +1,222 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "CLOSED"    // calls go through
+	BREAKER_OPEN      = "OPEN"      // calls are refused until the open duration has passed
+	BREAKER_HALF_OPEN = "HALF_OPEN" // a single trial call decides whether to close or reopen
+)
+
+const (
+	BREAKER_TRACKER  = "tracker"
+	BREAKER_DOWNLOAD = "download"
+)
+
+const breakersEndpoint = "/deployments/breakers"
+
+// createBackoff() returns a func that sleeps between retries, doubling the delay up to maxBackOff. Each sleep
+// is jittered between half and all of the delay so that callers failing together don't retry together. Sleeps
+// end early when shutdown abandons work in progress.
+func (gd *GatewayDeploy) createBackoff(retryIn, maxBackOff time.Duration) func() {
+	return func() {
+		sleep := jitter(retryIn)
+		log.Debugf("backoff called. will retry in %s.", sleep)
+		gd.lifecycle.sleep(sleep)
+		retryIn = retryIn * time.Duration(2)
+		if retryIn > maxBackOff {
+			retryIn = maxBackOff
+		}
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// circuitBreaker stops calls to an endpoint after consecutive failures
+type circuitBreaker struct {
+	sync.Mutex
+	registry    *breakerRegistry
+	name        string
+	state       string
+	failures    int
+	openedAt    time.Time
+	trialActive bool
+	lastFailure string
+}
+
+type breakerRegistry struct {
+	sync.Mutex
+	clock            Clock
+	failureThreshold int           // consecutive failures that open a breaker
+	openDuration     time.Duration // before a trial call
+	breakers         map[string]*circuitBreaker
+}
+
+func newBreakerRegistry(clock Clock, failureThreshold int, openDuration time.Duration) *breakerRegistry {
+	return &breakerRegistry{
+		clock:            clock,
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		breakers:         make(map[string]*circuitBreaker),
+	}
+}
+
+// sent by api
+type apiBreaker struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	Failures    int    `json:"failures"`
+	OpenedAt    string `json:"openedAt,omitempty"`
+	RetryAt     string `json:"retryAt,omitempty"`
+	LastFailure string `json:"lastFailure,omitempty"`
+}
+
+// get() returns the breaker for kind calls to the host of uri, creating it as closed
+func (r *breakerRegistry) get(kind, uri string) *circuitBreaker {
+	name := kind
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		name += ":" + u.Host
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	b := r.breakers[name]
+	if b == nil {
+		b = &circuitBreaker{registry: r, name: name, state: BREAKER_CLOSED}
+		r.breakers[name] = b
+	}
+	return b
+}
+
+func (r *breakerRegistry) report() []apiBreaker {
+	r.Lock()
+	list := make([]*circuitBreaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		list = append(list, b)
+	}
+	r.Unlock()
+
+	report := make([]apiBreaker, 0, len(list))
+	for _, b := range list {
+		report = append(report, b.report())
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+	return report
+}
+
+func (r *breakerRegistry) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.breakers = make(map[string]*circuitBreaker)
+}
+
+// allow() reports whether a call may be made. Once the open duration has passed, a single trial call is
+// allowed; its result must be reported with success() or failure().
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BREAKER_OPEN:
+		if b.registry.clock.Now().Sub(b.openedAt) < b.registry.openDuration {
+			return false
+		}
+		log.Infof("circuit breaker %s half-open, trying a call", b.name)
+		b.state = BREAKER_HALF_OPEN
+		b.trialActive = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if b.trialActive {
+			return false
+		}
+		b.trialActive = true
+	}
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state != BREAKER_CLOSED {
+		log.Infof("circuit breaker %s closed", b.name)
+	}
+	b.state = BREAKER_CLOSED
+	b.failures = 0
+	b.trialActive = false
+}
+
+func (b *circuitBreaker) failure(cause string) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.lastFailure = cause
+	b.trialActive = false
+	if b.state == BREAKER_HALF_OPEN || (b.state == BREAKER_CLOSED && b.failures >= b.registry.failureThreshold) {
+		log.Warnf("circuit breaker %s opened after %d failures: %s", b.name, b.failures, cause)
+		b.state = BREAKER_OPEN
+		b.openedAt = b.registry.clock.Now()
+	}
+}
+
+func (b *circuitBreaker) report() apiBreaker {
+	b.Lock()
+	defer b.Unlock()
+
+	r := apiBreaker{
+		Name:        b.name,
+		State:       b.state,
+		Failures:    b.failures,
+		LastFailure: b.lastFailure,
+	}
+	if b.state != BREAKER_CLOSED {
+		r.OpenedAt = formatHealthTime(b.openedAt)
+		r.RetryAt = formatHealthTime(b.openedAt.Add(b.registry.openDuration))
+	}
+	return r
+}
+
+// breakers are available before a DB has been set, unlike InitAPI()
+func (gd *GatewayDeploy) initBreakersAPI() {
+	gd.services.API().HandleFunc(breakersEndpoint, gd.authorize(PERMISSION_ADMIN, gd.apiGetBreakers)).Methods("GET")
+}
+
+func (gd *GatewayDeploy) apiGetBreakers(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(gd.breakers.report())
+	if err != nil {
+		log.Errorf("unable to marshal circuit breakers: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
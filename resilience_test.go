@@ -0,0 +1,186 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("resilience", func() {
+
+	var savedThreshold int
+	var savedOpenDuration time.Duration
+
+	BeforeEach(func() {
+		savedThreshold, savedOpenDuration = gd.breakers.failureThreshold, gd.breakers.openDuration
+		gd.breakers.failureThreshold = 2
+		gd.breakers.openDuration = 50 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		gd.breakers.failureThreshold, gd.breakers.openDuration = savedThreshold, savedOpenDuration
+		gd.trackerMaxAttempts, gd.downloadMaxAttempts = 0, 0
+		gd.breakers.reset()
+	})
+
+	It("should jitter backoff between half and all of the delay", func() {
+		for i := 0; i < 100; i++ {
+			d := jitter(time.Second)
+			Expect(d).To(BeNumerically(">=", 500*time.Millisecond))
+			Expect(d).To(BeNumerically("<=", time.Second))
+		}
+	})
+
+	It("should open, half-open and close a circuit breaker", func() {
+		b := gd.breakers.get(BREAKER_TRACKER, "http://tracker:1234/clusters")
+		Expect(b.name).To(Equal("tracker:tracker:1234"))
+		Expect(gd.breakers.get(BREAKER_TRACKER, "http://tracker:1234/other")).To(BeIdenticalTo(b))
+
+		Expect(b.allow()).To(BeTrue())
+		b.failure("down")
+		Expect(b.allow()).To(BeTrue())
+		b.failure("down")
+		Expect(b.report().State).To(Equal(BREAKER_OPEN))
+		Expect(b.allow()).To(BeFalse())
+
+		// a failed trial reopens
+		time.Sleep(gd.breakers.openDuration)
+		Expect(b.allow()).To(BeTrue())
+		Expect(b.report().State).To(Equal(BREAKER_HALF_OPEN))
+		Expect(b.allow()).To(BeFalse())
+		b.failure("still down")
+		Expect(b.report().State).To(Equal(BREAKER_OPEN))
+
+		// a successful trial closes
+		time.Sleep(gd.breakers.openDuration)
+		Expect(b.allow()).To(BeTrue())
+		b.success()
+		Expect(b.report()).To(Equal(apiBreaker{Name: b.name, State: BREAKER_CLOSED, LastFailure: "still down"}))
+		Expect(b.allow()).To(BeTrue())
+	})
+
+	It("should give up on the tracker after max attempts and report the open breaker", func() {
+		var calls int32
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		gd.breakers.failureThreshold = 3
+		gd.trackerMaxAttempts = 3
+
+		err = gd.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "x", Status: RESPONSE_STATUS_SUCCESS}})
+		Expect(err).Should(HaveOccurred())
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(3)))
+
+		res, err := http.Get(testServer.URL + breakersEndpoint)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var report []apiBreaker
+		Expect(json.Unmarshal(body, &report)).To(Succeed())
+		trackerURI, _ := url.Parse(tracker.URL)
+		Expect(report).To(HaveLen(1))
+		Expect(report[0].Name).To(Equal(BREAKER_TRACKER + ":" + trackerURI.Host))
+		Expect(report[0].State).To(Equal(BREAKER_OPEN))
+		Expect(report[0].LastFailure).To(Equal("status 503"))
+		Expect(report[0].RetryAt).ToNot(BeEmpty())
+	})
+
+	It("should count attempts refused by an open breaker toward max attempts", func() {
+		var calls int32
+		tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer tracker.Close()
+
+		var err error
+		gd.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		gd.breakers.openDuration = time.Minute
+		gd.trackerMaxAttempts = 4
+
+		err = gd.transmitDeploymentResultsToServer(apiDeploymentResults{{ID: "x", Status: RESPONSE_STATUS_SUCCESS}})
+		Expect(err).Should(HaveOccurred())
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(2)))
+	})
+
+	It("should require the admin permission for the circuit breakers", func() {
+		gd.apiAuth = apiAuthConfig{
+			clients: []apiClient{
+				{Name: "gateway", Token: "gateway-token", Permissions: []string{PERMISSION_READ, PERMISSION_REPORT}},
+				{Name: "operator", Token: "operator-token", Permissions: []string{PERMISSION_ADMIN}},
+			},
+		}
+
+		get := func(token string) int {
+			req, err := http.NewRequest("GET", testServer.URL+breakersEndpoint, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			return res.StatusCode
+		}
+		Expect(get("")).To(Equal(http.StatusUnauthorized))
+		Expect(get("gateway-token")).To(Equal(http.StatusForbidden))
+		Expect(get("operator-token")).To(Equal(http.StatusOK))
+	})
+
+	It("should fail a deployment after max download attempts", func() {
+		gd.markDeploymentFailedAfter = time.Minute
+		gd.breakers.failureThreshold = 10
+		gd.downloadMaxAttempts = 2
+
+		var calls int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+
+		deploymentID := "resilience_download_fail"
+		bundleURI := ts.URL + "/bundles/1"
+		dep := insertBundleDeployment(gd.getDB(), deploymentID, bundleURI, testGetChecksum("crc32", bundleURI))
+
+		gd.queueDownloadRequest(dep)
+
+		Eventually(func() int {
+			deployments, err := gd.getDeployments("WHERE id=$1", deploymentID)
+			Expect(err).ShouldNot(HaveOccurred())
+			return deployments[0].DeployErrorCode
+		}).Should(Equal(TRACKER_ERR_BUNDLE_DOWNLOAD_FAILED))
+		Consistently(func() int32 { return atomic.LoadInt32(&calls) }, 100*time.Millisecond).Should(Equal(int32(2)))
+	})
+})
@@ -0,0 +1,301 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"fmt"
+
+	"github.com/30x/apid-core"
+)
+
+const (
+	ROLLBACK_POLICY_NONE = "none" // failed deployments are left in place
+	ROLLBACK_POLICY_AUTO = "auto" // failed deployments are replaced by the previous known-good deployment
+)
+
+// the deployment history holds copies of downloaded deployments, so their bundles can be served again after
+// ApigeeSync deletes them. A rollback replaces a failed deployment with a deployment from the history.
+func initRollbackTables(db apid.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_deployment_history (
+		id character varying(36) NOT NULL,
+		bundle_config_id varchar(36) NOT NULL,
+		apid_cluster_id varchar(36) NOT NULL,
+		data_scope_id varchar(36) NOT NULL,
+		bundle_config_json text NOT NULL,
+		config_json text NOT NULL,
+		created timestamp without time zone,
+		created_by text,
+		updated timestamp without time zone,
+		updated_by text,
+		bundle_config_name text,
+		bundle_uri text,
+		local_bundle_uri text,
+		bundle_checksum text,
+		bundle_checksum_type text,
+		deploy_status string,
+		deploy_error_code int,
+		deploy_error_message text,
+		known_good boolean,
+		recorded int,
+		PRIMARY KEY (id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_deployment_rollback (
+		deployment_id varchar(36) NOT NULL,
+		rollback_id varchar(36) NOT NULL,
+		PRIMARY KEY (deployment_id)
+	);
+	`)
+	return err
+}
+
+func validRollbackPolicy(policy string) bool {
+	return policy == ROLLBACK_POLICY_NONE || policy == ROLLBACK_POLICY_AUTO
+}
+
+// getHistoryDeployments() is getDeployments() against the deployment history
+func (gd *GatewayDeploy) getHistoryDeployments(where string, a ...interface{}) (
+	deployments []DataDeployment, err error) {
+	rows, err := gd.getDB().Query("SELECT "+deploymentColumns+" FROM edgex_deployment_history "+where, a...)
+	if err != nil {
+		log.Errorf("Error querying edgex_deployment_history: %v", err)
+		return
+	}
+	defer rows.Close()
+	return dataDeploymentsFromRows(rows), nil
+}
+
+// recordBundleHistory() adds a downloaded deployment to the history of its bundle config and removes the
+// oldest deployments and their bundles beyond bundleHistory
+func (gd *GatewayDeploy) recordBundleHistory(dep DataDeployment) error {
+	if gd.bundleHistory == 0 {
+		return nil
+	}
+
+	tx, err := gd.getDB().Begin()
+	if err != nil {
+		log.Errorf("Unable to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT OR REPLACE INTO edgex_deployment_history
+		(`+deploymentColumns+`, known_good, recorded)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20);
+	`,
+		dep.ID, dep.BundleConfigID, dep.ApidClusterID, dep.DataScopeID,
+		dep.BundleConfigJSON, dep.ConfigJSON, dep.Created, dep.CreatedBy,
+		dep.Updated, dep.UpdatedBy, dep.BundleName, dep.BundleURI,
+		dep.LocalBundleURI, dep.BundleChecksum, dep.BundleChecksumType, dep.DeployStatus,
+		dep.DeployErrorCode, dep.DeployErrorMessage, false, gd.clock.Now().UnixNano())
+	if err != nil {
+		log.Errorf("insert into edgex_deployment_history %s failed: %v", dep.ID, err)
+		return err
+	}
+
+	// deployments in use by a rollback are kept
+	rows, err := tx.Query(`
+	SELECT id, local_bundle_uri FROM edgex_deployment_history
+	WHERE bundle_config_id=$1 AND id NOT IN (SELECT rollback_id FROM edgex_deployment_rollback)
+	ORDER BY recorded DESC
+	LIMIT -1 OFFSET $2
+	`, dep.BundleConfigID, gd.bundleHistory)
+	if err != nil {
+		log.Errorf("query edgex_deployment_history for %s failed: %v", dep.BundleConfigID, err)
+		return err
+	}
+	var pruned, prunedFiles []string
+	for rows.Next() {
+		var id, file string
+		if err := rows.Scan(&id, &file); err != nil {
+			rows.Close()
+			log.Errorf("scan edgex_deployment_history failed: %v", err)
+			return err
+		}
+		pruned = append(pruned, id)
+		prunedFiles = append(prunedFiles, file)
+	}
+	rows.Close()
+
+	for _, id := range pruned {
+		if _, err := tx.Exec("DELETE FROM edgex_deployment_history WHERE id=$1", id); err != nil {
+			log.Errorf("delete from edgex_deployment_history %s failed: %v", id, err)
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Unable to commit recordBundleHistory transaction: %v", err)
+		return err
+	}
+
+	for _, file := range prunedFiles {
+		if !gd.bundleInUse(file) {
+			log.Debugf("removing bundle beyond history: %v", file)
+			safeDelete(file)
+		}
+	}
+	return nil
+}
+
+// bundleInUse() returns whether a bundle file is needed by a deployment or the deployment history
+func (gd *GatewayDeploy) bundleInUse(file string) bool {
+	var n int
+	err := gd.getDB().QueryRow(`
+	SELECT (SELECT COUNT(*) FROM edgex_deployment WHERE local_bundle_uri=$1) +
+		(SELECT COUNT(*) FROM edgex_deployment_history WHERE local_bundle_uri=$1)
+	`, file).Scan(&n)
+	if err != nil {
+		log.Errorf("unable to determine if bundle %s is in use: %v", file, err)
+		return true
+	}
+	return n > 0
+}
+
+// markKnownGood() records successful deployments in the history as rollback targets
+func (gd *GatewayDeploy) markKnownGood(results apiDeploymentResults) {
+	if gd.bundleHistory == 0 {
+		return
+	}
+	for _, result := range results {
+		if result.Status != RESPONSE_STATUS_SUCCESS {
+			continue
+		}
+		_, err := gd.getDB().Exec("UPDATE edgex_deployment_history SET known_good=$1 WHERE id=$2", true, result.ID)
+		if err != nil {
+			log.Errorf("update edgex_deployment_history %s known_good failed: %v", result.ID, err)
+		}
+	}
+}
+
+// rollbackFailedDeployments() replaces each failed deployment with the most recent known-good deployment of
+// its bundle config, if the rollback policy is auto
+func (gd *GatewayDeploy) rollbackFailedDeployments(results apiDeploymentResults) {
+	if gd.rollbackPolicy != ROLLBACK_POLICY_AUTO {
+		return
+	}
+
+	var rollbackResults apiDeploymentResults
+	for _, result := range results {
+		if result.Status != RESPONSE_STATUS_FAIL {
+			continue
+		}
+		deployments, err := gd.getDeployments("WHERE id=$1 AND local_bundle_uri != $2", result.ID, "")
+		if err != nil || len(deployments) == 0 {
+			continue
+		}
+		dep := deployments[0]
+
+		previous, err := gd.getHistoryDeployments(`
+		WHERE bundle_config_id=$1 AND id != $2 AND known_good=$3 ORDER BY recorded DESC LIMIT 1
+		`, dep.BundleConfigID, dep.ID, true)
+		if err != nil || len(previous) == 0 {
+			log.Warnf("no known-good deployment of bundle config %s to roll back %s to", dep.BundleConfigID, dep.ID)
+			continue
+		}
+		rollbackTo := previous[0]
+
+		_, err = gd.getDB().Exec(`
+		INSERT OR REPLACE INTO edgex_deployment_rollback (deployment_id, rollback_id) VALUES ($1, $2)
+		`, dep.ID, rollbackTo.ID)
+		if err != nil {
+			log.Errorf("insert into edgex_deployment_rollback %s failed: %v", dep.ID, err)
+			continue
+		}
+
+		log.Infof("rolled back failed deployment %s to %s", dep.ID, rollbackTo.ID)
+		rollbackResults = append(rollbackResults, apiDeploymentResult{
+			ID:        dep.ID,
+			Status:    RESPONSE_STATUS_FAIL,
+			ErrorCode: TRACKER_ERR_DEPLOYMENT_ROLLED_BACK,
+			Message:   fmt.Sprintf("rolled back to deployment %s", rollbackTo.ID),
+		})
+		gd.emitDeploymentEvent(&DeploymentRolledBack{Deployment: dep, RolledBackTo: rollbackTo})
+		gd.notifyDeploymentsChanged(dep.ID)
+	}
+
+	if len(rollbackResults) > 0 {
+		go gd.transmitDeploymentResultsToServer(rollbackResults)
+	}
+}
+
+// applyRollbacks() replaces rolled back deployments with the deployments they were rolled back to
+func (gd *GatewayDeploy) applyRollbacks(deployments []DataDeployment) ([]DataDeployment, error) {
+	if gd.bundleHistory == 0 {
+		return deployments, nil
+	}
+
+	rollbacks := make(map[string]string)
+	rows, err := gd.getDB().Query("SELECT deployment_id, rollback_id FROM edgex_deployment_rollback")
+	if err != nil {
+		log.Errorf("query edgex_deployment_rollback failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var depID, rollbackID string
+		if err := rows.Scan(&depID, &rollbackID); err != nil {
+			log.Errorf("scan edgex_deployment_rollback failed: %v", err)
+			return nil, err
+		}
+		rollbacks[depID] = rollbackID
+	}
+	if len(rollbacks) == 0 {
+		return deployments, nil
+	}
+
+	history, err := gd.getHistoryDeployments("WHERE id IN (SELECT rollback_id FROM edgex_deployment_rollback)")
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]DataDeployment, len(history))
+	for _, d := range history {
+		byID[d.ID] = d
+	}
+
+	included := make(map[string]bool, len(deployments))
+	for _, d := range deployments {
+		included[d.ID] = true
+	}
+
+	var applied []DataDeployment
+	for _, d := range deployments {
+		if rollbackTo, ok := byID[rollbacks[d.ID]]; ok {
+			if !included[rollbackTo.ID] {
+				included[rollbackTo.ID] = true
+				applied = append(applied, rollbackTo)
+			}
+			continue
+		}
+		applied = append(applied, d)
+	}
+	return applied, nil
+}
+
+func (gd *GatewayDeploy) deleteRollback(depID string) error {
+	_, err := gd.getDB().Exec("DELETE FROM edgex_deployment_rollback WHERE deployment_id = $1;", depID)
+	if err != nil {
+		log.Errorf("delete rollback of %s failed: %v", depID, err)
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rollback", func() {
+
+	var saveHistory int
+	var savePolicy string
+
+	BeforeEach(func() {
+		saveHistory, savePolicy = gd.bundleHistory, gd.rollbackPolicy
+		gd.bundleHistory, gd.rollbackPolicy = 2, ROLLBACK_POLICY_AUTO
+	})
+
+	AfterEach(func() {
+		gd.bundleHistory, gd.rollbackPolicy = saveHistory, savePolicy
+	})
+
+	// inserts a downloaded deployment of bundle config "rollback_config" and records it in the history
+	insertDownloaded := func(depID string) DataDeployment {
+		insertTestDeployment(testServer, depID)
+		bundleFile := path.Join(gd.bundlePath, depID)
+		Expect(ioutil.WriteFile(bundleFile, []byte(depID), 0600)).To(Succeed())
+		_, err := gd.getDB().Exec("UPDATE edgex_deployment SET bundle_config_id=$1, local_bundle_uri=$2 WHERE id=$3",
+			"rollback_config", bundleFile, depID)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		deployments, err := gd.getDeployments("WHERE id=$1", depID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(gd.recordBundleHistory(deployments[0])).To(Succeed())
+		return deployments[0]
+	}
+
+	deleteFromSync := func(depID string) {
+		tx, err := gd.getDB().Begin()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deleteDeployment(tx, depID)).To(Succeed())
+		Expect(tx.Commit()).To(Succeed())
+	}
+
+	It("should serve the previous known-good deployment after a failure", func() {
+
+		good := insertDownloaded("rollback_good")
+		Expect(gd.setDeploymentResults(apiDeploymentResults{{ID: good.ID, Status: RESPONSE_STATUS_SUCCESS}})).To(Succeed())
+		deleteFromSync(good.ID)
+
+		events := listenForDeploymentEvents("rollback_bad")
+		bad := insertDownloaded("rollback_bad")
+		Expect(gd.setDeploymentResults(apiDeploymentResults{
+			{ID: bad.ID, Status: RESPONSE_STATUS_FAIL, ErrorCode: 1, Message: "broken"},
+		})).To(Succeed())
+
+		deployments, err := gd.getReadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deployments).To(HaveLen(1))
+		Expect(deployments[0].ID).To(Equal(good.ID))
+		Expect(deployments[0].LocalBundleURI).To(Equal(good.LocalBundleURI))
+
+		Eventually(events).Should(Receive(BeAssignableToTypeOf(&DeploymentRolledBack{})))
+	})
+
+	It("should not roll back without a known-good deployment", func() {
+
+		insertDownloaded("rollback_untested")
+		deleteFromSync("rollback_untested")
+
+		bad := insertDownloaded("rollback_no_target")
+		Expect(gd.setDeploymentResults(apiDeploymentResults{
+			{ID: bad.ID, Status: RESPONSE_STATUS_FAIL, ErrorCode: 1, Message: "broken"},
+		})).To(Succeed())
+
+		deployments, err := gd.getReadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deployments).To(HaveLen(1))
+		Expect(deployments[0].ID).To(Equal(bad.ID))
+	})
+
+	It("should delete bundles beyond the history", func() {
+
+		oldest := insertDownloaded("rollback_oldest")
+		deleteFromSync(oldest.ID)
+		older := insertDownloaded("rollback_older")
+		deleteFromSync(older.ID)
+		insertDownloaded("rollback_newest")
+
+		_, err := os.Stat(oldest.LocalBundleURI)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = os.Stat(older.LocalBundleURI)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+})
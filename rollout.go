@@ -0,0 +1,305 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/30x/apid-core"
+)
+
+// gateways send their labels as comma separated name=value pairs to match rollout selectors
+const gatewayLabelsHeader = "X-Gateway-Labels"
+
+const (
+	defaultRolloutStep               = 25
+	defaultRolloutSuccessesToAdvance = 1
+	defaultRolloutMaxFailures        = 1
+)
+
+// optional "rollout" of the deployment configuration. A deployment with a rollout is only sent to gateways that
+// match Selector and fall within the current percentage. The percentage starts at Percentage (or Step) and grows
+// by Step once SuccessesToAdvance more gateways report SUCCESS, until MaxFailures more gateways report FAIL during a
+// step and halt it. Each gateway counts once, by its latest result.
+type deploymentRollout struct {
+	Percentage         int               `json:"percentage"`
+	Selector           map[string]string `json:"selector"`
+	Step               int               `json:"step"`
+	SuccessesToAdvance int               `json:"successesToAdvance"`
+	MaxFailures        int               `json:"maxFailures"`
+}
+
+// the rollout of a deployment as of a point in time
+type rolloutView struct {
+	rollout    *deploymentRollout
+	percentage int
+	halted     bool
+}
+
+// a gateway polling for deployments, from its request headers
+type gatewayIdentity struct {
+	ID     string
+	Labels map[string]string
+}
+
+// successes and failures are the numbers of gateways whose latest result was SUCCESS and FAIL when the current
+// step started
+func initRolloutTable(db apid.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_deployment_rollout (
+		deployment_id varchar(36) NOT NULL,
+		percentage int,
+		successes int,
+		failures int,
+		halted boolean,
+		PRIMARY KEY (deployment_id)
+	);
+	`)
+	return err
+}
+
+func gatewayFromRequest(r *http.Request) gatewayIdentity {
+	gw := gatewayIdentity{
+		ID:     r.Header.Get(gatewayIDHeader),
+		Labels: make(map[string]string),
+	}
+	for _, label := range strings.Split(r.Header.Get(gatewayLabelsHeader), ",") {
+		if kv := strings.SplitN(strings.TrimSpace(label), "=", 2); len(kv) == 2 {
+			gw.Labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return gw
+}
+
+// parseRollout() returns the rollout of a deployment configuration, or nil if it has none
+func parseRollout(configJSON string) *deploymentRollout {
+	var config struct {
+		Rollout *deploymentRollout `json:"rollout"`
+	}
+	if configJSON == "" || json.Unmarshal([]byte(configJSON), &config) != nil || config.Rollout == nil {
+		return nil
+	}
+	r := config.Rollout
+	if r.Step <= 0 {
+		r.Step = defaultRolloutStep
+	}
+	if r.Percentage <= 0 {
+		// a selector alone targets all matching gateways
+		if len(r.Selector) > 0 {
+			r.Percentage = 100
+		} else {
+			r.Percentage = r.Step
+		}
+	}
+	if r.SuccessesToAdvance <= 0 {
+		r.SuccessesToAdvance = defaultRolloutSuccessesToAdvance
+	}
+	if r.MaxFailures <= 0 {
+		r.MaxFailures = defaultRolloutMaxFailures
+	}
+	return r
+}
+
+// includes() returns whether a gateway should be sent the deployment
+func (v *rolloutView) includes(depID string, gw gatewayIdentity) bool {
+	if v == nil {
+		return true
+	}
+	for name, value := range v.rollout.Selector {
+		if gw.Labels[name] != value {
+			return false
+		}
+	}
+	if v.percentage >= 100 {
+		return true
+	}
+	if gw.ID == "" {
+		return false
+	}
+	return rolloutBucket(depID, gw.ID) < v.percentage
+}
+
+// rolloutBucket() deterministically places a gateway in [0, 100) for a deployment
+func rolloutBucket(depID, gatewayID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(depID + "/" + gatewayID))
+	return int(h.Sum32() % 100)
+}
+
+// getRolloutViews() returns the current rollout of each of the deployments that has one
+func (gd *GatewayDeploy) getRolloutViews(deployments []DataDeployment) (map[string]*rolloutView, error) {
+
+	views := make(map[string]*rolloutView)
+	for _, d := range deployments {
+		if rollout := parseRollout(d.ConfigJSON); rollout != nil {
+			views[d.ID] = &rolloutView{rollout: rollout, percentage: rollout.Percentage}
+		}
+	}
+	if len(views) == 0 {
+		return views, nil
+	}
+
+	rows, err := gd.getDB().Query("SELECT deployment_id, percentage, halted FROM edgex_deployment_rollout")
+	if err != nil {
+		log.Errorf("query edgex_deployment_rollout failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var depID string
+		var percentage int
+		var halted bool
+		if err := rows.Scan(&depID, &percentage, &halted); err != nil {
+			log.Errorf("scan edgex_deployment_rollout failed: %v", err)
+			return nil, err
+		}
+		if v, ok := views[depID]; ok {
+			v.percentage, v.halted = percentage, halted
+		}
+	}
+	return views, rows.Err()
+}
+
+// filterDeploymentsForGateway() returns only the deployments rolled out to the gateway
+func filterDeploymentsForGateway(gw gatewayIdentity, deployments []DataDeployment, views map[string]*rolloutView) []DataDeployment {
+	if len(views) == 0 {
+		return deployments
+	}
+	var filtered []DataDeployment
+	for _, d := range deployments {
+		if views[d.ID].includes(d.ID, gw) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// updateRollouts() advances or halts the rollouts of deployments with the results reported by gateways
+func (gd *GatewayDeploy) updateRollouts(results apiDeploymentResults) error {
+
+	rollouts := make(map[string]*deploymentRollout)
+	for _, result := range results {
+		deployments, err := gd.getDeployments("WHERE id=$1", result.ID)
+		if err != nil {
+			return err
+		}
+		if len(deployments) > 0 {
+			if rollout := parseRollout(deployments[0].ConfigJSON); rollout != nil {
+				rollouts[result.ID] = rollout
+			}
+		}
+	}
+	if len(rollouts) == 0 {
+		return nil
+	}
+
+	tx, err := gd.getDB().Begin()
+	if err != nil {
+		log.Errorf("Unable to begin transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var changed []string
+	for depID, rollout := range rollouts {
+		advanced, err := updateRollout(tx, depID, rollout)
+		if err != nil {
+			return err
+		}
+		if advanced {
+			changed = append(changed, depID)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Unable to commit updateRollouts transaction: %v", err)
+		return err
+	}
+
+	for _, depID := range changed {
+		gd.notifyDeploymentsChanged(depID)
+	}
+	return nil
+}
+
+// updateRollout() advances or halts a rollout by the latest gateway results of the deployment, and returns true if
+// it was advanced to more gateways
+func updateRollout(tx *sql.Tx, depID string, rollout *deploymentRollout) (bool, error) {
+
+	percentage, stepSuccesses, stepFailures, halted := rollout.Percentage, 0, 0, false
+	err := tx.QueryRow(`
+	SELECT percentage, successes, failures, halted FROM edgex_deployment_rollout WHERE deployment_id=$1
+	`, depID).Scan(&percentage, &stepSuccesses, &stepFailures, &halted)
+	if err != nil && err != sql.ErrNoRows {
+		log.Errorf("query edgex_deployment_rollout for %s failed: %v", depID, err)
+		return false, err
+	}
+
+	if halted || percentage >= 100 {
+		return false, nil
+	}
+
+	// each gateway has one result, its latest
+	var successes, failures int
+	err = tx.QueryRow(`
+	SELECT
+		COALESCE(SUM(CASE WHEN deploy_status = $1 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN deploy_status = $2 THEN 1 ELSE 0 END), 0)
+	FROM edgex_deployment_gateway_result WHERE deployment_id = $3
+	`, RESPONSE_STATUS_SUCCESS, RESPONSE_STATUS_FAIL, depID).Scan(&successes, &failures)
+	if err != nil {
+		log.Errorf("count edgex_deployment_gateway_result for %s failed: %v", depID, err)
+		return false, err
+	}
+
+	advanced := false
+	switch {
+	case failures-stepFailures >= rollout.MaxFailures:
+		halted = true
+		log.Warnf("rollout of deployment %s halted at %d%% after %d failed gateways", depID, percentage,
+			failures-stepFailures)
+	case successes-stepSuccesses >= rollout.SuccessesToAdvance:
+		percentage += rollout.Step
+		if percentage > 100 {
+			percentage = 100
+		}
+		stepSuccesses, stepFailures = successes, failures
+		advanced = true
+		log.Infof("rollout of deployment %s advanced to %d%%", depID, percentage)
+	}
+
+	_, err = tx.Exec(`
+	INSERT OR REPLACE INTO edgex_deployment_rollout (deployment_id, percentage, successes, failures, halted)
+	VALUES ($1, $2, $3, $4, $5)
+	`, depID, percentage, stepSuccesses, stepFailures, halted)
+	if err != nil {
+		log.Errorf("update edgex_deployment_rollout for %s failed: %v", depID, err)
+		return false, err
+	}
+	return advanced, nil
+}
+
+func (gd *GatewayDeploy) deleteRollout(depID string) error {
+	_, err := gd.getDB().Exec("DELETE FROM edgex_deployment_rollout WHERE deployment_id = $1;", depID)
+	if err != nil {
+		log.Errorf("delete rollout of %s failed: %v", depID, err)
+	}
+	return err
+}
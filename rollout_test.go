@@ -0,0 +1,182 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rollout", func() {
+
+	It("should select gateways by label and percentage", func() {
+
+		view := &rolloutView{
+			rollout:    &deploymentRollout{Selector: map[string]string{"region": "east"}},
+			percentage: 100,
+		}
+		Expect(view.includes("dep", gatewayIdentity{Labels: map[string]string{"region": "east"}})).To(BeTrue())
+		Expect(view.includes("dep", gatewayIdentity{Labels: map[string]string{"region": "west"}})).To(BeFalse())
+
+		view = &rolloutView{rollout: &deploymentRollout{}, percentage: 50}
+		Expect(view.includes("dep", gatewayIdentity{})).To(BeFalse())
+		included := 0
+		for i := 0; i < 1000; i++ {
+			if view.includes("dep", gatewayIdentity{ID: fmt.Sprintf("gw-%d", i)}) {
+				included++
+			}
+		}
+		Expect(included).To(BeNumerically("~", 500, 100))
+
+		var nilView *rolloutView
+		Expect(nilView.includes("dep", gatewayIdentity{})).To(BeTrue())
+	})
+
+	It("should parse gateway labels from the request", func() {
+		r, err := http.NewRequest("GET", deploymentsEndpoint, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		r.Header.Set(gatewayIDHeader, "gw-1")
+		r.Header.Set(gatewayLabelsHeader, "region=east, tier = 1,bogus")
+		Expect(gatewayFromRequest(r)).To(Equal(gatewayIdentity{
+			ID:     "gw-1",
+			Labels: map[string]string{"region": "east", "tier": "1"},
+		}))
+	})
+
+	Context("API", func() {
+
+		// two gateways, the first of which is within percentage
+		var first, second string
+		var percentage int
+
+		setRollout := func(depID string, rollout deploymentRollout) {
+			insertTestDeployment(testServer, depID)
+			b, err := json.Marshal(map[string]interface{}{"rollout": rollout})
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = gd.getDB().Exec("UPDATE edgex_deployment SET config_json=$1 WHERE id=$2", string(b), depID)
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+
+		pickGateways := func(depID string) {
+			first, second = "gw-a", "gw-b"
+			if rolloutBucket(depID, first) > rolloutBucket(depID, second) {
+				first, second = second, first
+			}
+			Expect(rolloutBucket(depID, first)).To(BeNumerically("<", rolloutBucket(depID, second)))
+			percentage = rolloutBucket(depID, first) + 1
+		}
+
+		getAs := func(gatewayID string) ApiDeploymentResponse {
+			req, err := http.NewRequest("GET", testServer.URL+deploymentsEndpoint, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set(gatewayIDHeader, gatewayID)
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer res.Body.Close()
+			var depRes ApiDeploymentResponse
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(json.Unmarshal(body, &depRes)).To(Succeed())
+			return depRes
+		}
+
+		reportAs := func(gatewayID string, result apiDeploymentResult) {
+			payload, err := json.Marshal(apiDeploymentResults{result})
+			Expect(err).ShouldNot(HaveOccurred())
+			req, err := http.NewRequest("PUT", testServer.URL+deploymentsEndpoint, bytes.NewReader(payload))
+			Expect(err).ShouldNot(HaveOccurred())
+			req.Header.Set(gatewayIDHeader, gatewayID)
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		It("should advance on success", func() {
+
+			depID := "rollout_advance"
+			pickGateways(depID)
+			setRollout(depID, deploymentRollout{Percentage: percentage, Step: 100})
+
+			Expect(getAs(first)).To(HaveLen(1))
+			Expect(getAs(second)).To(BeEmpty())
+
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			Expect(getAs(second)).To(HaveLen(1))
+		})
+
+		It("should halt on failures", func() {
+
+			depID := "rollout_halt"
+			pickGateways(depID)
+			setRollout(depID, deploymentRollout{Percentage: percentage, Step: 100, MaxFailures: 1})
+
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_FAIL, ErrorCode: 1, Message: "no"})
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			Expect(getAs(first)).To(HaveLen(1))
+			Expect(getAs(second)).To(BeEmpty())
+		})
+
+		It("should count each gateway once per step", func() {
+
+			depID := "rollout_distinct"
+			pickGateways(depID)
+			setRollout(depID, deploymentRollout{Percentage: percentage, Step: 100, SuccessesToAdvance: 2,
+				MaxFailures: 2})
+
+			// re-reported and flapping results of one gateway
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			Expect(getAs(second)).To(BeEmpty())
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_FAIL, ErrorCode: 1, Message: "no"})
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_FAIL, ErrorCode: 1, Message: "no"})
+			Expect(getAs(first)).To(HaveLen(1))
+			Expect(getAs(second)).To(BeEmpty())
+
+			// a second gateway advances the rollout
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			reportAs("gw-c", apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			Expect(getAs(second)).To(HaveLen(1))
+		})
+
+		It("should reset the counts when the rollout advances", func() {
+
+			depID := "rollout_reset"
+			pickGateways(depID)
+			setRollout(depID, deploymentRollout{Percentage: percentage, Step: 1, MaxFailures: 2})
+
+			// the gateway that advanced the rollout doesn't count again in the next step
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			reportAs(first, apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_SUCCESS})
+			reportAs("gw-c", apiDeploymentResult{ID: depID, Status: RESPONSE_STATUS_FAIL, ErrorCode: 1, Message: "no"})
+
+			var current int
+			var halted bool
+			err := gd.getDB().QueryRow(`
+			SELECT percentage, halted FROM edgex_deployment_rollout WHERE deployment_id=$1
+			`, depID).Scan(&current, &halted)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(current).To(Equal(percentage + 1))
+			Expect(halted).To(BeFalse())
+		})
+	})
+})
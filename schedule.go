@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// optional fields of the deployment configuration. A deployment is only sent to gateways from activateAt
+// (inclusive) until deactivateAt (exclusive), but its bundle is downloaded immediately.
+type deploymentWindow struct {
+	ActivateAt   string `json:"activateAt"`
+	DeactivateAt string `json:"deactivateAt"`
+}
+
+type parsedWindow struct {
+	activateAt   time.Time
+	deactivateAt time.Time
+}
+
+// parseDeploymentWindow() returns the window of a deployment configuration. Configurations that aren't JSON
+// objects have no window.
+func parseDeploymentWindow(configJSON string) (w parsedWindow, err error) {
+	var object map[string]json.RawMessage
+	if json.Unmarshal([]byte(configJSON), &object) != nil {
+		return
+	}
+	var window deploymentWindow
+	if err = json.Unmarshal([]byte(configJSON), &window); err != nil {
+		return parsedWindow{}, fmt.Errorf("bad activation window: %v", err)
+	}
+	if window.ActivateAt != "" {
+		if w.activateAt, err = time.Parse(time.RFC3339, window.ActivateAt); err != nil {
+			return parsedWindow{}, fmt.Errorf("bad activateAt: %v", err)
+		}
+	}
+	if window.DeactivateAt != "" {
+		if w.deactivateAt, err = time.Parse(time.RFC3339, window.DeactivateAt); err != nil {
+			return parsedWindow{}, fmt.Errorf("bad deactivateAt: %v", err)
+		}
+	}
+	return
+}
+
+func (w parsedWindow) contains(t time.Time) bool {
+	if !w.activateAt.IsZero() && t.Before(w.activateAt) {
+		return false
+	}
+	if !w.deactivateAt.IsZero() && !t.Before(w.deactivateAt) {
+		return false
+	}
+	return true
+}
+
+// activeDeployments() returns the deployments within their activation window at t. Deployments with an
+// invalid window are never active; they were reported to the tracker as failed when they were received.
+func activeDeployments(deployments []DataDeployment, t time.Time) []DataDeployment {
+	var active []DataDeployment
+	for _, d := range deployments {
+		w, err := parseDeploymentWindow(d.ConfigJSON)
+		if err == nil && w.contains(t) {
+			active = append(active, d)
+		}
+	}
+	return active
+}
+
+// nextWindowBoundary() returns the first activateAt or deactivateAt of deployments after t
+func nextWindowBoundary(deployments []DataDeployment, t time.Time) (next time.Time) {
+	for _, d := range deployments {
+		w, err := parseDeploymentWindow(d.ConfigJSON)
+		if err != nil {
+			continue
+		}
+		for _, boundary := range []time.Time{w.activateAt, w.deactivateAt} {
+			if boundary.After(t) && (next.IsZero() || boundary.Before(next)) {
+				next = boundary
+			}
+		}
+	}
+	return
+}
+
+// scheduleWindowBoundaries() signals distributeEvents() at each activation window boundary until stop is closed
+func (gd *GatewayDeploy) scheduleWindowBoundaries(stop <-chan struct{}) {
+	for {
+		var timer <-chan time.Time
+		if gd.getDB() != nil {
+			deployments, err := gd.getDeployments("")
+			if err != nil {
+				log.Errorf("unable to get deployments to schedule activation windows: %v", err)
+			} else if next := nextWindowBoundary(deployments, gd.clock.Now()); !next.IsZero() {
+				log.Debugf("next deployment activation window boundary at %s", next)
+				timer = gd.clock.After(next.Sub(gd.clock.Now()))
+			}
+		}
+
+		select {
+		case t := <-timer:
+			select {
+			case gd.windowBoundaryReached <- t:
+			default: // already pending
+			}
+		case <-gd.rescheduleWindows:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (gd *GatewayDeploy) triggerWindowReschedule() {
+	select {
+	case gd.rescheduleWindows <- struct{}{}:
+	default: // already pending
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/30x/apidGatewayDeploy/testutil"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("activation windows", func() {
+
+	windowConfig := func(activateAt, deactivateAt time.Time) string {
+		w := deploymentWindow{}
+		if !activateAt.IsZero() {
+			w.ActivateAt = activateAt.Format(time.RFC3339Nano)
+		}
+		if !deactivateAt.IsZero() {
+			w.DeactivateAt = deactivateAt.Format(time.RFC3339Nano)
+		}
+		b, err := json.Marshal(w)
+		Expect(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("should only include deployments within their window", func() {
+
+		now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+		deployments := []DataDeployment{
+			{ID: "always", ConfigJSON: "{}"},
+			{ID: "active", ConfigJSON: windowConfig(now, now.Add(time.Hour))},
+			{ID: "pending", ConfigJSON: windowConfig(now.Add(time.Minute), time.Time{})},
+			{ID: "expired", ConfigJSON: windowConfig(time.Time{}, now)},
+			{ID: "invalid", ConfigJSON: `{"activateAt": "tomorrow"}`},
+			{ID: "numeric", ConfigJSON: `{"activateAt": 1496318400}`},
+			{ID: "array", ConfigJSON: `["activateAt"]`},
+			{ID: "scalar", ConfigJSON: `"config"`},
+			{ID: "malformed", ConfigJSON: `{"activateAt":`},
+		}
+
+		var active []string
+		for _, d := range activeDeployments(deployments, now) {
+			active = append(active, d.ID)
+		}
+		Expect(active).To(Equal([]string{"always", "active", "array", "scalar", "malformed"}))
+
+		Expect(nextWindowBoundary(deployments, now)).To(Equal(now.Add(time.Minute)))
+		Expect(nextWindowBoundary(deployments, now.Add(time.Minute))).To(Equal(now.Add(time.Hour)))
+		Expect(nextWindowBoundary(deployments, now.Add(time.Hour))).To(BeZero())
+	})
+
+	It("should report an invalid window to the tracker once, when the deployment is received", func() {
+
+		tracker := testutil.NewTracker()
+		defer tracker.Close()
+		other, err := NewGatewayDeploy(gd.services, Options{Store: &dbStore{}})
+		Expect(err).ShouldNot(HaveOccurred())
+		other.store.SetDB(gd.getDB())
+		other.apiServerBaseURI, err = url.Parse(tracker.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		row := common.Row{}
+		row["id"] = &common.ColumnVal{Value: "schedule_invalid"}
+		row["data_scope_id"] = &common.ColumnVal{Value: "schedule_invalid"}
+		row["bundle_config_json"] = &common.ColumnVal{Value: "{}"}
+		row["config_json"] = &common.ColumnVal{Value: `{"activateAt": 1496318400}`}
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{{
+			Operation: common.Insert,
+			Table:     DEPLOYMENT_TABLE,
+			NewRow:    row,
+		}}})
+
+		Eventually(tracker.Accepted).Should(HaveLen(1))
+		var received apiDeploymentResults
+		Expect(json.Unmarshal(tracker.Accepted()[0].Body, &received)).To(Succeed())
+		Expect(received).To(HaveLen(1))
+		Expect(received[0].ID).To(Equal("schedule_invalid"))
+		Expect(received[0].ErrorCode).To(Equal(TRACKER_ERR_DEPLOYMENT_BAD_CONFIG))
+
+		// queued for download all the same
+		Expect(other.downloadQueue).To(HaveLen(1))
+	})
+
+	It("should withhold deployments with an invalid window", func() {
+		insertTestDeployment(testServer, "schedule_withheld")
+		_, err := gd.getDB().Exec("UPDATE edgex_deployment SET config_json=$1 WHERE id=$2",
+			`{"activateAt": "tomorrow"}`, "schedule_withheld")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		deployments, err := gd.getReadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deployments).To(BeEmpty())
+	})
+
+	It("should schedule the windows of a DB set at startup", func() {
+
+		clock := NewFakeClock(time.Now())
+		other, err := NewGatewayDeploy(gd.services, Options{Clock: clock, Store: &dbStore{}})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		// restarted on an existing DB whose bundles are all downloaded
+		deploymentID := "schedule_restart"
+		insertTestDeployment(testServer, deploymentID)
+		_, err = gd.getDB().Exec("UPDATE edgex_deployment SET config_json=$1 WHERE id=$2",
+			windowConfig(clock.Now().Add(time.Hour), time.Time{}), deploymentID)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go other.scheduleWindowBoundaries(stop)
+		Consistently(clock.Waiters, 50*time.Millisecond).Should(BeZero())
+
+		// timers of earlier reschedules stay behind on a FakeClock
+		other.SetDB(gd.getDB())
+		Eventually(clock.Waiters).Should(BeNumerically(">=", 1))
+		clock.Advance(time.Hour)
+		Eventually(other.windowBoundaryReached).Should(Receive())
+	})
+
+	It("should wake long polling clients when a deployment activates", func() {
+
+		deploymentID := "schedule_activate"
+		insertTestDeployment(testServer, deploymentID)
+		activateAt := time.Now().Add(500 * time.Millisecond)
+		_, err := gd.getDB().Exec("UPDATE edgex_deployment SET config_json=$1 WHERE id=$2",
+			windowConfig(activateAt, time.Time{}), deploymentID)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		deployments, err := gd.getReadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deployments).To(BeEmpty())
+
+		// reschedule as a change from ApigeeSync would
+		gd.triggerWindowReschedule()
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s%s?block=5", testServer.URL, deploymentsEndpoint), nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Add("If-None-Match", gd.getETag())
+
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(time.Now()).To(BeTemporally(">=", activateAt))
+		Expect(time.Now()).To(BeTemporally("<", activateAt.Add(time.Second)))
+
+		var depRes ApiDeploymentResponse
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(json.Unmarshal(body, &depRes)).To(Succeed())
+		Expect(depRes).To(HaveLen(1))
+		Expect(depRes[0].ID).To(Equal(deploymentID))
+	})
+})
@@ -0,0 +1,327 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a bundle may carry the schema of its deployments' configuration at the root of its archive
+const bundleSchemaFile = "config.schema.json"
+
+// a location in the configuration, as a JSON pointer, and what is wrong there
+type schemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// jsonSchema supports the JSON Schema keywords type, enum, properties, required, additionalProperties, items,
+// minItems, maxItems, minimum, maximum, minLength, maxLength and pattern. Other keywords are ignored.
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"` // a type name or a list of them
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"` // false or a schema
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+
+	types            []string
+	noAdditional     bool
+	additionalSchema *jsonSchema
+	compiledPattern  *regexp.Regexp
+}
+
+func parseSchema(b []byte) (*jsonSchema, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *jsonSchema) compile() error {
+	switch t := s.Type.(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("type must be a string or list of strings")
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return fmt.Errorf("type must be a string or list of strings")
+	}
+
+	if len(s.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(s.AdditionalProperties, &allowed); err == nil {
+			s.noAdditional = !allowed
+		} else {
+			var err error
+			if s.additionalSchema, err = parseSchema(s.AdditionalProperties); err != nil {
+				return fmt.Errorf("additionalProperties: %v", err)
+			}
+		}
+	}
+
+	if s.Pattern != "" {
+		var err error
+		if s.compiledPattern, err = regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("pattern: %v", err)
+		}
+	}
+
+	for name, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return fmt.Errorf("properties/%s: %v", name, err)
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(); err != nil {
+			return fmt.Errorf("items: %v", err)
+		}
+	}
+	return nil
+}
+
+// validate() returns the violations of the schema by a decoded JSON value. If templated, string values with
+// placeholders aren't checked as they're only known once resolved.
+func (s *jsonSchema) validate(ptr string, v interface{}, templated bool) (violations []schemaViolation) {
+	violate := func(format string, a ...interface{}) {
+		violations = append(violations, schemaViolation{Path: displayPointer(ptr), Message: fmt.Sprintf(format, a...)})
+	}
+
+	if str, ok := v.(string); ok && templated && hasTemplatePlaceholder(str) {
+		return
+	}
+
+	if len(s.types) > 0 && !s.matchesType(v) {
+		violate("expected %s, got %s", strings.Join(s.types, " or "), jsonTypeOf(v))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violate("value is not one of the allowed values")
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				violate("missing required property %s", name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := ptr + "/" + escapePointerToken(name)
+			if p, ok := s.Properties[name]; ok {
+				violations = append(violations, p.validate(child, val[name], templated)...)
+			} else if s.additionalSchema != nil {
+				violations = append(violations, s.additionalSchema.validate(child, val[name], templated)...)
+			} else if s.noAdditional {
+				violations = append(violations, schemaViolation{Path: child, Message: "property is not allowed"})
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(val) < *s.MinItems {
+			violate("expected at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(val) > *s.MaxItems {
+			violate("expected at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range val {
+				violations = append(violations, s.Items.validate(ptr+"/"+strconv.Itoa(i), item, templated)...)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			violate("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			violate("must be at most %v", *s.Maximum)
+		}
+	case string:
+		length := len([]rune(val))
+		if s.MinLength != nil && length < *s.MinLength {
+			violate("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			violate("must be at most %d characters", *s.MaxLength)
+		}
+		if s.compiledPattern != nil && !s.compiledPattern.MatchString(val) {
+			violate("does not match pattern %s", s.Pattern)
+		}
+	}
+	return
+}
+
+func (s *jsonSchema) matchesType(v interface{}) bool {
+	actual := jsonTypeOf(v)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == float64(int64(val)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func escapePointerToken(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+func displayPointer(ptr string) string {
+	if ptr == "" {
+		return "/"
+	}
+	return ptr
+}
+
+// loadConfigSchemas() reads the <bundle type>.json schemas in dir
+func loadConfigSchemas(dir string) (map[string]*jsonSchema, error) {
+	files, err := filepath.Glob(path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	schemas := make(map[string]*jsonSchema, len(files))
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config schema %s: %v", file, err)
+		}
+		s, err := parseSchema(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse config schema %s: %v", file, err)
+		}
+		schemas[strings.TrimSuffix(path.Base(file), ".json")] = s
+	}
+	return schemas, nil
+}
+
+// readBundleSchema() returns the schema in a bundle archive, or nil if there is none
+func readBundleSchema(bundleFile string) (*jsonSchema, error) {
+	archive, err := zip.OpenReader(bundleFile)
+	if err != nil {
+		return nil, nil // not an archive
+	}
+	defer archive.Close()
+
+	for _, f := range archive.File {
+		if f.Name != bundleSchemaFile {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		return parseSchema(b)
+	}
+	return nil, nil
+}
+
+// validateDeploymentConfig() checks the configuration of a deployment against the schema in its bundle or, failing
+// that, the configured schema of its bundle type. If templated, values with placeholders are skipped; they are
+// checked once resolveConfigs() has resolved them.
+func (gd *GatewayDeploy) validateDeploymentConfig(dep DataDeployment, bundleFile string,
+	templated bool) []schemaViolation {
+
+	schema, err := readBundleSchema(bundleFile)
+	if err != nil {
+		return []schemaViolation{{Path: "/", Message: fmt.Sprintf("invalid bundle %s: %v", bundleSchemaFile, err)}}
+	}
+	if schema == nil {
+		var bc bundleConfigJson
+		json.Unmarshal([]byte(dep.BundleConfigJSON), &bc)
+		schema = gd.configSchemas[bc.Type]
+	}
+	if schema == nil {
+		return nil
+	}
+
+	var config interface{}
+	if err := json.Unmarshal([]byte(dep.ConfigJSON), &config); err != nil {
+		return []schemaViolation{{Path: "/", Message: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	return schema.validate("", config, templated)
+}
+
+func schemaViolationsMessage(violations []schemaViolation) string {
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.Path + ": " + v.Message
+	}
+	return "configuration does not match schema: " + strings.Join(msgs, "; ")
+}
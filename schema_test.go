@@ -0,0 +1,174 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/30x/apidGatewayDeploy/testutil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("schema", func() {
+
+	const testSchema = `{
+		"type": "object",
+		"required": ["name", "port"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+			"mode": {"enum": ["fast", "safe"]},
+			"hosts": {"type": "array", "items": {"type": "string", "pattern": "^[a-z.]+$"}}
+		}
+	}`
+
+	validate := func(config string) []schemaViolation {
+		schema, err := parseSchema([]byte(testSchema))
+		Expect(err).ShouldNot(HaveOccurred())
+		var v interface{}
+		Expect(json.Unmarshal([]byte(config), &v)).To(Succeed())
+		return schema.validate("", v, false)
+	}
+
+	It("should accept matching configuration", func() {
+		Expect(validate(`{"name": "a", "port": 80, "mode": "safe", "hosts": ["example.com"]}`)).To(BeEmpty())
+	})
+
+	It("should report violations with their paths", func() {
+		violations := validate(`{"port": 80.5, "mode": "slow", "hosts": ["ok", "NOT OK"], "extra": true}`)
+		paths := make([]string, len(violations))
+		for i, v := range violations {
+			paths[i] = v.Path
+		}
+		Expect(paths).To(ConsistOf("/", "/port", "/mode", "/hosts/1", "/extra"))
+
+		Expect(validate(`[]`)).To(Equal([]schemaViolation{{Path: "/", Message: "expected object, got array"}}))
+	})
+
+	It("should reject invalid schemas", func() {
+		_, err := parseSchema([]byte(`{"type": 1}`))
+		Expect(err).Should(HaveOccurred())
+		_, err = parseSchema([]byte(`{"properties": {"a": {"pattern": "("}}}`))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	Context("download", func() {
+
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "schema_test")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			gd.configSchemas = nil
+			os.RemoveAll(dir)
+		})
+
+		writeBundle := func(schema string) string {
+			bundleFile := path.Join(dir, "bundle.zip")
+			f, err := os.Create(bundleFile)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer f.Close()
+			zw := zip.NewWriter(f)
+			if schema != "" {
+				w, err := zw.Create(bundleSchemaFile)
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = w.Write([]byte(schema))
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			Expect(zw.Close()).To(Succeed())
+			return bundleFile
+		}
+
+		download := func(depID, bundleType, bundleURI, config string) {
+			b, err := ioutil.ReadFile(bundleURI)
+			Expect(err).ShouldNot(HaveOccurred())
+			dep := insertBundleDeployment(gd.getDB(), depID, bundleURI, testutil.Checksum(b))
+
+			bundleJson, err := json.Marshal(bundleConfigJson{Name: depID, URI: bundleURI, Type: bundleType})
+			Expect(err).ShouldNot(HaveOccurred())
+			dep.BundleConfigJSON = string(bundleJson)
+			dep.ConfigJSON = config
+			gd.queueDownloadRequest(dep)
+		}
+
+		It("should fail deployments not matching the schema in their bundle", func() {
+
+			depID := "schema_bundle"
+			events := listenForDeploymentEvents(depID)
+			download(depID, "", writeBundle(testSchema), `{"name": "", "port": 0}`)
+
+			var event interface{}
+			Eventually(events, 2).Should(Receive(&event))
+			failed, ok := event.(*DeploymentFailed)
+			Expect(ok).To(BeTrue())
+			Expect(failed.ErrorCode).To(Equal(TRACKER_ERR_DEPLOYMENT_BAD_CONFIG))
+			Expect(failed.Message).To(ContainSubstring("/name"))
+			Expect(failed.Message).To(ContainSubstring("/port"))
+
+			deployments, err := gd.getDeployments("WHERE id=$1", depID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deployments[0].LocalBundleURI).To(BeEmpty())
+			Expect(deployments[0].DeployStatus).To(Equal(RESPONSE_STATUS_FAIL))
+
+			// not downloaded again on the next start
+			unready, err := gd.getUnreadyDeployments()
+			Expect(err).ShouldNot(HaveOccurred())
+			for _, dep := range unready {
+				Expect(dep.ID).ShouldNot(Equal(depID))
+			}
+		})
+
+		It("should validate against configured schemas by bundle type", func() {
+
+			Expect(ioutil.WriteFile(path.Join(dir, "proxy.json"), []byte(testSchema), 0600)).To(Succeed())
+			var err error
+			gd.configSchemas, err = loadConfigSchemas(dir)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(gd.configSchemas).To(HaveKey("proxy"))
+
+			bundleFile := writeBundle("")
+			Expect(gd.validateDeploymentConfig(DataDeployment{
+				BundleConfigJSON: `{"type": "proxy"}`,
+				ConfigJSON:       `{"name": "a"}`,
+			}, bundleFile, false)).To(Equal([]schemaViolation{{Path: "/", Message: "missing required property port"}}))
+
+			Expect(gd.validateDeploymentConfig(DataDeployment{
+				BundleConfigJSON: `{"type": "other"}`,
+				ConfigJSON:       `{"name": "a"}`,
+			}, bundleFile, false)).To(BeEmpty())
+		})
+
+		It("should not check placeholders of templated configuration", func() {
+
+			bundleFile := writeBundle(testSchema)
+			dep := DataDeployment{ConfigJSON: `{"name": "${name}", "port": "${port}", "mode": "$${mode}"}`}
+
+			Expect(gd.validateDeploymentConfig(dep, bundleFile, false)).To(HaveLen(2))
+			Expect(gd.validateDeploymentConfig(dep, bundleFile, true)).To(Equal([]schemaViolation{
+				{Path: "/mode", Message: "value is not one of the allowed values"},
+			}))
+		})
+	})
+})
@@ -0,0 +1,156 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"github.com/30x/apid-core"
+	"github.com/apigee-labs/transicator/common"
+)
+
+// a row of the data scope table ApigeeSync maintains
+type dataScope struct {
+	ID        string
+	ClusterID string
+	Scope     string
+	Org       string
+	Env       string
+}
+
+// initScopeTables() creates the tables ApigeeSync maintains for data scopes and clusters, for DBs it hasn't
+// delivered them to
+func initScopeTables(db apid.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_apid_cluster (
+		id character varying(36) NOT NULL,
+		name text,
+		description text,
+		umbrella_org_app_name text,
+		created timestamp without time zone,
+		created_by text,
+		updated timestamp without time zone,
+		updated_by text,
+		PRIMARY KEY (id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_data_scope (
+		id character varying(36) NOT NULL,
+		apid_cluster_id character varying(36) NOT NULL,
+		scope text,
+		org text,
+		env text,
+		created timestamp without time zone,
+		created_by text,
+		updated timestamp without time zone,
+		updated_by text,
+		PRIMARY KEY (id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// holds a row once ApigeeSync has delivered the data scope table, even if it's empty
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_data_scope_delivery (
+		delivered integer NOT NULL
+	);
+	`)
+	return err
+}
+
+// markDataScopesDelivered() records that ApigeeSync has delivered the data scope table to db. From then on,
+// deployments are scoped.
+func markDataScopesDelivered(db apid.DB) error {
+	_, err := db.Exec(`
+	INSERT INTO edgex_data_scope_delivery (delivered)
+	SELECT 1 WHERE NOT EXISTS (SELECT 1 FROM edgex_data_scope_delivery)
+	`)
+	return err
+}
+
+// snapshotHasTable() returns true if the snapshot includes any of the tables
+func snapshotHasTable(snapshot *common.Snapshot, tables ...string) bool {
+	for _, t := range snapshot.Tables {
+		for _, name := range tables {
+			if t.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getDataScopes() returns the data scopes by id, leaving out those whose cluster is no longer in the cluster
+// table. scoped is false until ApigeeSync has delivered the data scope table; until then deployments aren't scoped.
+func (gd *GatewayDeploy) getDataScopes() (scopes map[string]dataScope, scoped bool, err error) {
+	db := gd.getDB()
+
+	if err = db.QueryRow("SELECT count(*) > 0 FROM edgex_data_scope_delivery").Scan(&scoped); err != nil || !scoped {
+		return
+	}
+
+	rows, err := db.Query(`
+	SELECT id, apid_cluster_id, COALESCE(scope, ''), COALESCE(org, ''), COALESCE(env, '')
+	FROM edgex_data_scope
+	WHERE NOT EXISTS (SELECT 1 FROM edgex_apid_cluster)
+		OR apid_cluster_id IN (SELECT id FROM edgex_apid_cluster)
+	`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	scopes = make(map[string]dataScope)
+	for rows.Next() {
+		var s dataScope
+		if err = rows.Scan(&s.ID, &s.ClusterID, &s.Scope, &s.Org, &s.Env); err != nil {
+			return
+		}
+		scopes[s.ID] = s
+	}
+	err = rows.Err()
+	return
+}
+
+// scopeDeployments() hides deployments whose data scope has disappeared and adds the org and env of their scope
+// to the others
+func (gd *GatewayDeploy) scopeDeployments(deployments []DataDeployment) ([]DataDeployment, error) {
+	scopes, scoped, err := gd.getDataScopes()
+	if err != nil {
+		log.Errorf("unable to get data scopes: %v", err)
+		return nil, err
+	}
+	if !scoped {
+		return deployments, nil
+	}
+
+	var scopedDeps []DataDeployment
+	for _, dep := range deployments {
+		scope, ok := scopes[dep.DataScopeID]
+		if !ok {
+			log.Debugf("hiding deployment %s of missing data scope %s", dep.ID, dep.DataScopeID)
+			continue
+		}
+		dep.Org = scope.Org
+		dep.Env = scope.Env
+		scopedDeps = append(scopedDeps, dep)
+	}
+	return scopedDeps, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("data scopes", func() {
+
+	insertCluster := func(id string) {
+		_, err := gd.getDB().Exec("INSERT INTO edgex_apid_cluster (id, name) VALUES ($1, $1)", id)
+		Expect(err).ShouldNot(HaveOccurred())
+	}
+
+	// as ApigeeSync applies an insert of the scope
+	insertScope := func(id, clusterID, org, env string) {
+		_, err := gd.getDB().Exec(`
+		INSERT INTO edgex_data_scope (id, apid_cluster_id, scope, org, env) VALUES ($1, $2, $3, $3, $4)
+		`, id, clusterID, org, env)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(markDataScopesDelivered(gd.getDB())).To(Succeed())
+	}
+
+	// as ApigeeSync delivers the delete of the scope
+	deleteScope := func(id string) {
+		_, err := gd.getDB().Exec("DELETE FROM edgex_data_scope WHERE id=$1", id)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		row := common.Row{}
+		row["id"] = &common.ColumnVal{Value: id}
+		gd.processChangeList(&common.ChangeList{Changes: []common.Change{{
+			Operation: common.Delete,
+			Table:     DATA_SCOPE_TABLE,
+			OldRow:    row,
+		}}})
+	}
+
+	getDeployments := func() ApiDeploymentResponse {
+		uri, err := url.Parse(testServer.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		uri.Path = deploymentsEndpoint
+
+		res, err := http.Get(uri.String())
+		Expect(err).ShouldNot(HaveOccurred())
+		defer res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		var depRes ApiDeploymentResponse
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(json.Unmarshal(body, &depRes)).To(Succeed())
+		return depRes
+	}
+
+	ids := func(deps ApiDeploymentResponse) []string {
+		var ids []string
+		for _, dep := range deps {
+			ids = append(ids, dep.ID)
+		}
+		return ids
+	}
+
+	It("should not scope deployments before any data scope is known", func() {
+		insertTestDeployment(testServer, "scopes_unscoped")
+
+		deps := getDeployments()
+		Expect(ids(deps)).To(Equal([]string{"scopes_unscoped"}))
+		Expect(deps[0].Org).To(BeEmpty())
+		Expect(deps[0].Env).To(BeEmpty())
+	})
+
+	It("should return the org and env of each deployment's data scope", func() {
+		insertTestDeployment(testServer, "scopes_prod")
+		insertTestDeployment(testServer, "scopes_test")
+		insertScope("scopes_prod", "cluster", "org", "prod")
+		insertScope("scopes_test", "cluster", "org", "test")
+
+		deps := getDeployments()
+		Expect(ids(deps)).To(ConsistOf("scopes_prod", "scopes_test"))
+		for _, dep := range deps {
+			Expect(dep.Org).To(Equal("org"))
+			Expect(dep.Env).To(Equal(dep.ID[len("scopes_"):]))
+		}
+	})
+
+	It("should hide deployments whose data scope was deleted", func() {
+		insertTestDeployment(testServer, "scopes_kept")
+		insertTestDeployment(testServer, "scopes_deleted")
+		insertScope("scopes_kept", "cluster", "org", "prod")
+
+		Expect(ids(getDeployments())).To(Equal([]string{"scopes_kept"}))
+	})
+
+	It("should hide deployments whose cluster is no longer listed", func() {
+		insertTestDeployment(testServer, "scopes_listed")
+		insertTestDeployment(testServer, "scopes_unlisted")
+		insertCluster("listed")
+		insertScope("scopes_listed", "listed", "org", "prod")
+		insertScope("scopes_unlisted", "unlisted", "org", "prod")
+
+		Expect(ids(getDeployments())).To(Equal([]string{"scopes_listed"}))
+	})
+
+	It("should notify clients when a change list changes data scopes", func() {
+		insertTestDeployment(testServer, "scopes_notify")
+		insertScope("scopes_notify", "cluster", "org", "prod")
+		Expect(getDeployments()).To(HaveLen(1))
+		eTag := gd.getETag()
+
+		deleteScope("scopes_notify")
+		Eventually(gd.getETag).ShouldNot(Equal(eTag))
+		Expect(getDeployments()).To(BeEmpty())
+	})
+
+	It("should hide the deployments of the only data scope when it's deleted", func() {
+		insertTestDeployment(testServer, "scopes_only")
+		insertScope("scopes_only", "cluster", "org", "prod")
+		Expect(ids(getDeployments())).To(Equal([]string{"scopes_only"}))
+
+		deleteScope("scopes_only")
+		Expect(getDeployments()).To(BeEmpty())
+	})
+
+	It("should scope deployments once a snapshot delivers the data scope table", func() {
+		saveDB := gd.getDB()
+		defer SetDB(saveDB)
+
+		snapshot := common.Snapshot{
+			SnapshotInfo: "scopes_snapshot",
+			Tables:       []common.Table{{Name: DATA_SCOPE_TABLE}},
+		}
+		db, err := gd.data.DBVersion(snapshot.SnapshotInfo)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(InitDB(db)).To(Succeed())
+		insertDeploymentToDb(DataDeployment{ID: "scopes_snapshot", DataScopeID: "scopes_snapshot", LocalBundleURI: "x"}, db)
+
+		Expect(gd.switchToSnapshot(&snapshot)).To(Succeed())
+		deployments, err := gd.getReadyDeployments()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deployments).To(BeEmpty())
+	})
+})
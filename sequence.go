@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/30x/apid-core"
+	"github.com/apigee-labs/transicator/common"
+)
+
+// changeSequence orders changes: by commit, then by position within the commit. The zero value is before all
+// changes; changes without a sequence have the zero value and are always processed.
+type changeSequence struct {
+	commit uint64
+	index  uint32
+}
+
+func sequenceOfChange(change common.Change) changeSequence {
+	return changeSequence{change.CommitSequence, change.CommitIndex}
+}
+
+func (s changeSequence) isZero() bool {
+	return s == changeSequence{}
+}
+
+func (s changeSequence) before(other changeSequence) bool {
+	return s.commit < other.commit || (s.commit == other.commit && s.index < other.index)
+}
+
+func (s changeSequence) String() string {
+	return fmt.Sprintf("%d.%d", s.commit, s.index)
+}
+
+func initSequenceTable(db apid.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS edgex_deployment_sequence (
+		apid_instance_id varchar(36) NOT NULL,
+		commit_sequence int NOT NULL,
+		commit_index int NOT NULL,
+		PRIMARY KEY (apid_instance_id)
+	);
+	`)
+	return err
+}
+
+// getLastSequence() returns the sequence of the last change processed by this instance, zero if none
+func (gd *GatewayDeploy) getLastSequence() (changeSequence, error) {
+	db := gd.getDB()
+	if db == nil {
+		return changeSequence{}, nil
+	}
+
+	var commit, index int64
+	err := db.QueryRow(`
+	SELECT commit_sequence, commit_index FROM edgex_deployment_sequence WHERE apid_instance_id=$1
+	`, gd.apidInstanceID).Scan(&commit, &index)
+	if err == sql.ErrNoRows {
+		return changeSequence{}, nil
+	}
+	if err != nil {
+		return changeSequence{}, err
+	}
+	return changeSequence{uint64(commit), uint32(index)}, nil
+}
+
+func (gd *GatewayDeploy) setLastSequence(seq changeSequence) error {
+	db := gd.getDB()
+	if db == nil {
+		return nil
+	}
+
+	_, err := db.Exec(`
+	INSERT OR REPLACE INTO edgex_deployment_sequence (apid_instance_id, commit_sequence, commit_index)
+	VALUES ($1, $2, $3)
+	`, gd.apidInstanceID, int64(seq.commit), int64(seq.index))
+	return err
+}
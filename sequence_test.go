@@ -0,0 +1,139 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+
+	"github.com/30x/apidGatewayDeploy/testutil"
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("change sequence", func() {
+
+	var (
+		origin *testutil.BundleOrigin
+		other  *GatewayDeploy // not started, so that queued downloads stay queued
+	)
+
+	BeforeEach(func() {
+		origin = testutil.NewBundleOrigin()
+
+		var err error
+		other, err = NewGatewayDeploy(gd.services, Options{Store: &dbStore{}})
+		Expect(err).ShouldNot(HaveOccurred())
+		other.store.SetDB(gd.getDB())
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	// returns an insert of a deployment whose bundle is content, as ApigeeSync has applied it to the DB
+	insertChange := func(id string, content string, commit uint64, index uint32) common.Change {
+		bundleURI := origin.AddBundle("/bundles/"+content, []byte(content))
+		checksum := testutil.Checksum([]byte(content))
+		bundleJSON, err := json.Marshal(bundleConfigJson{URI: bundleURI, ChecksumType: "crc32", Checksum: checksum})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		row := common.Row{}
+		row["id"] = &common.ColumnVal{Value: id}
+		row["data_scope_id"] = &common.ColumnVal{Value: id}
+		row["bundle_config_json"] = &common.ColumnVal{Value: string(bundleJSON)}
+
+		_, err = other.getDB().Exec("DELETE FROM edgex_deployment WHERE id=$1", id)
+		Expect(err).ShouldNot(HaveOccurred())
+		insertBundleDeployment(other.getDB(), id, bundleURI, checksum)
+
+		return common.Change{
+			Operation:      common.Insert,
+			Table:          DEPLOYMENT_TABLE,
+			CommitSequence: commit,
+			CommitIndex:    index,
+			NewRow:         row,
+		}
+	}
+
+	It("should order changes by commit, then index", func() {
+		Expect(changeSequence{}.before(changeSequence{1, 0})).To(BeTrue())
+		Expect(changeSequence{1, 5}.before(changeSequence{2, 0})).To(BeTrue())
+		Expect(changeSequence{2, 0}.before(changeSequence{2, 1})).To(BeTrue())
+		Expect(changeSequence{2, 1}.before(changeSequence{2, 1})).To(BeFalse())
+		Expect(changeSequence{3, 0}.before(changeSequence{2, 9})).To(BeFalse())
+	})
+
+	It("should skip changes already processed", func() {
+		first := insertChange("sequence_first", "first", 10, 0)
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{first}})
+		Expect(other.downloadQueue).To(HaveLen(1))
+		Expect(other.getLastSequence()).To(Equal(changeSequence{10, 0}))
+
+		// redelivered with the next change
+		next := insertChange("sequence_next", "next", 10, 1)
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{first, next}})
+		Expect(other.downloadQueue).To(HaveLen(2))
+		Expect(other.getLastSequence()).To(Equal(changeSequence{10, 1}))
+
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{first, next}})
+		Expect(other.downloadQueue).To(HaveLen(2))
+
+		// recorded per instance
+		fresh, err := NewGatewayDeploy(gd.services, Options{Store: &dbStore{}})
+		Expect(err).ShouldNot(HaveOccurred())
+		fresh.store.SetDB(gd.getDB())
+		Expect(fresh.getLastSequence()).To(Equal(changeSequence{10, 1}))
+	})
+
+	It("should download a redelivered deployment once", func() {
+		change := insertChange("sequence_redelivered", "redelivered", 0, 0)
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{change}})
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{change}})
+		Expect(other.downloadQueue).To(HaveLen(1))
+		Expect(other.downloads.count()).To(Equal(1))
+
+		req := <-other.downloadQueue
+		req.downloadBundle()
+		Expect(origin.Requests("/bundles/redelivered")).To(Equal(1))
+		Expect(other.downloads.count()).To(Equal(0))
+
+		// queued again once the previous download is done
+		other.queueDownloadRequest(req.dep)
+		Expect(other.downloadQueue).To(HaveLen(1))
+	})
+
+	It("should replace an in-flight download when the bundle changes", func() {
+		change := insertChange("sequence_changed", "before", 0, 0)
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{change}})
+		change = insertChange("sequence_changed", "after", 0, 0)
+		other.processChangeList(&common.ChangeList{Changes: []common.Change{change}})
+		Expect(other.downloadQueue).To(HaveLen(2))
+		Expect(other.downloads.count()).To(Equal(1))
+
+		superseded := <-other.downloadQueue
+		superseded.downloadBundle()
+		Expect(origin.Requests("/bundles/before")).To(Equal(0))
+
+		req := <-other.downloadQueue
+		req.downloadBundle()
+		Expect(origin.Requests("/bundles/after")).To(Equal(1))
+		Expect(other.downloads.count()).To(Equal(0))
+
+		deployments, err := other.getDeployments("WHERE id=$1", "sequence_changed")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deployments[0].LocalBundleURI).To(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,311 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// environment variables with this prefix resolve placeholders of the rest of their name
+const TEMPLATE_ENV_PREFIX = "GATEWAYDEPLOY_VAR_"
+
+// template variables from config, from least to most specific
+type templateVarConfig struct {
+	cluster     map[string]string
+	scopes      map[string]map[string]string // by data scope id
+	instance    map[string]string
+	secretsFile string
+}
+
+// the variables a deployment's configuration is resolved with, as read when the ETag changed
+type templateSources struct {
+	config  templateVarConfig
+	secrets map[string]string
+}
+
+// lookup() resolves name from the layered sources, most specific first: secrets file, environment, apid instance,
+// data scope and cluster
+func (s *templateSources) lookup(name, scopeID string) (string, bool) {
+	if v, ok := s.secrets[name]; ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(TEMPLATE_ENV_PREFIX + name); ok {
+		return v, true
+	}
+	if v, ok := s.config.instance[name]; ok {
+		return v, true
+	}
+	if v, ok := s.config.scopes[scopeID][name]; ok {
+		return v, true
+	}
+	v, ok := s.config.cluster[name]
+	return v, ok
+}
+
+type resolvedConfig struct {
+	source     string
+	resolved   string
+	err        error
+	violations []schemaViolation // of the resolved configuration
+}
+
+// resolved configurations are cached until the ETag changes
+type templateCache struct {
+	sync.Mutex
+	eTag     string
+	sources  *templateSources
+	resolved map[string]resolvedConfig // by deployment id
+	reported map[string]string         // configurations reported as unresolvable, by deployment id
+}
+
+func initTemplateVars(cluster, scopes, instance interface{}, secretsFile string) (templateVarConfig, error) {
+	vars := templateVarConfig{secretsFile: secretsFile}
+	var err error
+	if vars.cluster, err = stringMap(cluster); err != nil {
+		return vars, fmt.Errorf("cluster template vars: %v", err)
+	}
+	if vars.instance, err = stringMap(instance); err != nil {
+		return vars, fmt.Errorf("instance template vars: %v", err)
+	}
+	scopeMap, err := toMap(scopes)
+	if err != nil {
+		return vars, fmt.Errorf("scope template vars: %v", err)
+	}
+	vars.scopes = make(map[string]map[string]string, len(scopeMap))
+	for scopeID, v := range scopeMap {
+		if vars.scopes[scopeID], err = stringMap(v); err != nil {
+			return vars, fmt.Errorf("scope %s template vars: %v", scopeID, err)
+		}
+	}
+	if secretsFile != "" {
+		if _, err := readTemplateSecrets(secretsFile); err != nil {
+			return vars, err
+		}
+	}
+	return vars, nil
+}
+
+func readTemplateSecrets(secretsFile string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(secretsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read template secrets file %s: %v", secretsFile, err)
+	}
+	var secrets map[string]string
+	if err = json.Unmarshal(b, &secrets); err != nil {
+		return nil, fmt.Errorf("unable to parse template secrets file %s: %v", secretsFile, err)
+	}
+	return secrets, nil
+}
+
+// toMap() accepts the map types config values are decoded to
+func toMap(v interface{}) (map[string]interface{}, error) {
+	switch m := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			converted[fmt.Sprint(k)] = v
+		}
+		return converted, nil
+	case map[string]string:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			converted[k] = v
+		}
+		return converted, nil
+	}
+	return nil, fmt.Errorf("expected a map, got %T", v)
+}
+
+func stringMap(v interface{}) (map[string]string, error) {
+	m, err := toMap(v)
+	if err != nil {
+		return nil, err
+	}
+	strs := make(map[string]string, len(m))
+	for k, v := range m {
+		strs[k] = fmt.Sprint(v)
+	}
+	return strs, nil
+}
+
+// resolveConfigs() returns deployments with their configuration templates resolved and checked against their
+// schema. Deployments whose configuration can't be resolved or doesn't match are left out and reported to the
+// tracker once.
+func (gd *GatewayDeploy) resolveConfigs(deployments []DataDeployment, eTag string) []DataDeployment {
+	if !gd.templatingEnabled {
+		return deployments
+	}
+
+	resolved, errResults := gd.resolveConfigTemplates(deployments, eTag)
+	if len(errResults) > 0 {
+		go gd.setDeploymentResults(errResults)
+	}
+	return resolved
+}
+
+// forgetReportedConfig() drops the report of a deleted deployment's configuration
+func (gd *GatewayDeploy) forgetReportedConfig(depID string) {
+	gd.templates.Lock()
+	defer gd.templates.Unlock()
+	delete(gd.templates.reported, depID)
+}
+
+func (gd *GatewayDeploy) resolveConfigTemplates(deployments []DataDeployment, eTag string) ([]DataDeployment,
+	apiDeploymentResults) {
+
+	gd.templates.Lock()
+	defer gd.templates.Unlock()
+
+	if gd.templates.reported == nil {
+		gd.templates.reported = make(map[string]string)
+	}
+
+	if gd.templates.eTag != eTag || gd.templates.sources == nil {
+		sources := &templateSources{config: gd.templateVars}
+		if gd.templateVars.secretsFile != "" {
+			secrets, err := readTemplateSecrets(gd.templateVars.secretsFile)
+			if err != nil {
+				log.Errorf("%v", err)
+			}
+			sources.secrets = secrets
+		}
+		gd.templates.eTag = eTag
+		gd.templates.sources = sources
+		gd.templates.resolved = make(map[string]resolvedConfig)
+	}
+
+	var resolved []DataDeployment
+	var errResults apiDeploymentResults
+	for _, d := range deployments {
+		rc, ok := gd.templates.resolved[d.ID]
+		if !ok || rc.source != d.ConfigJSON {
+			rc = resolvedConfig{source: d.ConfigJSON}
+			rc.resolved, rc.err = resolveConfigTemplate(d.ConfigJSON, func(name string) (string, bool) {
+				return gd.templates.sources.lookup(name, d.DataScopeID)
+			})
+			if rc.err != nil {
+				log.Errorf("unable to resolve configuration of deployment %s: %v", d.ID, rc.err)
+			} else if rc.resolved != d.ConfigJSON {
+				// placeholders were skipped when the bundle was downloaded
+				resolvedDep := d
+				resolvedDep.ConfigJSON = rc.resolved
+				rc.violations = gd.validateDeploymentConfig(resolvedDep, d.LocalBundleURI, false)
+				if len(rc.violations) > 0 {
+					rc.err = errors.New(schemaViolationsMessage(rc.violations))
+					log.Errorf("resolved configuration of deployment %s rejected: %v", d.ID, rc.err)
+				}
+			}
+			gd.templates.resolved[d.ID] = rc
+		}
+		if rc.err != nil {
+			if gd.templates.reported[d.ID] != d.ConfigJSON {
+				gd.templates.reported[d.ID] = d.ConfigJSON
+				result := apiDeploymentResult{
+					ID:         d.ID,
+					Status:     RESPONSE_STATUS_FAIL,
+					ErrorCode:  TRACKER_ERR_DEPLOYMENT_BAD_CONFIG,
+					Message:    fmt.Sprintf("unable to resolve configuration: %v", rc.err),
+					Violations: rc.violations,
+				}
+				if len(rc.violations) > 0 {
+					result.Message = "resolved " + rc.err.Error()
+				}
+				errResults = append(errResults, result)
+			}
+			continue
+		}
+		delete(gd.templates.reported, d.ID)
+		d.ConfigJSON = rc.resolved
+		resolved = append(resolved, d)
+	}
+	return resolved, errResults
+}
+
+// hasTemplatePlaceholder() returns true if s has a ${name} placeholder that isn't escaped as $${
+func hasTemplatePlaceholder(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "$${") {
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(s[i:], "${") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConfigTemplate() replaces ${name} placeholders within the string values of a JSON configuration.
+// Values are JSON escaped and $${ produces a literal ${. The result must be valid JSON.
+func resolveConfigTemplate(config string, lookup func(name string) (string, bool)) (string, error) {
+	if !strings.Contains(config, "${") {
+		if !json.Valid([]byte(config)) {
+			return "", fmt.Errorf("configuration is not valid JSON")
+		}
+		return config, nil
+	}
+
+	var out bytes.Buffer
+	inString := false
+	for i := 0; i < len(config); i++ {
+		c := config[i]
+		switch {
+		case !inString:
+			inString = c == '"'
+		case c == '\\' && i+1 < len(config):
+			out.WriteByte(c)
+			i++
+			c = config[i]
+		case c == '"':
+			inString = false
+		case c == '$' && strings.HasPrefix(config[i:], "$${"):
+			out.WriteString("${")
+			i += 2
+			continue
+		case c == '$' && strings.HasPrefix(config[i:], "${"):
+			end := strings.IndexByte(config[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated placeholder at offset %d", i)
+			}
+			name := config[i+2 : i+end]
+			value, ok := lookup(name)
+			if !ok {
+				return "", fmt.Errorf("unresolved placeholder ${%s}", name)
+			}
+			quoted, _ := json.Marshal(value)
+			out.Write(quoted[1 : len(quoted)-1])
+			i += end
+			continue
+		}
+		out.WriteByte(c)
+	}
+
+	resolved := out.String()
+	if !json.Valid([]byte(resolved)) {
+		return "", fmt.Errorf("resolved configuration is not valid JSON")
+	}
+	return resolved, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("templates", func() {
+
+	lookup := func(vars map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			v, ok := vars[name]
+			return v, ok
+		}
+	}
+
+	It("should resolve placeholders within strings", func() {
+		resolved, err := resolveConfigTemplate(`{"host": "${host}:${port}", "raw": "$${host}", "esc": "\"${q}\""}`,
+			lookup(map[string]string{"host": "example.com", "port": "8080", "q": `a"b`}))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(resolved).To(Equal(`{"host": "example.com:8080", "raw": "${host}", "esc": "\"a\"b\""}`))
+	})
+
+	It("should reject unresolved placeholders and invalid JSON", func() {
+		_, err := resolveConfigTemplate(`{"host": "${missing}"}`, lookup(nil))
+		Expect(err).Should(HaveOccurred())
+
+		_, err = resolveConfigTemplate(`{"host": "${unterminated"}`, lookup(nil))
+		Expect(err).Should(HaveOccurred())
+
+		_, err = resolveConfigTemplate(`{"port": ${port}}`, lookup(map[string]string{"port": "8080"}))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should layer template variables", func() {
+		secretsFile := path.Join(gd.bundlePath, "template_secrets.json")
+		Expect(ioutil.WriteFile(secretsFile, []byte(`{"password": "secret"}`), 0600)).To(Succeed())
+		defer os.Remove(secretsFile)
+		os.Setenv(TEMPLATE_ENV_PREFIX+"region", "env-region")
+		defer os.Unsetenv(TEMPLATE_ENV_PREFIX + "region")
+
+		vars, err := initTemplateVars(
+			map[string]interface{}{"region": "cluster-region", "tier": "cluster-tier", "zone": "cluster-zone"},
+			map[interface{}]interface{}{"scope1": map[interface{}]interface{}{"tier": "scope-tier", "zone": 1}},
+			map[string]interface{}{"zone": "instance-zone"},
+			secretsFile)
+		Expect(err).ShouldNot(HaveOccurred())
+		sources := &templateSources{config: vars}
+		sources.secrets, err = readTemplateSecrets(secretsFile)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		resolve := func(name, scopeID string) string {
+			v, ok := sources.lookup(name, scopeID)
+			Expect(ok).To(BeTrue())
+			return v
+		}
+		Expect(resolve("password", "scope1")).To(Equal("secret"))
+		Expect(resolve("region", "scope1")).To(Equal("env-region"))
+		Expect(resolve("zone", "scope1")).To(Equal("instance-zone"))
+		Expect(resolve("tier", "scope1")).To(Equal("scope-tier"))
+		Expect(resolve("tier", "scope2")).To(Equal("cluster-tier"))
+
+		_, err = initTemplateVars([]string{"region"}, nil, nil, "")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	Context("API", func() {
+
+		var saveEnabled bool
+		var saveVars templateVarConfig
+
+		BeforeEach(func() {
+			saveEnabled, saveVars = gd.templatingEnabled, gd.templateVars
+			gd.templatingEnabled = true
+			gd.templateVars = templateVarConfig{cluster: map[string]string{"greeting": "hello"}}
+		})
+
+		AfterEach(func() {
+			gd.templatingEnabled, gd.templateVars = saveEnabled, saveVars
+		})
+
+		It("should serve resolved configurations and leave out unresolvable ones", func() {
+
+			setConfig := func(depID, config string) {
+				insertTestDeployment(testServer, depID)
+				_, err := gd.getDB().Exec("UPDATE edgex_deployment SET config_json=$1 WHERE id=$2", config, depID)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+			setConfig("template_resolved", `{"greeting": "${greeting}"}`)
+			setConfig("template_unresolved", `{"greeting": "${farewell}"}`)
+			gd.incrementETag()
+
+			res, err := http.Get(testServer.URL + deploymentsEndpoint)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var depRes ApiDeploymentResponse
+			Expect(json.Unmarshal(body, &depRes)).To(Succeed())
+			Expect(depRes).To(HaveLen(1))
+			Expect(depRes[0].ID).To(Equal("template_resolved"))
+			Expect(string(depRes[0].ConfigJson)).To(MatchJSON(`{"greeting": "hello"}`))
+		})
+
+		It("should withhold resolved configurations not matching their schema", func() {
+
+			schema, err := parseSchema([]byte(`{"properties": {"port": {"type": "string", "pattern": "^[0-9]+$"}}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			gd.configSchemas = map[string]*jsonSchema{"templated": schema}
+			defer func() { gd.configSchemas = nil }()
+
+			depID := "template_schema"
+			events := listenForDeploymentEvents(depID)
+			insertTestDeployment(testServer, depID)
+			_, err = gd.getDB().Exec("UPDATE edgex_deployment SET bundle_config_json=$1, config_json=$2 WHERE id=$3",
+				`{"type": "templated"}`, `{"port": "${port}"}`, depID)
+			Expect(err).ShouldNot(HaveOccurred())
+			deployments, err := gd.getDeployments("WHERE id=$1", depID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			gd.templateVars = templateVarConfig{cluster: map[string]string{"port": "eighty"}}
+			Expect(gd.resolveConfigs(deployments, "1")).To(BeEmpty())
+
+			var event interface{}
+			Eventually(events, 2).Should(Receive(&event))
+			failed, ok := event.(*DeploymentFailed)
+			Expect(ok).To(BeTrue())
+			Expect(failed.ErrorCode).To(Equal(TRACKER_ERR_DEPLOYMENT_BAD_CONFIG))
+			Expect(failed.Message).To(ContainSubstring("/port"))
+
+			gd.templateVars = templateVarConfig{cluster: map[string]string{"port": "80"}}
+			resolved := gd.resolveConfigs(deployments, "2")
+			Expect(resolved).To(HaveLen(1))
+			Expect(resolved[0].ConfigJSON).To(MatchJSON(`{"port": "80"}`))
+		})
+
+		It("should report unresolvable configurations once", func() {
+
+			depID := "template_reported"
+			events := listenForDeploymentEvents(depID)
+			insertTestDeployment(testServer, depID)
+			_, err := gd.getDB().Exec("UPDATE edgex_deployment SET config_json=$1 WHERE id=$2",
+				`{"greeting": "${farewell}"}`, depID)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			deployments, err := gd.getDeployments("WHERE id=$1", depID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(gd.resolveConfigs(deployments, "1")).To(BeEmpty())
+			Expect(gd.resolveConfigs(deployments, "2")).To(BeEmpty())
+
+			var event interface{}
+			Eventually(events, 2).Should(Receive(&event))
+			failed, ok := event.(*DeploymentFailed)
+			Expect(ok).To(BeTrue())
+			Expect(failed.ErrorCode).To(Equal(TRACKER_ERR_DEPLOYMENT_BAD_CONFIG))
+			Expect(failed.Message).To(ContainSubstring("${farewell}"))
+			Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+
+			deployments, err = gd.getDeployments("WHERE id=$1", depID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deployments[0].DeployStatus).To(Equal(RESPONSE_STATUS_FAIL))
+			Expect(deployments[0].DeployErrorCode).To(Equal(TRACKER_ERR_DEPLOYMENT_BAD_CONFIG))
+
+			// the report goes with the deployment
+			_, err = gd.getDB().Exec("DELETE FROM edgex_deployment WHERE id=$1", depID)
+			Expect(err).ShouldNot(HaveOccurred())
+			row := common.Row{}
+			row["id"] = &common.ColumnVal{Value: depID}
+			gd.processChangeList(&common.ChangeList{Changes: []common.Change{{
+				Operation: common.Delete,
+				Table:     DEPLOYMENT_TABLE,
+				OldRow:    row,
+			}}})
+			gd.templates.Lock()
+			defer gd.templates.Unlock()
+			Expect(gd.templates.reported).NotTo(HaveKey(depID))
+		})
+	})
+})
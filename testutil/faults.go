@@ -0,0 +1,140 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil provides in-process fakes of the servers apidGatewayDeploy talks to, a bundle origin and a
+// tracker, whose responses can be scripted to inject faults.
+package testutil
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Fault scripts one response of a fake server. The zero Fault responds normally. Faults combine, Latency first:
+//
+//	Fault{Latency: time.Second}             // responds after a second, or not at all if the client gives up first
+//	Fault{ResetAfter: 5}                    // sends the headers and 5 bytes of content, then resets the connection
+//	Fault{WrongBytes: true}                 // serves content of the right length that fails its checksum
+//	Repeat(3, Status(503))                  // answers the next 3 requests 503 without content
+//	Fault{DripEvery: 50 * time.Millisecond} // serves the content a byte at a time
+//	Status(401)                             // rejects the credentials, as a Tracker does itself with RequireToken()
+type Fault struct {
+	Latency    time.Duration // before responding
+	Status     int           // responds with this status and no content, unless 0 or 200
+	Drop       bool          // resets the connection without responding
+	Body       []byte        // served instead of the content
+	WrongBytes bool          // serves the content with each byte inverted
+	ResetAfter int           // resets the connection after this many bytes of content, if > 0
+	DripEvery  time.Duration // serves the content a byte at a time, each after this long, if > 0
+}
+
+// Status() returns a Fault responding with status
+func Status(status int) Fault {
+	return Fault{Status: status}
+}
+
+// Repeat() returns n copies of f, e.g. for a sequence of 5xx responses
+func Repeat(n int, f Fault) []Fault {
+	faults := make([]Fault, n)
+	for i := range faults {
+		faults[i] = f
+	}
+	return faults
+}
+
+// status() returns the status a client sees, 0 for none
+func (f Fault) status() int {
+	switch {
+	case f.Drop:
+		return 0
+	case f.Status != 0:
+		return f.Status
+	}
+	return http.StatusOK
+}
+
+// serve() responds to r with content, as scripted by f
+func (f Fault) serve(w http.ResponseWriter, r *http.Request, content []byte) {
+
+	if f.Latency > 0 && !wait(r, f.Latency) {
+		return
+	}
+	if f.Drop {
+		reset(w)
+		return
+	}
+	if f.Status != 0 && f.Status != http.StatusOK {
+		w.WriteHeader(f.Status)
+		return
+	}
+
+	body := content
+	if f.Body != nil {
+		body = f.Body
+	}
+	if f.WrongBytes {
+		inverted := make([]byte, len(body))
+		for i, b := range body {
+			inverted[i] = ^b
+		}
+		body = inverted
+	}
+
+	// clients detect a reset from the missing content
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+
+	switch {
+	case f.ResetAfter > 0 && f.ResetAfter < len(body):
+		w.Write(body[:f.ResetAfter])
+		flush(w)
+		reset(w)
+	case f.DripEvery > 0:
+		for i := range body {
+			if !wait(r, f.DripEvery) {
+				return
+			}
+			w.Write(body[i : i+1])
+			flush(w)
+		}
+	default:
+		w.Write(body)
+	}
+}
+
+// wait() returns false if the client goes away first
+func wait(r *http.Request, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// reset() closes the connection, dropping anything not flushed
+func reset(w http.ResponseWriter) {
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"encoding/hex"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// BundleOrigin is a fake bundle server. Each GET of a bundle path uses up the next scripted fault for the path,
+// if any, and otherwise serves the bundle.
+type BundleOrigin struct {
+	*httptest.Server
+	mux      sync.Mutex
+	bundles  map[string][]byte
+	faults   map[string][]Fault
+	requests map[string]int
+}
+
+// NewBundleOrigin() starts a BundleOrigin without bundles, answering 404 to unscripted requests of unknown paths.
+// Close() stops it.
+func NewBundleOrigin() *BundleOrigin {
+	o := &BundleOrigin{
+		bundles:  make(map[string][]byte),
+		faults:   make(map[string][]Fault),
+		requests: make(map[string]int),
+	}
+	o.Server = httptest.NewServer(http.HandlerFunc(o.handle))
+	return o
+}
+
+// AddBundle() serves content at path and returns its URI
+func (o *BundleOrigin) AddBundle(path string, content []byte) string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.bundles[path] = content
+	return o.URL + path
+}
+
+// Script() adds faults for the next requests of path, one request each
+func (o *BundleOrigin) Script(path string, faults ...Fault) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.faults[path] = append(o.faults[path], faults...)
+}
+
+// Requests() returns the number of requests of path so far
+func (o *BundleOrigin) Requests(path string) int {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.requests[path]
+}
+
+func (o *BundleOrigin) handle(w http.ResponseWriter, r *http.Request) {
+
+	o.mux.Lock()
+	path := r.URL.Path
+	o.requests[path]++
+	content, ok := o.bundles[path]
+	var f Fault
+	scripted := len(o.faults[path]) > 0
+	if scripted {
+		f = o.faults[path][0]
+		o.faults[path] = o.faults[path][1:]
+	}
+	o.mux.Unlock()
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !ok && !scripted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.serve(w, r, content)
+}
+
+// Checksum() returns the crc32 checksum of content, as given with a bundle checksum type of "crc32"
+func Checksum(content []byte) string {
+	hashWriter := crc32.NewIEEE()
+	hashWriter.Write(content)
+	return hex.EncodeToString(hashWriter.Sum(nil))
+}
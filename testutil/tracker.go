@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Tracker is a fake tracking service. Each request uses up the next scripted fault, if any, and is otherwise
+// answered 200 OK. With a required token, requests without it are answered 401 without using up a fault.
+type Tracker struct {
+	*httptest.Server
+	mux      sync.Mutex
+	token    string
+	faults   []Fault
+	requests []TrackerRequest
+}
+
+// TrackerRequest is a request received by a Tracker
+type TrackerRequest struct {
+	Method string
+	Path   string      // e.g. /clusters/{clusterID}/apids/{instanceID}/deployments
+	Header http.Header // as received, including Authorization
+	Body   []byte      // read in full before answering
+	Status int         // answered, 0 if the connection was reset
+}
+
+// NewTracker() starts a Tracker accepting any request until scripted or given a required token. Close() stops it.
+func NewTracker() *Tracker {
+	t := &Tracker{}
+	t.Server = httptest.NewServer(http.HandlerFunc(t.handle))
+	return t
+}
+
+// RequireToken() answers 401 to requests without an "Authorization: Bearer <token>" header. "" accepts any.
+func (t *Tracker) RequireToken(token string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.token = token
+}
+
+// Script() adds faults for the next requests, one request each
+func (t *Tracker) Script(faults ...Fault) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.faults = append(t.faults, faults...)
+}
+
+// Requests() returns the requests received so far
+func (t *Tracker) Requests() []TrackerRequest {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return append([]TrackerRequest(nil), t.requests...)
+}
+
+// Accepted() returns the requests answered 200 OK so far
+func (t *Tracker) Accepted() []TrackerRequest {
+	var accepted []TrackerRequest
+	for _, req := range t.Requests() {
+		if req.Status == http.StatusOK {
+			accepted = append(accepted, req)
+		}
+	}
+	return accepted
+}
+
+func (t *Tracker) handle(w http.ResponseWriter, r *http.Request) {
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	t.mux.Lock()
+	var f Fault
+	if t.token != "" && r.Header.Get("Authorization") != "Bearer "+t.token {
+		f = Status(http.StatusUnauthorized)
+	} else if len(t.faults) > 0 {
+		f = t.faults[0]
+		t.faults = t.faults[1:]
+	}
+	t.requests = append(t.requests, TrackerRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header,
+		Body:   body,
+		Status: f.status(),
+	})
+	t.mux.Unlock()
+
+	f.serve(w, r, []byte("OK"))
+}
@@ -0,0 +1,332 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	webhooksEndpoint = "/deployments/webhooks"
+	webhookEndpoint  = "/deployments/webhooks/{id}"
+)
+
+const (
+	WEBHOOK_MODE_FULL   = "full"   // POST the deployments, as returned by GET /deployments
+	WEBHOOK_MODE_NOTICE = "notice" // POST only the new ETag
+)
+
+const (
+	webhookSignatureHeader = "X-Deployments-Signature" // "sha256=" hex HMAC of the body with the secret
+	webhookETagHeader      = "X-Deployments-ETag"
+)
+
+// per delivery attempt
+const webhookTimeout = 30 * time.Second
+
+// sent to and received from client
+type apiWebhook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Mode   string `json:"mode"`
+	Secret string `json:"secret,omitempty"`
+}
+
+type apiWebhookNotice struct {
+	ETag string `json:"eTag"`
+}
+
+// a registered callback. Deliveries are filtered like GET /deployments for the client and gateway that
+// registered it.
+type webhook struct {
+	apiWebhook
+	gd           *GatewayDeploy
+	client       *apiClient
+	gateway      gatewayIdentity
+	mux          sync.Mutex
+	latestETag   string
+	failedInARow int
+}
+
+type webhookRegistry struct {
+	sync.RWMutex
+	registrations map[string]*webhook
+}
+
+func newWebhookRegistry() *webhookRegistry {
+	return &webhookRegistry{registrations: make(map[string]*webhook)}
+}
+
+func (reg *webhookRegistry) add(w *webhook) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.registrations[w.ID] = w
+}
+
+func (reg *webhookRegistry) remove(id string) bool {
+	reg.Lock()
+	defer reg.Unlock()
+	_, ok := reg.registrations[id]
+	delete(reg.registrations, id)
+	return ok
+}
+
+func (reg *webhookRegistry) list(client *apiClient) []*webhook {
+	reg.RLock()
+	defer reg.RUnlock()
+	var hooks []*webhook
+	for _, w := range reg.registrations {
+		if client == nil || w.client == client {
+			hooks = append(hooks, w)
+		}
+	}
+	return hooks
+}
+
+func (gd *GatewayDeploy) initWebhooksAPI() {
+	gd.services.API().HandleFunc(webhooksEndpoint,
+		gd.instrumentAPI(gd.authorize(PERMISSION_WEBHOOK, gd.apiRegisterWebhook))).Methods("POST")
+	gd.services.API().HandleFunc(webhooksEndpoint,
+		gd.instrumentAPI(gd.authorize(PERMISSION_WEBHOOK, gd.apiListWebhooks))).Methods("GET")
+	gd.services.API().HandleFunc(webhookEndpoint,
+		gd.instrumentAPI(gd.authorize(PERMISSION_WEBHOOK, gd.apiDeleteWebhook))).Methods("DELETE")
+}
+
+func (gd *GatewayDeploy) apiRegisterWebhook(w http.ResponseWriter, r *http.Request) {
+
+	// without authentication anyone could make apid POST deployments anywhere
+	if !gd.apiAuth.enabled() {
+		writeError(w, http.StatusForbidden, API_ERR_FORBIDDEN, "webhooks require API authentication")
+		return
+	}
+
+	var reg apiWebhook
+	buf, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(buf, &reg); err != nil {
+		writeError(w, http.StatusBadRequest, API_ERR_BAD_JSON, "Malformed JSON")
+		return
+	}
+
+	if u, err := url.Parse(reg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, API_ERR_BAD_CONTENT, "url must be an absolute http or https URL")
+		return
+	}
+	if reg.Mode == "" {
+		reg.Mode = WEBHOOK_MODE_FULL
+	}
+	if reg.Mode != WEBHOOK_MODE_FULL && reg.Mode != WEBHOOK_MODE_NOTICE {
+		writeError(w, http.StatusBadRequest, API_ERR_BAD_CONTENT,
+			fmt.Sprintf("mode must be '%s' or '%s'", WEBHOOK_MODE_FULL, WEBHOOK_MODE_NOTICE))
+		return
+	}
+
+	var err error
+	if reg.ID, err = randomHex(16); err == nil && reg.Secret == "" {
+		reg.Secret, err = randomHex(32)
+	}
+	if err != nil {
+		log.Errorf("unable to generate webhook id or secret: %v", err)
+		writeError(w, http.StatusInternalServerError, API_ERR_INTERNAL, "unable to register webhook")
+		return
+	}
+
+	hook := &webhook{
+		apiWebhook: reg,
+		gd:         gd,
+		client:     clientFromRequest(r),
+		gateway:    gatewayFromRequest(r),
+	}
+	gd.webhooks.add(hook)
+	log.Infof("registered webhook %s: %s", reg.ID, reg.URL)
+
+	b, _ := json.Marshal(reg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func (gd *GatewayDeploy) apiListWebhooks(w http.ResponseWriter, r *http.Request) {
+
+	client := clientFromRequest(r)
+	if client == unrestrictedClient {
+		client = nil // all registrations
+	}
+
+	list := []apiWebhook{}
+	for _, hook := range gd.webhooks.list(client) {
+		reg := hook.apiWebhook
+		reg.Secret = ""
+		list = append(list, reg)
+	}
+
+	b, _ := json.Marshal(list)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (gd *GatewayDeploy) apiDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+
+	id := gd.services.API().Vars(r)["id"]
+
+	gd.webhooks.RLock()
+	hook, ok := gd.webhooks.registrations[id]
+	gd.webhooks.RUnlock()
+
+	client := clientFromRequest(r)
+	if !ok || (client != unrestrictedClient && hook.client != client) {
+		writeError(w, http.StatusNotFound, API_ERR_BAD_CONTENT, "no such webhook")
+		return
+	}
+
+	gd.webhooks.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyWebhooks() delivers new deployments to each registered webhook
+func (gd *GatewayDeploy) notifyWebhooks(deployments []DataDeployment, eTag string) {
+	hooks := gd.webhooks.list(nil)
+	if len(hooks) == 0 {
+		return
+	}
+
+	deployments = gd.resolveConfigs(deployments, eTag)
+	rollouts, err := gd.getRolloutViews(deployments)
+	if err != nil {
+		log.Errorf("unable to notify webhooks: %v", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		var body []byte
+		if hook.Mode == WEBHOOK_MODE_NOTICE {
+			body, err = json.Marshal(apiWebhookNotice{ETag: eTag})
+		} else {
+			deps := filterDeploymentsForClient(hook.client, deployments)
+			deps = filterDeploymentsForGateway(hook.gateway, deps, rollouts)
+			apiDeps := ApiDeploymentResponse{}
+			for _, d := range deps {
+				apiDeps = append(apiDeps, apiDeploymentFromData(d))
+			}
+			body, err = json.Marshal(apiDeps)
+		}
+		if err != nil {
+			log.Errorf("unable to marshal webhook %s payload: %v", hook.ID, err)
+			continue
+		}
+
+		hook.mux.Lock()
+		hook.latestETag = eTag
+		hook.mux.Unlock()
+
+		go hook.deliver(body, eTag)
+	}
+}
+
+// deliver() POSTs body, retrying with backoff until it succeeds, webhookMaxAttempts is reached or a newer
+// delivery supersedes it
+func (hook *webhook) deliver(body []byte, eTag string) {
+
+	backOffFunc := hook.gd.createBackoff(hook.gd.webhookRetryDelay, 5*time.Minute)
+	signature := "sha256=" + signWebhookPayload(hook.Secret, body)
+
+	for attempt := 1; ; attempt++ {
+		if hook.superseded(eTag) {
+			log.Debugf("webhook %s delivery of %s superseded", hook.ID, eTag)
+			return
+		}
+
+		err := hook.post(body, signature, eTag)
+		if err == nil {
+			hook.mux.Lock()
+			hook.failedInARow = 0
+			hook.mux.Unlock()
+			return
+		}
+		log.Warnf("webhook %s delivery of %s attempt %d failed: %v", hook.ID, eTag, attempt, err)
+
+		if hook.gd.lifecycle.stopping() {
+			return
+		}
+		if attempt >= hook.gd.webhookMaxAttempts {
+			break
+		}
+		backOffFunc()
+	}
+
+	hook.mux.Lock()
+	hook.failedInARow++
+	dead := hook.failedInARow >= hook.gd.webhookMaxFailedDeliveries
+	hook.mux.Unlock()
+
+	if dead && hook.gd.webhooks.remove(hook.ID) {
+		log.Warnf("dropped webhook %s after %d failed deliveries: %s", hook.ID, hook.gd.webhookMaxFailedDeliveries, hook.URL)
+	}
+}
+
+func (hook *webhook) superseded(eTag string) bool {
+	hook.mux.Lock()
+	defer hook.mux.Unlock()
+	return hook.latestETag != eTag
+}
+
+func (hook *webhook) post(body []byte, signature, eTag string) error {
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signature)
+	req.Header.Set(webhookETagHeader, eTag)
+
+	ctx, cancel := context.WithTimeout(hook.gd.lifecycle.ctx, webhookTimeout)
+	defer cancel()
+	resp, err := hook.gd.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status %d", hook.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiGatewayDeploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("webhooks", func() {
+
+	var saveAttempts, saveFailures int
+	var saveDelay time.Duration
+
+	BeforeEach(func() {
+		saveAttempts, saveFailures, saveDelay = gd.webhookMaxAttempts, gd.webhookMaxFailedDeliveries, gd.webhookRetryDelay
+		gd.webhookRetryDelay = 10 * time.Millisecond
+		gd.apiAuth = apiAuthConfig{token: "shared-secret"}
+	})
+
+	AfterEach(func() {
+		gd.webhookMaxAttempts, gd.webhookMaxFailedDeliveries, gd.webhookRetryDelay = saveAttempts, saveFailures, saveDelay
+		for _, hook := range gd.webhooks.list(nil) {
+			gd.webhooks.remove(hook.ID)
+		}
+	})
+
+	post := func(token string, payload []byte) *http.Response {
+		req, err := http.NewRequest("POST", testServer.URL+webhooksEndpoint, bytes.NewReader(payload))
+		Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		return res
+	}
+
+	register := func(reg apiWebhook) apiWebhook {
+		payload, err := json.Marshal(reg)
+		Expect(err).ShouldNot(HaveOccurred())
+		res := post("shared-secret", payload)
+		defer res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).ShouldNot(HaveOccurred())
+		var registered apiWebhook
+		Expect(json.Unmarshal(body, &registered)).To(Succeed())
+		return registered
+	}
+
+	It("should POST signed deployments when they change", func() {
+
+		type delivery struct {
+			body      []byte
+			signature string
+			eTag      string
+		}
+		deliveries := make(chan delivery, 10)
+		callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			deliveries <- delivery{body, r.Header.Get(webhookSignatureHeader), r.Header.Get(webhookETagHeader)}
+		}))
+		defer callback.Close()
+
+		reg := register(apiWebhook{URL: callback.URL, Secret: "s3cret"})
+		Expect(reg.ID).ShouldNot(BeEmpty())
+		Expect(reg.Mode).To(Equal(WEBHOOK_MODE_FULL))
+
+		deploymentID := "webhook_deployment"
+		insertTestDeployment(testServer, deploymentID)
+		gd.deploymentsChanged <- deploymentID
+
+		var d delivery
+		Eventually(deliveries, 2*time.Second).Should(Receive(&d))
+		Expect(d.signature).To(Equal("sha256=" + signWebhookPayload("s3cret", d.body)))
+		Expect(d.eTag).ShouldNot(BeEmpty())
+
+		var depRes ApiDeploymentResponse
+		Expect(json.Unmarshal(d.body, &depRes)).To(Succeed())
+		Expect(depRes).To(HaveLen(1))
+		Expect(depRes[0].ID).To(Equal(deploymentID))
+	})
+
+	It("should retry and drop dead registrations", func() {
+
+		gd.webhookMaxAttempts, gd.webhookMaxFailedDeliveries = 3, 1
+
+		var attempts int32
+		callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer callback.Close()
+
+		reg := register(apiWebhook{URL: callback.URL, Mode: WEBHOOK_MODE_NOTICE})
+		gd.notifyWebhooks(nil, "webhook_etag")
+
+		Eventually(func() int { return len(gd.webhooks.list(nil)) }, 2*time.Second).Should(BeZero())
+		Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(3)))
+
+		req, err := http.NewRequest("DELETE", testServer.URL+webhooksEndpoint+"/"+reg.ID, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer shared-secret")
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should reject invalid registrations", func() {
+		res := post("shared-secret", []byte(`{"url": "ftp://example.com"}`))
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should only register webhooks of authenticated clients with the webhook permission", func() {
+		gd.apiAuth = apiAuthConfig{
+			clients: []apiClient{
+				{Name: "reader", Token: "reader-token", Permissions: []string{PERMISSION_READ}},
+				{Name: "subscriber", Token: "subscriber-token", Permissions: []string{PERMISSION_READ, PERMISSION_WEBHOOK}},
+			},
+		}
+		payload := []byte(`{"url": "http://example.com/hook"}`)
+
+		res := post("reader-token", payload)
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+
+		res = post("subscriber-token", payload)
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusCreated))
+
+		gd.apiAuth = apiAuthConfig{}
+		res = post("", payload)
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(gd.webhooks.list(nil)).To(HaveLen(1))
+	})
+})